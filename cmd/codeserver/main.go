@@ -1,7 +1,10 @@
 package main
 
-import "codeserver/internal"
+import (
+	"codeserver/internal"
+	"os"
+)
 
 func main() {
-	internal.Serve()
+	internal.Main(os.Args[1:])
 }
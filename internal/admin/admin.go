@@ -0,0 +1,254 @@
+package admin
+
+import (
+	"codeserver/internal/audit"
+	"codeserver/internal/auth"
+	"codeserver/internal/principal"
+	"codeserver/internal/storage"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// API is the administration API over the auth and storage services
+type API struct {
+	auth    *auth.Service
+	storage *storage.Service
+	audit   *audit.Log
+}
+
+func New(auth *auth.Service, storage *storage.Service, audit *audit.Log) *API {
+	return &API{auth: auth, storage: storage, audit: audit}
+}
+
+// Handler serves the administration API, it has to be mounted behind the
+// authentication and admin-role middlewares
+func (a *API) Handler() http.Handler {
+	adminHandler := http.NewServeMux()
+	adminHandler.HandleFunc("GET /users", a.listUsers)
+	adminHandler.HandleFunc("POST /users/{username}/disable", a.setDisabled(true))
+	adminHandler.HandleFunc("POST /users/{username}/enable", a.setDisabled(false))
+	adminHandler.HandleFunc("POST /users/{username}/logout", a.logoutUser)
+	adminHandler.HandleFunc("PUT /users/{username}/role", a.setRole)
+	adminHandler.HandleFunc("POST /unlock", a.unlock)
+	adminHandler.HandleFunc("POST /invites", a.mintInvite)
+
+	adminHandler.HandleFunc("GET /objects", a.listObjects)
+	adminHandler.HandleFunc("DELETE /objects/{id}", a.deleteObject)
+	adminHandler.HandleFunc("GET /usage", a.usage)
+
+	adminHandler.HandleFunc("GET /audit", a.events)
+	return adminHandler
+}
+
+// page reads limit (default 50, at most 500) and offset from the query
+func page(r *http.Request) (int, int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return min(limit, 500), offset
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// record audits an action of the administrator making the request
+func (a *API) record(r *http.Request, typ, username, subject, detail string) {
+	e := audit.FromRequest(r, typ)
+	e.Actor = principal.Username(r)
+	e.Username = username
+	e.Subject = subject
+	e.Success = true
+	e.Detail = detail
+	a.audit.Record(e)
+}
+
+// userStatus maps errors of the user operations to HTTP status codes
+func userStatus(err error) int {
+	if err == auth.ErrUserNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// listUsers searches users by email or username
+// q: optional, limit: optional, offset: optional
+func (a *API) listUsers(w http.ResponseWriter, r *http.Request) {
+	limit, offset := page(r)
+	users, err := a.auth.SearchUsers(r.URL.Query().Get("q"), limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type user struct {
+		Email         string `json:"email"`
+		Username      string `json:"username"`
+		CreatedAt     string `json:"created_at"`
+		EmailVerified bool   `json:"email_verified"`
+		Role          string `json:"role"`
+		Disabled      bool   `json:"disabled"`
+	}
+	resp := make([]user, 0, len(users))
+	for _, u := range users {
+		resp = append(resp, user{u.Email, u.Username, u.CreatedAt, u.EmailVerified, u.Role, u.Disabled})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a *API) setDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+		if disabled && username == principal.Username(r) {
+			http.Error(w, "can't disable your own account", http.StatusBadRequest)
+			return
+		}
+		if err := a.auth.SetDisabled(username, disabled); err != nil {
+			http.Error(w, err.Error(), userStatus(err))
+			return
+		}
+		if disabled {
+			a.record(r, audit.UserDisable, username, username, "")
+			a.record(r, audit.SessionRevoke, username, username, "reason=disabled scope=all")
+		} else {
+			a.record(r, audit.UserEnable, username, username, "")
+		}
+		slog.InfoContext(r.Context(), "user disabled set by admin", "admin", principal.Username(r), "username", username, "disabled", disabled)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}
+}
+
+// logoutUser ends every session of the user
+func (a *API) logoutUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	if err := a.auth.RevokeSessions(username); err != nil {
+		http.Error(w, err.Error(), userStatus(err))
+		return
+	}
+	a.record(r, audit.SessionRevoke, username, username, "reason=admin scope=all")
+	slog.InfoContext(r.Context(), "user logged out by admin", "admin", principal.Username(r), "username", username)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// setRole changes the role of a user
+// body: {"role": "user" | "admin"}
+func (a *API) setRole(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	username := r.PathValue("username")
+	if data.Role != auth.RoleUser && data.Role != auth.RoleAdmin {
+		http.Error(w, "role must be user or admin", http.StatusBadRequest)
+		return
+	}
+	if username == principal.Username(r) && data.Role != auth.RoleAdmin {
+		http.Error(w, "can't demote yourself", http.StatusBadRequest)
+		return
+	}
+	if err := a.auth.SetRole(username, data.Role); err != nil {
+		http.Error(w, err.Error(), userStatus(err))
+		return
+	}
+	a.record(r, audit.RoleChange, username, username, "role="+data.Role)
+	slog.InfoContext(r.Context(), "user role set by admin", "admin", principal.Username(r), "username", username, "role", data.Role)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// unlock lifts the login throttle of an account or IP
+// email: optional, ip: optional
+func (a *API) unlock(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	ip := r.URL.Query().Get("ip")
+	if email == "" && ip == "" {
+		http.Error(w, "email or ip is required", http.StatusBadRequest)
+		return
+	}
+	if err := a.auth.Unlock(email, ip); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.record(r, audit.LoginUnlock, "", strings.TrimPrefix(email+" "+ip, " "), "")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("unlocked"))
+}
+
+// mintInvite creates an invite without quota
+func (a *API) mintInvite(w http.ResponseWriter, r *http.Request) {
+	code, err := a.auth.MintInvite(principal.Username(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"code": code})
+}
+
+// listObjects lists objects of every user
+// username: optional, q: optional, limit: optional, offset: optional
+func (a *API) listObjects(w http.ResponseWriter, r *http.Request) {
+	limit, offset := page(r)
+	objs, err := a.storage.ListObjects(r.URL.Query().Get("username"), r.URL.Query().Get("q"), limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, objs)
+}
+
+func (a *API) deleteObject(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	obj, err := a.storage.DeleteObject(r.Context(), id)
+	if err == storage.ErrObjectNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.record(r, audit.Delete, obj.Username, obj.ID, "path="+obj.Filename)
+	slog.InfoContext(r.Context(), "object deleted by admin", "admin", principal.Username(r), "id", id)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("deleted"))
+}
+
+// usage reports the number of objects and bytes per user
+func (a *API) usage(w http.ResponseWriter, r *http.Request) {
+	usages, err := a.storage.Usage()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, usages)
+}
+
+// events queries the audit log of all users
+// username, type, ip: optional, since, until: optional (RFC 3339), limit, offset: optional
+func (a *API) events(w http.ResponseWriter, r *http.Request) {
+	filter, err := audit.FilterFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	evs, err := a.audit.Query(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, evs)
+}
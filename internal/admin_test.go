@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"bytes"
+	"codeserver/internal/auth"
+	"codeserver/internal/storage"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// authStore returns the store of the auth database of server
+func authStore(t *testing.T, server *Server) auth.Store {
+	t.Helper()
+	for _, db := range server.dbs {
+		if db.Name == "auth" {
+			return auth.NewStore(db)
+		}
+	}
+	t.Fatal("no auth database")
+	return nil
+}
+
+// createUser creates a verified account with role on server and returns a
+// session of it
+func createUser(t *testing.T, server *Server, email, username, role string) string {
+	t.Helper()
+	store := authStore(t, server)
+	if err := store.CreateUser(email, "password123", username, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetRole(email, role); err != nil {
+		t.Fatal(err)
+	}
+	session, err := store.CreateSession(email, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestAdmin(t *testing.T) {
+	server, _ := newServer(t)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	admin := createUser(t, server, "root@example.com", "root", auth.RoleAdmin)
+	ann := createUser(t, server, "ann@example.com", "ann", auth.RoleUser)
+
+	// call sends a request with the session as bearer token, the response
+	// body is decoded into v if it isn't nil
+	call := func(t *testing.T, method, path, session, body string, v any) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if session != "" {
+			req.Header.Set("Authorization", "Bearer "+session)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if v != nil && resp.StatusCode == http.StatusOK {
+			if err := json.Unmarshal(b, v); err != nil {
+				t.Fatalf("%s %s: %v in %s", method, path, err, b)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	t.Run("role check", func(t *testing.T) {
+		for _, test := range []struct {
+			name, session string
+			want          int
+		}{
+			{"anonymous", "", http.StatusUnauthorized},
+			{"invalid session", "not a session", http.StatusUnauthorized},
+			{"user", ann, http.StatusForbidden},
+			{"admin", admin, http.StatusOK},
+		} {
+			if status := call(t, "GET", "/admin/users", test.session, "", nil); status != test.want {
+				t.Errorf("%s: %d, want %d", test.name, status, test.want)
+			}
+		}
+	})
+
+	t.Run("users", func(t *testing.T) {
+		var users []struct {
+			Email, Username, Role string
+			Disabled              bool
+		}
+		if status := call(t, "GET", "/admin/users?q=ANN", admin, "", &users); status != http.StatusOK {
+			t.Fatalf("search: %d", status)
+		}
+		if len(users) != 1 || users[0].Username != "ann" || users[0].Role != auth.RoleUser {
+			t.Errorf("search for ann: %+v", users)
+		}
+
+		if status := call(t, "PUT", "/admin/users/ann/role", admin, `{"role":"owner"}`, nil); status != http.StatusBadRequest {
+			t.Errorf("unknown role: %d, want 400", status)
+		}
+		if status := call(t, "PUT", "/admin/users/root/role", admin, `{"role":"user"}`, nil); status != http.StatusBadRequest {
+			t.Errorf("demoting yourself: %d, want 400", status)
+		}
+		if status := call(t, "PUT", "/admin/users/nobody/role", admin, `{"role":"admin"}`, nil); status != http.StatusNotFound {
+			t.Errorf("unknown user: %d, want 404", status)
+		}
+		if status := call(t, "PUT", "/admin/users/ann/role", admin, `{"role":"admin"}`, nil); status != http.StatusOK {
+			t.Fatalf("promote: %d", status)
+		}
+		if status := call(t, "GET", "/admin/usage", ann, "", nil); status != http.StatusOK {
+			t.Errorf("promoted user: %d", status)
+		}
+		if status := call(t, "PUT", "/admin/users/ann/role", admin, `{"role":"user"}`, nil); status != http.StatusOK {
+			t.Fatalf("demote: %d", status)
+		}
+		if status := call(t, "GET", "/admin/usage", ann, "", nil); status != http.StatusForbidden {
+			t.Errorf("demoted user: %d, want 403", status)
+		}
+	})
+
+	t.Run("disable and logout", func(t *testing.T) {
+		if status := call(t, "POST", "/admin/users/root/disable", admin, "", nil); status != http.StatusBadRequest {
+			t.Errorf("disabling yourself: %d, want 400", status)
+		}
+		if status := call(t, "POST", "/admin/users/ann/disable", admin, "", nil); status != http.StatusOK {
+			t.Fatalf("disable: %d", status)
+		}
+		if status := call(t, "GET", "/storage/list", ann, "", nil); status != http.StatusUnauthorized {
+			t.Errorf("session of a disabled user: %d, want 401", status)
+		}
+		if status := call(t, "POST", "/admin/users/ann/enable", admin, "", nil); status != http.StatusOK {
+			t.Fatalf("enable: %d", status)
+		}
+		// Disabling ended the sessions, a new one works again
+		session, err := authStore(t, server).CreateSession("ann@example.com", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := call(t, "GET", "/storage/list", session, "", nil); status != http.StatusOK {
+			t.Errorf("enabled user: %d", status)
+		}
+		if status := call(t, "POST", "/admin/users/ann/logout", admin, "", nil); status != http.StatusOK {
+			t.Fatalf("logout: %d", status)
+		}
+		if status := call(t, "GET", "/storage/list", session, "", nil); status != http.StatusUnauthorized {
+			t.Errorf("session after the logout: %d, want 401", status)
+		}
+		if status := call(t, "POST", "/admin/users/nobody/logout", admin, "", nil); status != http.StatusNotFound {
+			t.Errorf("unknown user: %d, want 404", status)
+		}
+	})
+
+	t.Run("objects", func(t *testing.T) {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		file, _ := form.CreateFormFile("file", "hello.txt")
+		file.Write([]byte("hello"))
+		form.Close()
+		req, _ := http.NewRequest("POST", ts.URL+"/storage/upload", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer "+admin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("upload: %d", resp.StatusCode)
+		}
+
+		var objects []storage.Object
+		if status := call(t, "GET", "/admin/objects?username=root", admin, "", &objects); status != http.StatusOK {
+			t.Fatalf("list: %d", status)
+		}
+		if len(objects) != 1 || objects[0].Filename != "hello.txt" {
+			t.Fatalf("objects %+v", objects)
+		}
+		var usage []storage.OwnerUsage
+		if status := call(t, "GET", "/admin/usage", admin, "", &usage); status != http.StatusOK {
+			t.Fatalf("usage: %d", status)
+		}
+		if len(usage) != 1 || usage[0] != (storage.OwnerUsage{Username: "root", Objects: 1, Bytes: 5}) {
+			t.Errorf("usage %+v", usage)
+		}
+
+		if status := call(t, "DELETE", "/admin/objects/"+objects[0].ID, admin, "", nil); status != http.StatusOK {
+			t.Fatalf("delete: %d", status)
+		}
+		if status := call(t, "DELETE", "/admin/objects/"+objects[0].ID, admin, "", nil); status != http.StatusNotFound {
+			t.Errorf("deleting again: %d, want 404", status)
+		}
+	})
+
+	t.Run("audit", func(t *testing.T) {
+		var events []struct{ Type, Actor, Username string }
+		if status := call(t, "GET", "/admin/audit?type=user", admin, "", &events); status != http.StatusOK {
+			t.Fatalf("audit: %d", status)
+		}
+		types := map[string]bool{}
+		for _, e := range events {
+			if e.Actor != "root" || e.Username != "ann" {
+				t.Errorf("event %+v", e)
+			}
+			types[e.Type] = true
+		}
+		if !types["user.role"] || !types["user.disable"] || !types["user.enable"] {
+			t.Errorf("event types %v", types)
+		}
+		if status := call(t, "GET", "/admin/audit?since=yesterday", admin, "", nil); status != http.StatusBadRequest {
+			t.Errorf("invalid filter: %d, want 400", status)
+		}
+	})
+
+	t.Run("unlock and invites", func(t *testing.T) {
+		if status := call(t, "POST", "/admin/unlock", admin, "", nil); status != http.StatusBadRequest {
+			t.Errorf("unlock without a key: %d, want 400", status)
+		}
+		if status := call(t, "POST", "/admin/unlock?email=ann@example.com", admin, "", nil); status != http.StatusOK {
+			t.Errorf("unlock: %d", status)
+		}
+		req, _ := http.NewRequest("POST", ts.URL+"/admin/invites", nil)
+		req.Header.Set("Authorization", "Bearer "+admin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var invite struct{ Code string }
+		json.NewDecoder(resp.Body).Decode(&invite)
+		if resp.StatusCode != http.StatusCreated || invite.Code == "" {
+			t.Errorf("invite: %d %+v", resp.StatusCode, invite)
+		}
+	})
+}
@@ -2,56 +2,330 @@ package internal
 
 import (
 	"codeserver/internal/auth"
+	"codeserver/internal/config"
+	"codeserver/internal/database"
+	"codeserver/internal/geoip"
+	"codeserver/internal/logging"
+	"codeserver/internal/mail"
 	"codeserver/internal/r2"
 	"codeserver/internal/storage"
-	"flag"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gnitoahc/go-dotenv"
 )
 
-var (
-	port = flag.Int("port", 3000, "The server port")
-)
+const usage = `usage: codeserver [serve] [flags]
+       codeserver config print [flags]
+       codeserver migrate <status|up|down> [flags]
+
+Run "codeserver serve -h" for the flags, every flag also has an environment
+variable and a key in the config file.
+`
 
-func init() {
+// Main runs the subcommand in args, serve if there is none
+func Main(args []string) {
 	dotenv.Load(".env")
 
-	// r2 package init
-	CF_ACCOUNT_ID := os.Getenv("CF_ACCOUNT_ID")
-	CF_BUCKET_NAME := os.Getenv("CF_BUCKET_NAME")
-	CF_ACCESS_KEY := os.Getenv("CF_ACCESS_KEY")
-	CF_SECRET_ACCESS_KEY := os.Getenv("CF_SECRET_ACCESS_KEY")
-	r2.Init(CF_ACCOUNT_ID, CF_ACCESS_KEY, CF_SECRET_ACCESS_KEY, CF_BUCKET_NAME)
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "serve":
+		c, err := config.Load(args)
+		if err != nil {
+			fatal("invalid configuration", err)
+		}
+		if err := setLogger(c); err != nil {
+			fatal("invalid configuration", err)
+		}
+		Serve(c)
+	case "config":
+		if len(args) == 0 || args[0] != "print" {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		// Print even an invalid configuration, the errors say what to fix
+		c, err := config.Load(args[1:])
+		if c != nil {
+			if err := c.Print(os.Stdout); err != nil {
+				fatal("printing the configuration failed", err)
+			}
+		}
+		if err != nil {
+			fatal("invalid configuration", err)
+		}
+	case "migrate":
+		if err := migrateCommand(args); err != nil {
+			fatal("migrate failed", err)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
 
-	// auth package init
-	auth.Init("", "", true)
+// setLogger makes the configured log the default, which the log package
+// writes to as well
+func setLogger(c *config.Config) error {
+	logger, err := logging.New(os.Stderr, c.Log.Format, c.Log.Level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
 
-	// storage package init
-	storage.Init("", "", true)
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
-func Serve() {
-	// Mux definition start
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /ping", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("pong"))
-	})
-	handle(mux, "/auth/", http.StripPrefix("/auth", auth.AuthHandler()))
-	handle(mux, "/storage/", http.StripPrefix("/storage", storage.StorageHandler()), authMiddleware)
-	handle(mux, "/anonymous/", http.StripPrefix("/anonymous", storage.AnonymousHandler()))
-	// Mux definition end
+// serverConfig opens the databases and the R2 bucket and builds the services'
+// configuration
+func serverConfig(c *config.Config) (Config, error) {
+	blob, err := r2.New(c.Blob.R2.AccountID, c.Blob.R2.AccessKey, c.Blob.R2.SecretAccessKey, c.Blob.R2.Bucket)
+	if err != nil {
+		return Config{}, err
+	}
+	authDB, storageDB, err := openUserDBs(c)
+	if err != nil {
+		return Config{}, err
+	}
+	auditDB, err := database.Open(c.Database.Audit.URL, c.Database.Audit.Token)
+	if err != nil {
+		return Config{}, err
+	}
+	auditDB.Name = "audit"
+
+	sc := Config{
+		AuditDB:         auditDB,
+		AuditRetention:  time.Duration(c.Audit.RetentionDays) * 24 * time.Hour,
+		AutoMigrate:     c.Database.AutoMigrate,
+		MaxBodySize:     c.Server.MaxBodySize,
+		TransferTimeout: c.Server.TransferTimeout,
+		TrustedProxies:  c.Server.TrustedProxies,
+		Cloudflare:      c.Server.Cloudflare,
+		Storage: storage.Config{
+			DB:                 storageDB,
+			Shared:             storageDB == authDB,
+			Blob:               blob,
+			MaxUploadSize:      c.Storage.MaxUploadSize,
+			MultipartThreshold: c.Storage.MultipartThreshold,
+			PartSize:           c.Storage.PartSize,
+		},
+		Auth: auth.Config{
+			DB:          authDB,
+			BaseURL:     c.Server.PublicURL,
+			TokenSecret: c.Auth.Secret,
+			Admins:      c.Auth.AdminUsers,
+			Cookies: auth.CookiePolicy{
+				Secure: c.Auth.Cookies.Secure,
+				MaxAge: c.Auth.Cookies.MaxAge,
+			},
+			Registration: auth.RegistrationPolicy{
+				Mode:           auth.RegistrationMode(c.Auth.Registration.Mode),
+				AllowedDomains: c.Auth.Registration.AllowedDomains,
+				InviteQuota:    c.Auth.Registration.InviteQuota,
+				InviteTTL:      c.Auth.Registration.InviteTTL,
+			},
+			Usernames: auth.UsernamePolicy{
+				MinLength: c.Auth.Usernames.MinLength,
+				MaxLength: c.Auth.Usernames.MaxLength,
+				Reserved:  c.Auth.Usernames.Reserved,
+			},
+		},
+	}
+
+	if c.Auth.Proxy.EmailHeader != "" {
+		sc.Auth.Proxy = &auth.ProxyAuthConfig{
+			EmailHeader:    c.Auth.Proxy.EmailHeader,
+			UserHeader:     c.Auth.Proxy.UserHeader,
+			TrustedProxies: c.Auth.Proxy.TrustedProxies,
+			DisableLogin:   c.Auth.Proxy.DisableLogin,
+		}
+	}
+	if ldap := c.Auth.LDAP; ldap.URL != "" {
+		sc.Auth.LDAP = &auth.LDAPConfig{
+			URL:               ldap.URL,
+			StartTLS:          ldap.StartTLS,
+			BindDN:            ldap.BindDN,
+			BindPassword:      ldap.BindPassword,
+			BaseDN:            ldap.BaseDN,
+			UserFilter:        ldap.UserFilter,
+			UsernameAttribute: ldap.UsernameAttribute,
+			EmailAttribute:    ldap.EmailAttribute,
+			AllowedGroups:     ldap.AllowedGroups,
+		}
+	}
+	for _, p := range c.Auth.OIDC {
+		sc.Auth.OIDC = append(sc.Auth.OIDC, auth.OIDCConfig{
+			Name:         p.Name,
+			Issuer:       p.Issuer,
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			RedirectURL:  p.RedirectURL,
+		})
+	}
+
+	var locator geoip.Locator = geoip.Nop{}
+	if c.GeoIP.DB != "" {
+		mmdb, err := geoip.OpenMMDB(c.GeoIP.DB)
+		if err != nil {
+			return Config{}, err
+		}
+		locator = mmdb
+	} else if c.GeoIP.HTTPURL != "" {
+		locator = &geoip.HTTP{URL: c.GeoIP.HTTPURL, Client: &http.Client{Timeout: 5 * time.Second}}
+	}
+	sc.Auth.Locator = geoip.NewCached(locator, 24*time.Hour, 10000)
+
+	// On the server port the metrics are only served with a token
+	if c.Metrics.Listen == "" {
+		sc.MetricsToken = c.Metrics.Token
+	}
+	sc.Auth.Mailer = &mail.LogMailer{Dir: c.Mail.Dir}
+	if smtp := c.Mail.SMTP; smtp.Host != "" {
+		sc.Auth.Mailer = &mail.SMTPMailer{
+			Host:     smtp.Host,
+			Port:     smtp.Port,
+			Username: smtp.Username,
+			Password: smtp.Password,
+			From:     smtp.From,
+		}
+	}
+	return sc, nil
+}
 
-	log.Printf("Starting server on port %d", *port)
+// openUserDBs opens the auth and storage databases, which are the same one
+// if a shared database is configured
+func openUserDBs(c *config.Config) (authDB, storageDB *database.DB, err error) {
+	if shared := c.Database.Shared; shared.URL != "" {
+		db, err := database.Open(shared.URL, shared.Token)
+		if err != nil {
+			return nil, nil, err
+		}
+		db.Name = "shared"
+		return db, db, nil
+	}
+	if authDB, err = database.Open(c.Database.Auth.URL, c.Database.Auth.Token); err != nil {
+		return nil, nil, err
+	}
+	authDB.Name = "auth"
+	if storageDB, err = database.Open(c.Database.Storage.URL, c.Database.Storage.Token); err != nil {
+		return nil, nil, err
+	}
+	storageDB.Name = "storage"
+	return authDB, storageDB, nil
+}
+
+// Serve runs the server until SIGTERM or an interrupt, then drains it: new
+// uploads are refused and the requests in flight get the shutdown timeout to
+// finish. Uploads still running after it are aborted.
+func Serve(c *config.Config) {
+	sc, err := serverConfig(c)
+	if err != nil {
+		fatal("configuring the server failed", err)
+	}
+	server, err := NewServer(sc)
+	if err != nil {
+		fatal("starting the server failed", err)
+	}
 
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	slog.Info("starting server", "port", c.Server.Port)
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", c.Server.Port))
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		fatal("failed to listen", err)
+	}
+	srv := &http.Server{
+		Handler:           server.Handler(),
+		ReadHeaderTimeout: c.Server.ReadHeaderTimeout,
+		ReadTimeout:       c.Server.ReadTimeout,
+		WriteTimeout:      c.Server.WriteTimeout,
+		IdleTimeout:       c.Server.IdleTimeout,
+		MaxHeaderBytes:    c.Server.MaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	stopTLS, err := serverTLS(c, srv)
+	if err != nil {
+		fatal("setting up TLS failed", err)
+	}
+	defer stopTLS()
+	stopMetrics, err := serveMetrics(c.Metrics, server)
+	if err != nil {
+		fatal("serving metrics failed", err)
+	}
+	defer stopMetrics()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			serveErr <- srv.ServeTLS(lis, "", "")
+			return
+		}
+		serveErr <- srv.Serve(lis)
+	}()
+	select {
+	case err := <-serveErr:
+		fatal("serving failed", err)
+	case sig := <-stop:
+		slog.Info("draining", "signal", sig.String(), "timeout", c.Server.ShutdownTimeout.String())
+	}
+	signal.Stop(stop)
+
+	server.Drain()
+	ctx, cancel := context.WithTimeout(context.Background(), c.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("requests still running after the shutdown timeout, closing them", "error", err)
+		srv.Close()
+	}
+	// Aborting multipart uploads takes a request to R2 each
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Close(ctx); err != nil {
+		slog.Error("closing the server failed", "error", err)
+	}
+	slog.Info("server stopped")
+}
+
+// serveMetrics serves the metrics on their own listener if one is configured,
+// stop closes it
+func serveMetrics(c config.Metrics, server *Server) (stop func(), err error) {
+	if c.Listen == "" {
+		return func() {}, nil
+	}
+	lis, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", server.MetricsHandler(c.Token))
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
 	}
-	log.Fatal(http.Serve(lis, mux))
+	go func() {
+		if err := srv.Serve(lis); err != http.ErrServerClosed {
+			slog.Error("metrics listener stopped", "error", err)
+		}
+	}()
+	slog.Info("serving metrics", "address", lis.Addr().String())
+	return func() { srv.Close() }, nil
 }
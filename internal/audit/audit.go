@@ -0,0 +1,209 @@
+// Package audit keeps a durable record of security relevant events such as
+// logins, session revocations and object downloads.
+package audit
+
+import (
+	"codeserver/internal/database"
+	"codeserver/internal/realip"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	Register      = "register"
+	LoginSuccess  = "login.success"
+	LoginFailure  = "login.failure"
+	LoginLockout  = "login.lockout"
+	LoginUnlock   = "login.unlock"
+	Logout        = "logout"
+	SessionRevoke = "session.revoke"
+	RoleChange    = "user.role"
+	UserDisable   = "user.disable"
+	UserEnable    = "user.enable"
+	UserRename    = "user.rename"
+	UserDelete    = "user.delete"
+	Upload        = "object.upload"
+	Download      = "object.download"
+	Delete        = "object.delete"
+)
+
+type Event struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Actor    string    `json:"actor"`    // Username of who did it, empty if anonymous or unknown
+	Username string    `json:"username"` // Username of the account or object owner it concerns
+	// IDs of the actor and the user, which unlike usernames are never reused.
+	// Record looks up unset ones by username, zero if there is no such user.
+	ActorID int64  `json:"actor_id,omitempty"`
+	UserID  int64  `json:"user_id,omitempty"`
+	Subject string `json:"subject"` // e.g. object ID, login identifier or throttle key
+	IP      string `json:"ip"`
+	Agent   string `json:"agent"`
+	Success bool   `json:"success"`
+	Detail  string `json:"detail"`
+}
+
+// Filter narrows Query, zero values match everything
+type Filter struct {
+	Username string // Matches both actor and username
+	UserID   int64  // Matches both actor and user ID
+	Type     string // Exact type or prefix, e.g. "login"
+	IP       string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+	Offset   int
+}
+
+// Log is the append-only event log. A nil *Log only writes events to the
+// server log, which keeps packages usable without an audit database.
+type Log struct {
+	db     dbStruct
+	now    func() time.Time
+	userID func(username string) int64 // Set by SetUserLookup
+
+	pruneOnce   sync.Once
+	retention   time.Duration
+	retentionMu sync.Mutex
+}
+
+// New returns the log stored in conn, which has to be migrated to
+// Schemas[conn.Dialect]. clock may be nil.
+func New(conn *database.DB, clock func() time.Time) *Log {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &Log{db: dbStruct{db: conn}, now: clock}
+}
+
+// SetUserLookup sets how Record finds the IDs of actors and users, which it
+// has to do when the event happens as usernames can be taken over later
+func (l *Log) SetUserLookup(userID func(username string) int64) {
+	if l != nil {
+		l.userID = userID
+	}
+}
+
+// SetRetention sets how long events are kept, zero keeps them forever.
+// Expired events are pruned hourly.
+func (l *Log) SetRetention(d time.Duration) {
+	l.retentionMu.Lock()
+	l.retention = d
+	l.retentionMu.Unlock()
+	l.pruneOnce.Do(func() {
+		go func() {
+			for {
+				l.prune()
+				time.Sleep(time.Hour)
+			}
+		}()
+	})
+}
+
+func (l *Log) prune() {
+	l.retentionMu.Lock()
+	d := l.retention
+	l.retentionMu.Unlock()
+	if d <= 0 {
+		return
+	}
+	n, err := l.db.prune(l.now().Add(-d))
+	if err != nil {
+		slog.Error("pruning audit events failed", "error", err)
+		return
+	}
+	if n > 0 {
+		slog.Info("audit events pruned", "count", n, "older_than", d.String())
+	}
+}
+
+// Record appends an event, the time is filled in if unset. Failures are only
+// logged, auditing must never break the request it describes.
+func (l *Log) Record(e Event) {
+	if l == nil {
+		slog.Info("audit event", "type", e.Type, "actor", e.Actor, "username", e.Username, "subject", e.Subject, "detail", e.Detail, "success", e.Success)
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = l.now()
+	}
+	if l.userID != nil {
+		if e.ActorID == 0 && e.Actor != "" {
+			e.ActorID = l.userID(e.Actor)
+		}
+		if e.UserID == 0 && e.Username != "" {
+			e.UserID = l.userID(e.Username)
+		}
+	}
+	if err := l.db.insert(e); err != nil {
+		slog.Error("recording audit event failed", "type", e.Type, "username", e.Username, "error", err)
+	}
+}
+
+// FromRequest returns an event with the client IP and user agent of r
+func FromRequest(r *http.Request, typ string) Event {
+	return Event{
+		Type:  typ,
+		IP:    realip.FromRequest(r),
+		Agent: r.UserAgent(),
+	}
+}
+
+// Query returns events matching the filter, newest first
+func (l *Log) Query(f Filter) ([]Event, error) {
+	if l == nil {
+		return []Event{}, nil
+	}
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+	return l.db.query(f)
+}
+
+// FilterFromQuery reads type, ip, username, user_id, since, until, limit and
+// offset from URL query parameters, times are RFC 3339
+func FilterFromQuery(q url.Values) (Filter, error) {
+	f := Filter{
+		Username: q.Get("username"),
+		Type:     q.Get("type"),
+		IP:       q.Get("ip"),
+	}
+	for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := q.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return Filter{}, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*t = parsed
+		}
+	}
+	if v := q.Get("user_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id <= 0 {
+			return Filter{}, fmt.Errorf("invalid user_id %q", v)
+		}
+		f.UserID = id
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return Filter{}, fmt.Errorf("invalid limit %q", v)
+		}
+		f.Limit = min(limit, 1000)
+	}
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return Filter{}, fmt.Errorf("invalid offset %q", v)
+		}
+		f.Offset = offset
+	}
+	return f, nil
+}
@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"codeserver/internal/database"
+	"codeserver/internal/migrate"
+	"embed"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrations embed.FS
+
+// Schemas are the migrations of the events table for every dialect
+var Schemas = migrate.MustLoadDialects("audit", migrations, "migrations")
+
+// likeEscaper escapes the wildcards of LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+type dbStruct struct {
+	db *database.DB
+}
+
+func (db *dbStruct) insert(e Event) error {
+	query := `INSERT INTO events (created_at, type, actor, actor_id, username, user_id, subject, ip, agent, success, detail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.db.Exec(query, e.Time.UnixMilli(), e.Type, e.Actor, e.ActorID, e.Username, e.UserID, e.Subject, e.IP, e.Agent, e.Success, e.Detail)
+	return err
+}
+
+// query returns the events matching the filter, newest first
+func (db *dbStruct) query(f Filter) ([]Event, error) {
+	var where []string
+	var args []any
+	if f.Username != "" {
+		// Events the user caused and events concerning the user
+		where = append(where, "(username = ? OR actor = ?)")
+		args = append(args, f.Username, f.Username)
+	}
+	if f.UserID != 0 {
+		where = append(where, "(user_id = ? OR actor_id = ?)")
+		args = append(args, f.UserID, f.UserID)
+	}
+	if f.Type != "" {
+		// "login" matches "login.success", "login.failure" etc.
+		where = append(where, `(type = ? OR type LIKE ? ESCAPE '\')`)
+		args = append(args, f.Type, likeEscaper.Replace(f.Type)+".%")
+	}
+	if f.IP != "" {
+		where = append(where, "ip = ?")
+		args = append(args, f.IP)
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since.UnixMilli())
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.Until.UnixMilli())
+	}
+	query := "SELECT id, created_at, type, actor, actor_id, username, user_id, subject, ip, agent, success, detail FROM events"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?"
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []Event{}
+	for rows.Next() {
+		e := Event{}
+		var createdAt int64
+		err := rows.Scan(&e.ID, &createdAt, &e.Type, &e.Actor, &e.ActorID, &e.Username, &e.UserID, &e.Subject, &e.IP, &e.Agent, &e.Success, &e.Detail)
+		if err != nil {
+			return nil, err
+		}
+		e.Time = time.UnixMilli(createdAt).UTC()
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (db *dbStruct) prune(before time.Time) (int64, error) {
+	result, err := db.db.Exec("DELETE FROM events WHERE created_at < ?", before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1 @@
+ALTER TABLE events ALTER COLUMN agent TYPE VARCHAR(255) USING left(agent, 255);
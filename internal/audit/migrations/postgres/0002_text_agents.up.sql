@@ -0,0 +1,2 @@
+-- User agents have no length limit, a longer one failed the insert
+ALTER TABLE events ALTER COLUMN agent TYPE TEXT;
@@ -0,0 +1,7 @@
+-- Users are identified by ID, usernames are freed by renames and deletions
+-- and may then be registered by someone else. Earlier events keep 0 and only
+-- show up when filtering by username.
+ALTER TABLE events ADD COLUMN actor_id BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE events ADD COLUMN user_id BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX events_user_id ON events (user_id, created_at);
+CREATE INDEX events_actor_id ON events (actor_id, created_at);
@@ -0,0 +1,17 @@
+-- The table is append-only, rows are never updated and only deleted once
+-- they fall out of the retention period
+CREATE TABLE IF NOT EXISTS events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at INTEGER NOT NULL,        -- Unix time in milliseconds
+    type VARCHAR(64) NOT NULL,
+    actor VARCHAR(255) NOT NULL,        -- Who did it, empty if anonymous
+    username VARCHAR(255) NOT NULL,     -- Whose account or object it concerns
+    subject VARCHAR(255) NOT NULL,
+    ip VARCHAR(64) NOT NULL,
+    agent VARCHAR(255) NOT NULL,
+    success BOOLEAN NOT NULL,
+    detail TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_username ON events (username, created_at);
+CREATE INDEX IF NOT EXISTS events_actor ON events (actor, created_at);
+CREATE INDEX IF NOT EXISTS events_created_at ON events (created_at);
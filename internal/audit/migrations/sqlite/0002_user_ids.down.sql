@@ -0,0 +1,4 @@
+DROP INDEX events_actor_id;
+DROP INDEX events_user_id;
+ALTER TABLE events DROP COLUMN user_id;
+ALTER TABLE events DROP COLUMN actor_id;
@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"codeserver/internal/audit"
+	"codeserver/internal/mail"
+	"codeserver/internal/realip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const changeEmailTTL = 24 * time.Hour
+
+// AccountHooks lets other packages follow account changes. Objects in the
+// storage package are owned by username, or stored under it, so renames and
+// deletions have to be applied there as well.
+type AccountHooks struct {
+	RenameUser func(ctx context.Context, oldUsername, newUsername string) error
+	DeleteUser func(ctx context.Context, username string) error
+}
+
+// changePassword requires the current password and, if enabled, a second
+// factor, all other sessions are revoked afterwards
+func (s *Service) changePassword(w http.ResponseWriter, r *http.Request) {
+	user := s.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	var data struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+		Code            string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data.NewPassword == "" {
+		http.Error(w, "new_password is required", http.StatusBadRequest)
+		return
+	}
+	// Accounts from external providers may set a first password
+	if !s.reauthenticate(w, r, user, data.CurrentPassword, data.Code) {
+		return
+	}
+	if err := s.store.SetPassword(user.Email, data.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sessionID, _ := s.SessionID(r)
+	if err := s.store.DeleteOtherSessions(user.Email, sessionID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.audit.Record(userEvent(r, audit.SessionRevoke, user, "reason=password change scope=others"))
+	slog.InfoContext(r.Context(), "password changed", "username", user.Username)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("password changed"))
+}
+
+// changeEmail mails a confirmation link to the new address, the address is
+// only changed once the link was opened. It requires the password and, if
+// enabled, a second factor.
+func (s *Service) changeEmail(w http.ResponseWriter, r *http.Request) {
+	user := s.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	var data struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data.Email = normalizeEmail(data.Email)
+	if data.Email == "" {
+		http.Error(w, "email is required", http.StatusBadRequest)
+		return
+	}
+	if !s.reauthenticate(w, r, user, data.Password, data.Code) {
+		return
+	}
+	if existing, _ := s.store.GetUser(data.Email); existing != nil {
+		http.Error(w, ErrUserAlreadyExists.Error(), http.StatusConflict)
+		return
+	}
+
+	token := s.signToken(tokenClaims{
+		Purpose:     purposeChangeEmail,
+		Email:       user.Email,
+		NewEmail:    data.Email,
+		Expires:     s.now().Add(changeEmailTTL).Unix(),
+		Fingerprint: emailFingerprint(user),
+	})
+	link := s.baseURL + "/auth/account/email/confirm?token=" + url.QueryEscape(token)
+	err := s.mailer.Send(r.Context(), mail.Message{
+		To:      data.Email,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Open the link below to use this address for your account %s:\n\n%s\n\n"+
+			"The link expires in %s.\n", user.Username, link, changeEmailTTL),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "sending email change confirmation failed", "error", err)
+		http.Error(w, "failed to send mail", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("confirmation email sent"))
+}
+
+// confirmEmail applies an email change
+// token: query parameter (link in the mail) or JSON body
+func (s *Service) confirmEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		var data struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(r.Body).Decode(&data)
+		token = data.Token
+	}
+	claims, err := s.parseToken(token, purposeChangeEmail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := s.store.GetUser(claims.Email)
+	if err != nil && err != ErrUserNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The fingerprint changes with every email change, so a link issued
+	// before the address was changed and changed back doesn't work anymore
+	if user == nil || claims.Fingerprint != emailFingerprint(user) {
+		http.Error(w, ErrInvalidToken.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.store.ChangeEmail(claims.Email, claims.NewEmail); err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrUserNotFound {
+			status = http.StatusBadRequest
+		} else if err == ErrUserAlreadyExists {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	slog.InfoContext(r.Context(), "email changed", "old_email", claims.Email, "email", claims.NewEmail)
+	err = s.mailer.Send(r.Context(), mail.Message{
+		To:      claims.Email,
+		Subject: "Your email address was changed",
+		Body:    fmt.Sprintf("The email address of your account was changed to %s.\n", claims.NewEmail),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "changing email failed", "error", err)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("email changed"))
+}
+
+// changeUsername renames the account together with the objects it owns
+func (s *Service) changeUsername(w http.ResponseWriter, r *http.Request) {
+	user := s.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	var data struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data.Username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	if err := s.checkUsername(data.Username); err != nil {
+		http.Error(w, err.Error(), usernameStatus(err))
+		return
+	}
+	// The unique index reserves the new name before the objects move, the
+	// old one is restored if they can't
+	if err := s.store.SetUsername(user.Email, data.Username); errors.Is(err, ErrUsernameTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.hooks.RenameUser != nil {
+		if err := s.hooks.RenameUser(r.Context(), user.Username, data.Username); err != nil {
+			slog.ErrorContext(r.Context(), "moving objects failed", "username", user.Username, "error", err)
+			if err := s.store.SetUsername(user.Email, user.Username); err != nil {
+				slog.ErrorContext(r.Context(), "restoring username failed", "username", user.Username, "error", err)
+			}
+			http.Error(w, "failed to move objects", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.audit.Record(userEvent(r, audit.UserRename, user, "new="+data.Username))
+	slog.InfoContext(r.Context(), "user renamed", "old_username", user.Username, "username", data.Username)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("username changed"))
+}
+
+// reauthenticate checks the password, if the account has one, and the second
+// factor, if enabled, before a sensitive change. Wrong guesses are throttled
+// and counted like failed logins. It writes the error and returns false if
+// either is wrong.
+func (s *Service) reauthenticate(w http.ResponseWriter, r *http.Request, user *User, password, code string) bool {
+	ip := realip.FromRequest(r)
+	wait, err := s.countLoginAttempt(user.Email, ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if wait > 0 {
+		s.loginFailure(r, user.Email, "throttled")
+		writeThrottled(w, wait)
+		return false
+	}
+	if user.Password != "" && !checkPassword(password, user.Password) {
+		s.recordLoginFailure(r, user.Email, ip, "invalid credentials")
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return false
+	}
+	if user.TOTPEnabled {
+		verified, err := s.verifySecondFactor(user, code)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		if !verified {
+			s.recordLoginFailure(r, user.Email, ip, "invalid second factor")
+			http.Error(w, "invalid code", http.StatusUnauthorized)
+			return false
+		}
+	}
+	s.loginAttemptPassed(ip)
+	s.clearLoginFailures(user.Email)
+	return true
+}
+
+// deleteAccount removes the account, its sessions and all stored objects. It
+// requires the password and, if enabled, a second factor.
+func (s *Service) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := s.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	var data struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.reauthenticate(w, r, user, data.Password, data.Code) {
+		return
+	}
+	if s.hooks.DeleteUser != nil {
+		if err := s.hooks.DeleteUser(r.Context(), user.Username); err != nil {
+			slog.ErrorContext(r.Context(), "deleting objects failed", "username", user.Username, "error", err)
+			http.Error(w, "failed to delete objects", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := s.store.DeleteUser(user.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.audit.Record(userEvent(r, audit.UserDelete, user, ""))
+	slog.InfoContext(r.Context(), "account deleted", "username", user.Username)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("account deleted"))
+}
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"codeserver/internal/mail"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mailbox keeps the sent messages
+type mailbox struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+func (m *mailbox) Send(ctx context.Context, msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+var tokenParam = regexp.MustCompile(`token=(\S+)`)
+
+// token returns the token linked in the latest message
+func (m *mailbox) token(t *testing.T) string {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.messages) == 0 {
+		t.Fatal("no mail sent")
+	}
+	match := tokenParam.FindStringSubmatch(m.messages[len(m.messages)-1].Body)
+	if match == nil {
+		t.Fatal("no token in the mail")
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestChangeUsername(t *testing.T) {
+	var fail error
+	s := newTestService(t, Config{Hooks: AccountHooks{RenameUser: func(ctx context.Context, oldUsername, newUsername string) error {
+		return fail
+	}}})
+	session := newTestUser(t, s, "ann@example.com", "ann")
+	newTestUser(t, s, "bob@example.com", "bob")
+	handler := s.Handler()
+
+	if code, body := do(t, handler, "POST", "/account/username", session, `{"username":"BOB"}`); code != http.StatusConflict {
+		t.Errorf("taken username: %d %s", code, body)
+	}
+
+	fail = errors.New("blob store down")
+	if code, body := do(t, handler, "POST", "/account/username", session, `{"username":"anna"}`); code != http.StatusInternalServerError {
+		t.Errorf("failed move: %d %s", code, body)
+	}
+	user, err := s.store.GetUser("ann@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "ann" {
+		t.Errorf("username after failed move = %q, want it restored", user.Username)
+	}
+
+	fail = nil
+	if code, body := do(t, handler, "POST", "/account/username", session, `{"username":"anna"}`); code != http.StatusOK {
+		t.Errorf("rename: %d %s", code, body)
+	}
+	if user, err = s.store.GetUser("ann@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "anna" {
+		t.Errorf("username = %q, want anna", user.Username)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	mails := &mailbox{}
+	s := newTestService(t, Config{Mailer: mails})
+	session := newTestUser(t, s, "ann@example.com", "ann")
+	handler := s.Handler()
+
+	// change requests a link to the new address and opens it
+	change := func(email string) string {
+		t.Helper()
+		if code, body := do(t, handler, "POST", "/account/email", session, `{"email":"`+email+`","password":"password123"}`); code != http.StatusAccepted {
+			t.Fatalf("change to %s: %d %s", email, code, body)
+		}
+		return mails.token(t)
+	}
+	confirm := func(token string) int {
+		t.Helper()
+		code, _ := do(t, handler, "GET", "/account/email/confirm?token="+url.QueryEscape(token), "", "")
+		return code
+	}
+
+	first := change("ann@example.org")
+	if code := confirm(first); code != http.StatusOK {
+		t.Fatalf("confirm: %d", code)
+	}
+	if code := confirm(first); code != http.StatusBadRequest {
+		t.Errorf("confirming twice: %d", code)
+	}
+
+	// Back to the first address, which the first link was issued for
+	if code := confirm(change("ann@example.com")); code != http.StatusOK {
+		t.Fatalf("confirm the change back: %d", code)
+	}
+	if code := confirm(first); code != http.StatusBadRequest {
+		t.Errorf("replaying the first link: %d", code)
+	}
+	if _, err := s.store.GetUser("ann@example.com"); err != nil {
+		t.Errorf("address after the replay: %v", err)
+	}
+}
+
+func TestReauthentication(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	s := newTestService(t, Config{Clock: func() time.Time { return now }, Mailer: &mailbox{}})
+	handler := s.Handler()
+
+	t.Run("second factor", func(t *testing.T) {
+		session := newTestUser(t, s, "gina@example.com", "gina")
+		secret, err := generateTOTPSecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.store.SetTOTPSecret("gina@example.com", secret); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.store.EnableTOTP("gina@example.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct {
+			path, body string
+			status     int
+		}{
+			{"/account/email", `{"email":"gina@example.org","password":"password123"`, http.StatusAccepted},
+			{"/account/password", `{"current_password":"password123","new_password":"password456"`, http.StatusOK},
+		} {
+			if status, body := do(t, handler, "POST", c.path, session, c.body+`}`); status != http.StatusUnauthorized {
+				t.Errorf("%s without a code: %d %s", c.path, status, body)
+			}
+			// Every code works once, the next one is due
+			now = now.Add(totpPeriod * time.Second)
+			code, _ := totpCode(secret, now.Unix()/totpPeriod)
+			if status, body := do(t, handler, "POST", c.path, session, c.body+`,"code":"`+code+`"}`); status != c.status {
+				t.Errorf("%s with a code: %d %s", c.path, status, body)
+			}
+		}
+	})
+
+	t.Run("lockout", func(t *testing.T) {
+		session := newTestUser(t, s, "hank@example.com", "hank")
+		for i := 0; ; i++ {
+			status, body := do(t, handler, "POST", "/account/password", session, `{"current_password":"wrong","new_password":"password456"}`)
+			if status == http.StatusTooManyRequests {
+				break
+			}
+			if status != http.StatusUnauthorized || i > accountPolicy.freeAttempts {
+				t.Fatalf("guess %d: %d %s", i, status, body)
+			}
+		}
+		// The right password doesn't help once locked, neither does another
+		// endpoint
+		if status, _ := do(t, handler, "POST", "/account/password", session, `{"current_password":"password123","new_password":"password456"}`); status != http.StatusTooManyRequests {
+			t.Errorf("password change while locked: %d", status)
+		}
+		if status, _ := do(t, handler, "POST", "/account/email", session, `{"email":"hank@example.org","password":"password123"}`); status != http.StatusTooManyRequests {
+			t.Errorf("email change while locked: %d", status)
+		}
+	})
+}
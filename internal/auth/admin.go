@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// UserFromSessionID returns the owner of a session, accounts that are not
+// verified or disabled can't use their sessions
+func (s *Service) UserFromSessionID(sessionID string) (*User, error) {
+	user, err := s.store.GetUserFromSessionID(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	if !user.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+	return user, nil
+}
+
+// SessionCount returns the number of sessions of all users
+func (s *Service) SessionCount() (int, error) {
+	return s.store.CountSessions()
+}
+
+// isAdmin reports whether username is one of the configured administrators
+// (ADMIN_USERS)
+func (s *Service) isAdmin(username string) bool {
+	return slices.ContainsFunc(s.admins, func(admin string) bool {
+		return strings.EqualFold(strings.TrimSpace(admin), username)
+	})
+}
+
+// bootstrapAdmins promotes the configured administrators that already have an
+// account as long as there is no administrator. Afterwards roles are only
+// changed through the admin API, a demotion sticks across restarts.
+func (s *Service) bootstrapAdmins() error {
+	if len(s.admins) == 0 {
+		return nil
+	}
+	n, err := s.store.CountAdmins()
+	if err != nil || n > 0 {
+		return err
+	}
+	for _, username := range s.admins {
+		if username = strings.TrimSpace(username); username == "" {
+			continue
+		}
+		if err := s.SetRole(username, RoleAdmin); err != nil && err != ErrUserNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// createUser creates an account with the invite quota of the registration
+// policy, configured administrators start out with the admin role
+func (s *Service) createUser(email, password, username string, verified bool) error {
+	if err := s.store.CreateUser(email, password, username, verified, s.registration.InviteQuota); err != nil {
+		return err
+	}
+	if !s.isAdmin(username) {
+		return nil
+	}
+	return s.store.SetRole(email, RoleAdmin)
+}
+
+// SearchUsers returns users whose email or username contains query
+func (s *Service) SearchUsers(query string, limit, offset int) ([]User, error) {
+	return s.store.SearchUsers(query, limit, offset)
+}
+
+func (s *Service) SetRole(username, role string) error {
+	if role != RoleUser && role != RoleAdmin {
+		return errors.New("unknown role " + role)
+	}
+	user, err := s.store.GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	return s.store.SetRole(user.Email, role)
+}
+
+// SetDisabled disables or enables an account, disabling also ends all of its
+// sessions
+func (s *Service) SetDisabled(username string, disabled bool) error {
+	user, err := s.store.GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	if err := s.store.SetDisabled(user.Email, disabled); err != nil {
+		return err
+	}
+	if disabled {
+		if err := s.store.DeleteSessions(user.Email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeSessions logs the user out everywhere
+func (s *Service) RevokeSessions(username string) error {
+	user, err := s.store.GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	return s.store.DeleteSessions(user.Email)
+}
+
+// Unlock lifts the login throttle of an account and/or an IP
+func (s *Service) Unlock(email, ip string) error {
+	if email = normalizeEmail(email); email != "" {
+		if err := s.store.DeleteLoginFailures(accountKey(email)); err != nil {
+			return err
+		}
+	}
+	if ip != "" {
+		if err := s.store.DeleteLoginFailures(ipKey(ip)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MintInvite creates an invite that doesn't count against any quota
+func (s *Service) MintInvite(createdBy string) (string, error) {
+	return s.newInvite(createdBy)
+}
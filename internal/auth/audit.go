@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"codeserver/internal/audit"
+	"encoding/json"
+	"net/http"
+)
+
+// userEvent is an audit event the user caused on their own account
+func userEvent(r *http.Request, typ string, user *User, detail string) audit.Event {
+	e := audit.FromRequest(r, typ)
+	e.Actor, e.ActorID = user.Username, user.ID
+	e.Username, e.UserID = user.Username, user.ID
+	e.Subject = user.Email
+	e.Success = true
+	e.Detail = detail
+	return e
+}
+
+// loginFailure records a failed login for account, which is the email of an
+// existing user or the identifier as it was entered
+func (s *Service) loginFailure(r *http.Request, account, detail string) {
+	e := audit.FromRequest(r, audit.LoginFailure)
+	e.Subject = account
+	e.Detail = detail
+	if user, err := s.store.GetUser(account); err == nil {
+		e.Username, e.UserID = user.Username, user.ID
+	}
+	s.audit.Record(e)
+}
+
+// userID returns the ID of the user holding username, zero if none does
+func (s *Service) userID(username string) int64 {
+	user, err := s.store.GetUserByUsername(username)
+	if err != nil {
+		return 0
+	}
+	return user.ID
+}
+
+// events returns the audit events of the session's user, selected by ID as
+// earlier holders of the username may have had events of their own
+// type: optional, since: optional (RFC 3339), until: optional, limit: optional, offset: optional
+func (s *Service) events(w http.ResponseWriter, r *http.Request) {
+	user := s.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	filter, err := audit.FilterFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Username, filter.UserID = "", user.ID
+	evs, err := s.audit.Query(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(evs)
+}
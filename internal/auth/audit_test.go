@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"codeserver/internal/audit"
+	"codeserver/internal/migrate"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	db := newTestService(t, Config{}).store.(*sqlStore).db
+	if _, err := migrate.Up(context.Background(), db, audit.Schemas[db.Dialect], 0); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Config{DB: db, TokenSecret: "test secret", Audit: audit.New(db, nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := s.Handler()
+
+	// events returns the types of the session user's events
+	events := func(session, query string) []string {
+		t.Helper()
+		status, body := do(t, handler, "GET", "/audit"+query, session, "")
+		var evs []audit.Event
+		if err := json.Unmarshal([]byte(body), &evs); status != http.StatusOK || err != nil {
+			t.Fatalf("events: %d %s", status, body)
+		}
+		types := []string{}
+		for _, e := range evs {
+			types = append(types, e.Type)
+		}
+		return types
+	}
+
+	ann := newTestUser(t, s, "ann@example.com", "ann")
+	if status, body := do(t, handler, "POST", "/login", "", `{"username":"ann","password":"password123"}`); status != http.StatusOK {
+		t.Fatalf("login: %d %s", status, body)
+	}
+	if status, body := do(t, handler, "POST", "/account/username", ann, `{"username":"anna"}`); status != http.StatusOK {
+		t.Fatalf("rename: %d %s", status, body)
+	}
+
+	// Someone else takes the freed username
+	other := newTestUser(t, s, "zed@example.com", "ann")
+	if status, body := do(t, handler, "POST", "/login", "", `{"username":"ann","password":"wrong"}`); status != http.StatusUnauthorized {
+		t.Fatalf("failed login: %d %s", status, body)
+	}
+	if got := events(other, ""); len(got) != 1 || got[0] != audit.LoginFailure {
+		t.Errorf("events of the new ann: %v, want only the failed login", got)
+	}
+	if got := events(ann, ""); len(got) != 2 || got[0] != audit.UserRename || got[1] != audit.LoginSuccess {
+		t.Errorf("events of anna: %v, want the rename and the login", got)
+	}
+
+	// The username parameter doesn't select another user's events
+	if got := events(other, "?username=anna"); len(got) != 1 || got[0] != audit.LoginFailure {
+		t.Errorf("events of anna by name: %v", got)
+	}
+}
@@ -1,226 +1,254 @@
 package auth
 
 import (
-	"database/sql"
+	"codeserver/internal/audit"
+	"codeserver/internal/realip"
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
-
-	_ "github.com/tursodatabase/libsql-client-go/libsql"
-	_ "modernc.org/sqlite"
+	"time"
 )
 
-type dbStruct struct {
-	db *sql.DB
-}
-
-var (
-	db  dbStruct
-	dev bool
-
-	// Constant for reserved usernames
-	reservedUsername = [3]string{"anon", "admin", "root"}
-)
+// Handler serves the authentication API
+func (s *Service) Handler() http.Handler {
+	authhandler := http.NewServeMux()
+	authhandler.HandleFunc("GET /config", s.config)
+	authhandler.HandleFunc("GET /username", s.username)
+	authhandler.HandleFunc("POST /logout", s.logout)
+	authhandler.HandleFunc("GET /me", s.me)
+	authhandler.HandleFunc("GET /audit", s.events)
+	authhandler.HandleFunc("POST /account/username", s.changeUsername)
+	authhandler.HandleFunc("DELETE /account", s.deleteAccount)
 
-func Init(tursoURL, tursoToken string, _dev bool) {
-	dev = _dev
-	if _dev {
-		_db, err := sql.Open("sqlite", "file:auth.db?cache=shared")
-		if err != nil {
-			panic(err)
-		}
-		db = dbStruct{db: _db}
-		err = createTable()
-		if err != nil {
-			panic(err)
-		}
-		return
+	// Behind an authenticating proxy the proxy owns credentials and email
+	// addresses, a changed address would just provision a new account
+	if s.loginDisabled() {
+		return authhandler
 	}
 
-	conn := tursoURL + "?authToken=" + tursoToken
+	authhandler.HandleFunc("POST /register", s.register)
+	authhandler.HandleFunc("POST /login", s.login)
+	authhandler.HandleFunc("POST /login/totp", s.loginTOTP)
+	authhandler.HandleFunc("POST /ldap/link", s.ldapLink)
 
-	_db, err := sql.Open("libsql", conn)
-	if err != nil {
-		panic(err)
-	}
+	authhandler.HandleFunc("GET /verify-email", s.verifyEmail)
+	authhandler.HandleFunc("POST /verify-email", s.verifyEmail)
+	authhandler.HandleFunc("POST /verify-email/resend", s.resendVerification)
+	authhandler.HandleFunc("POST /password/forgot", s.forgotPassword)
+	authhandler.HandleFunc("POST /password/reset", s.resetPassword)
 
-	db = dbStruct{db: _db}
-	err = createTable()
-	if err != nil {
-		panic(err)
-	}
-}
+	authhandler.HandleFunc("GET /invites", s.listInvites)
+	authhandler.HandleFunc("POST /invites", s.createInvite)
 
-func AuthHandler() http.Handler {
-	authhandler := http.NewServeMux()
-	authhandler.HandleFunc("GET /username", username)
-	authhandler.HandleFunc("POST /register", register)
-	authhandler.HandleFunc("POST /login", login)
-	authhandler.HandleFunc("POST /logout", logout)
-	authhandler.HandleFunc("GET /me", me)
+	authhandler.HandleFunc("POST /account/password", s.changePassword)
+	authhandler.HandleFunc("POST /account/email", s.changeEmail)
+	authhandler.HandleFunc("GET /account/email/confirm", s.confirmEmail)
+	authhandler.HandleFunc("POST /account/email/confirm", s.confirmEmail)
 
-	if dev {
-		authhandler.HandleFunc("GET /users", getAllUsers)
-		authhandler.HandleFunc("GET /sessions", getAllSessions)
-		authhandler.HandleFunc("POST /reset", reset)
-	}
-	return authhandler
-}
+	authhandler.HandleFunc("POST /totp/enroll", s.totpEnroll)
+	authhandler.HandleFunc("POST /totp/verify", s.totpVerify)
+	authhandler.HandleFunc("POST /totp/disable", s.totpDisable)
 
-func getAllUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := db.getUsers()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(users)
-}
+	authhandler.HandleFunc("GET /oidc/{provider}/login", s.oidcLogin)
+	authhandler.HandleFunc("GET /oidc/{provider}/callback", s.oidcCallback)
+	authhandler.HandleFunc("POST /oidc/{provider}/link", s.oidcLink)
+	authhandler.HandleFunc("POST /oidc/link/confirm", s.oidcConfirmLink)
+	authhandler.HandleFunc("POST /oidc/register", s.oidcRegister)
 
-func getAllSessions(w http.ResponseWriter, r *http.Request) {
-	sessions, err := db.getAllSessions()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(sessions)
+	return authhandler
 }
 
-func reset(w http.ResponseWriter, r *http.Request) {
-	table := r.URL.Query().Get("table")
-	err := db.reset(table)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// username route will check if a username is taken, the registration policy
+// is reported in headers so clients can tell whether to ask for an invite
+func (s *Service) username(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Registration-Mode", string(s.registration.Mode))
+	if len(s.registration.AllowedDomains) > 0 {
+		w.Header().Set("X-Registration-Domains", strings.Join(s.registration.AllowedDomains, ","))
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("database reset"))
-}
-
-// username route will check if a username is taken
-func username(w http.ResponseWriter, r *http.Request) {
 	username := r.URL.Query().Get("username")
-	for _, reserved := range reservedUsername {
-		if username == reserved {
-			w.WriteHeader(http.StatusConflict)
-			w.Write([]byte("username forbidden"))
-			return
-		}
-	}
-	exists := db.usernameExists(username)
-	if exists {
-		w.WriteHeader(http.StatusConflict)
-		w.Write([]byte("username taken"))
+	if err := s.checkUsername(username); err != nil {
+		w.WriteHeader(usernameStatus(err))
+		w.Write([]byte(err.Error()))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("username available"))
 }
 
-func register(w http.ResponseWriter, r *http.Request) {
+func (s *Service) register(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
 		Username string `json:"username"`
+		Invite   string `json:"invite"` // Required in invite mode
 	}
 	err := json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	data.Email = normalizeEmail(data.Email)
 	if data.Email == "" || data.Password == "" || data.Username == "" {
 		http.Error(w, "email, password adn username are required", http.StatusBadRequest)
 		return
 	}
-	log.Printf("[/auth/register] user %s is trying to register", data.Email)
-	err = db.createUser(data.Email, data.Password, data.Username)
+	if err := s.checkRegistration(data.Email); err != nil {
+		http.Error(w, err.Error(), registrationStatus(err))
+		return
+	}
+	if err := s.checkUsername(data.Username); err != nil {
+		http.Error(w, err.Error(), usernameStatus(err))
+		return
+	}
+	release, err := s.claimInvite(data.Invite, data.Email)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), registrationStatus(err))
+		return
+	}
+	err = s.createUser(data.Email, data.Password, data.Username, false)
+	if err != nil {
+		release()
+		http.Error(w, err.Error(), registrationStatus(err))
 		return
 	}
-	log.Printf("[/auth/register] user created: %s", data.Email)
+	slog.InfoContext(r.Context(), "user created", "method", "password", "email", data.Email, "username", data.Username)
+	s.audit.Record(userEvent(r, audit.Register, &User{Email: data.Email, Username: data.Username}, "method=password"))
+	if err := s.sendVerificationEmail(r.Context(), data.Email); err != nil {
+		slog.ErrorContext(r.Context(), "sending verification email failed", "email", data.Email, "error", err)
+	}
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("user created"))
 }
 
-func login(w http.ResponseWriter, r *http.Request) {
+// login accepts either the email or the username as identifier
+func (s *Service) login(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
-		Username string `json:"username"` // Unimplemented
+		Username string `json:"username"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
-		if err.Error() == "user not found" {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	log.Printf("[/auth/login] user %s is trying to login", data.Email)
-	verified, err := verify(data.Email, data.Password)
+	identifier := data.Email
+	if data.Username != "" {
+		identifier = data.Username
+	}
+	if identifier == "" || data.Password == "" {
+		http.Error(w, "email or username and password are required", http.StatusBadRequest)
+		return
+	}
+	account, ip := s.accountFor(identifier), realip.FromRequest(r)
+	wait, err := s.countLoginAttempt(account, ip)
 	if err != nil {
-		if err.Error() == "user not found" {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			log.Printf("[/auth/login] [user not found] user %s failed to login", data.Email)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("[/auth/login] [internal error] user %s failed to login", data.Email)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "login throttle check failed", "error", err)
+		return
+	}
+	if wait > 0 {
+		s.loginFailure(r, account, "throttled")
+		writeThrottled(w, wait)
+		slog.InfoContext(r.Context(), "login throttled", "wait", wait.String())
 		return
 	}
-	if !verified {
-		http.Error(w, "invalid credentials", http.StatusUnauthorized)
-		log.Printf("[/auth/login] [invalid credentials] user %s failed to login", data.Email)
+	user, err := s.verify(r.Context(), identifier, data.Password)
+	if err != nil {
+		// Don't tell whether the account exists
+		if err == ErrInvalidCredentials {
+			s.recordLoginFailure(r, account, ip, "invalid credentials")
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			slog.InfoContext(r.Context(), "login failed, invalid credentials")
+			return
+		}
+		if err == ErrIdentityNotLinked {
+			s.loginFailure(r, account, "identity not linked")
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "login failed", "error", err)
 		return
 	}
-	agent := r.Header.Get("User-Agent")
-	ip := r.RemoteAddr
-	ip = strings.Split(ip, ":")[0] // Remove port
-	sessionID, err := db.createSession(data.Email, agent, ip)
+	s.loginAttemptPassed(ip)
+	s.completeLogin(w, r, user, "password")
+}
+
+// startSession creates a session for the already verified user and writes
+// the session ID as the response, or sets the session cookies if the client
+// asked for them. method is recorded in the audit log.
+func (s *Service) startSession(w http.ResponseWriter, r *http.Request, user *User, method string) {
+	sessionID, err := s.newSession(r, user, method)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if wantsCookie(r) {
+		s.setSessionCookies(w, sessionID)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("login success"))
+		return
+	}
 	w.Header().Set("X-Session-ID", sessionID)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(sessionID))
 }
 
-func logout(w http.ResponseWriter, r *http.Request) {
-	sessionID := r.Header.Get("Authorization")
-	if sessionID == "" {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+// newSession creates a session and audits the successful login. The session
+// is stored right away, its location is resolved in the background so a slow
+// lookup doesn't delay the login.
+func (s *Service) newSession(r *http.Request, user *User, method string) (string, error) {
+	sessionID, err := s.store.CreateSession(user.Email, r.Header.Get("User-Agent"))
+	if err != nil {
+		return "", err
+	}
+	go s.resolveLocation(sessionID, realip.FromRequest(r))
+	s.audit.Record(userEvent(r, audit.LoginSuccess, user, "method="+method))
+	return sessionID, nil
+}
+
+func (s *Service) logout(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := s.SessionID(r)
+	if err != nil {
+		http.Error(w, err.Error(), sessionStatus(err))
 		return
 	}
-	sessionID = sessionID[7:] // Remove "Bearer "
+	s.clearSessionCookies(w)
 
-	err := db.deleteSession(sessionID)
+	user, _ := s.store.GetUserFromSessionID(sessionID)
+	err = s.store.DeleteSession(sessionID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if user != nil {
+		s.audit.Record(userEvent(r, audit.Logout, user, ""))
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("logout success"))
 }
 
-func me(w http.ResponseWriter, r *http.Request) {
+// me describes the session's user
+// session_id: optional, the Authorization header, session cookie or proxy
+// headers otherwise
+func (s *Service) me(w http.ResponseWriter, r *http.Request) {
+	var user *User
+	var err error
 	sessionID := r.URL.Query().Get("session_id")
-	if sessionID == "" {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		return
+	if sessionID != "" {
+		user, err = s.store.GetUserFromSessionID(sessionID)
+	} else {
+		user, sessionID, err = s.currentUser(r)
 	}
-
-	user, err := db.getUserFromSessionID(sessionID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), sessionStatus(err))
 		return
 	}
 
-	sessions, err := db.getSessions(user.Email)
+	sessions, err := s.store.GetSessions(user.Email)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -252,8 +280,26 @@ func me(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]any{
-		"email":    user.Email,
-		"username": user.Username,
-		"sessions": respSessions,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"username":       user.Username,
+		"role":           user.Role,
+		"sessions":       respSessions,
 	})
 }
+
+func (s *Service) resolveLocation(sessionID, ip string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	location, err := s.locator.Locate(ctx, ip)
+	if err != nil {
+		slog.Warn("locating session failed", "error", err)
+		return
+	}
+	if location == "" {
+		return
+	}
+	if err := s.store.SetSessionLocation(sessionID, location); err != nil {
+		slog.Error("storing session location failed", "error", err)
+	}
+}
@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"codeserver/internal/database"
+	"codeserver/internal/migrate"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestService returns a service on a new SQLite database, config.DB is
+// filled in
+func newTestService(t *testing.T, config Config) *Service {
+	t.Helper()
+	db, err := database.Open(filepath.Join(t.TempDir(), "auth.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := migrate.Up(context.Background(), db, Schemas[db.Dialect], 0); err != nil {
+		t.Fatal(err)
+	}
+	config.DB = db
+	if config.TokenSecret == "" {
+		config.TokenSecret = "test secret"
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newTestUser creates a verified user and returns a session of it
+func newTestUser(t *testing.T, s *Service, email, username string) string {
+	t.Helper()
+	if err := s.store.CreateUser(email, "password123", username, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	session, err := s.store.CreateSession(email, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// do sends a request to handler with the session as bearer token if it
+// isn't empty and returns the status and body
+func do(t *testing.T, handler http.Handler, method, target, session, body string) (int, string) {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if session != "" {
+		r.Header.Set("Authorization", "Bearer "+session)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	b, _ := io.ReadAll(w.Body)
+	return w.Code, string(b)
+}
+
+// fixedLocator places every address in the same city
+type fixedLocator string
+
+func (l fixedLocator) Locate(ctx context.Context, ip string) (string, error) {
+	return string(l), nil
+}
+
+func TestSessionLocation(t *testing.T) {
+	s := newTestService(t, Config{Locator: fixedLocator("Berlin, DE")})
+	newTestUser(t, s, "ann@example.com", "ann")
+	if status, body := do(t, s.Handler(), "POST", "/login", "", `{"username":"ann","password":"password123"}`); status != http.StatusOK {
+		t.Fatalf("login: %d %s", status, body)
+	}
+	// The location is resolved after the login was answered
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sessions, err := s.store.GetSessions("ann@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		located := 0
+		for _, session := range sessions {
+			if session.Location == "Berlin, DE" {
+				located++
+			}
+		}
+		if located == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sessions %+v, want the login located", sessions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	register := func(t *testing.T, s *Service, email, username, invite string) (int, string) {
+		t.Helper()
+		body := fmt.Sprintf(`{"email":%q,"password":"password123","username":%q,"invite":%q}`, email, username, invite)
+		return do(t, s.Handler(), "POST", "/register", "", body)
+	}
+
+	t.Run("open", func(t *testing.T) {
+		s := newTestService(t, Config{})
+		if status, body := register(t, s, "ann@example.com", "ann", ""); status != http.StatusCreated {
+			t.Errorf("register: %d %s", status, body)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		s := newTestService(t, Config{Registration: RegistrationPolicy{Mode: RegistrationClosed}})
+		if status, _ := register(t, s, "ann@example.com", "ann", ""); status != http.StatusForbidden {
+			t.Errorf("register: %d, want 403", status)
+		}
+		if _, err := s.store.GetUser("ann@example.com"); err != ErrUserNotFound {
+			t.Errorf("user created: %v", err)
+		}
+	})
+
+	t.Run("allowed domains", func(t *testing.T) {
+		s := newTestService(t, Config{Registration: RegistrationPolicy{AllowedDomains: []string{" Example.com "}}})
+		if status, _ := register(t, s, "ann@example.org", "ann", ""); status != http.StatusForbidden {
+			t.Errorf("other domain: %d, want 403", status)
+		}
+		if status, body := register(t, s, "ann@EXAMPLE.com", "ann", ""); status != http.StatusCreated {
+			t.Errorf("allowed domain: %d %s", status, body)
+		}
+	})
+
+	t.Run("invite", func(t *testing.T) {
+		now := time.Now()
+		s := newTestService(t, Config{
+			Clock:        func() time.Time { return now },
+			Registration: RegistrationPolicy{Mode: RegistrationInvite, InviteQuota: 1, InviteTTL: 24 * time.Hour},
+		})
+		handler := s.Handler()
+		if err := s.store.CreateUser("ann@example.com", "password123", "ann", true, 2); err != nil {
+			t.Fatal(err)
+		}
+		session, err := s.store.CreateSession("ann@example.com", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		invite := func() string {
+			t.Helper()
+			status, body := do(t, handler, "POST", "/invites", session, "")
+			if status != http.StatusCreated {
+				t.Fatalf("invite: %d %s", status, body)
+			}
+			var data struct{ Code string }
+			if err := json.Unmarshal([]byte(body), &data); err != nil {
+				t.Fatal(err)
+			}
+			return data.Code
+		}
+		first, second := invite(), invite()
+		if status, _ := do(t, handler, "POST", "/invites", session, ""); status != http.StatusForbidden {
+			t.Errorf("invite beyond the quota: %d, want 403", status)
+		}
+
+		if status, _ := register(t, s, "bob@example.com", "bob", ""); status != http.StatusForbidden {
+			t.Errorf("without an invite: %d, want 403", status)
+		}
+		if status, _ := register(t, s, "bob@example.com", "bob", "UNKNOWN"); status != http.StatusForbidden {
+			t.Errorf("unknown invite: %d, want 403", status)
+		}
+		// A failed registration gives the invite back
+		if status, _ := register(t, s, "ann@example.com", "annie", first); status != http.StatusConflict {
+			t.Errorf("existing email: %d, want 409", status)
+		}
+		if status, body := register(t, s, "bob@example.com", "bob", first); status != http.StatusCreated {
+			t.Fatalf("register: %d %s", status, body)
+		}
+		if status, _ := register(t, s, "carol@example.com", "carol", first); status != http.StatusForbidden {
+			t.Errorf("reused invite: %d, want 403", status)
+		}
+		bob, err := s.store.GetUser("bob@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bob.InviteQuota != 1 {
+			t.Errorf("new user's quota %d, want 1", bob.InviteQuota)
+		}
+
+		status, body := do(t, handler, "GET", "/invites", session, "")
+		if status != http.StatusOK {
+			t.Fatalf("list invites: %d %s", status, body)
+		}
+		var list struct {
+			Invites []Invite
+			Quota   int
+		}
+		if err := json.Unmarshal([]byte(body), &list); err != nil {
+			t.Fatal(err)
+		}
+		used := map[string]string{}
+		for _, invite := range list.Invites {
+			used[invite.Code] = invite.UsedBy
+		}
+		if list.Quota != 0 || len(used) != 2 || used[first] != "bob@example.com" || used[second] != "" {
+			t.Errorf("invites %s", body)
+		}
+
+		now = now.Add(25 * time.Hour)
+		if status, _ := register(t, s, "carol@example.com", "carol", second); status != http.StatusForbidden {
+			t.Errorf("expired invite: %d, want 403", status)
+		}
+	})
+}
+
+func TestConfiguredAdmins(t *testing.T) {
+	s := newTestService(t, Config{})
+	newTestUser(t, s, "ann@example.com", "ann")
+	db := s.store.(*sqlStore).db
+	role := func(email string) string {
+		t.Helper()
+		user, err := s.store.GetUser(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user.Role
+	}
+
+	// Without any administrator the existing accounts are promoted
+	s, err := New(Config{DB: db, TokenSecret: "test secret", Admins: []string{" Ann ", "bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := role("ann@example.com"); got != RoleAdmin {
+		t.Errorf("existing account: role %q, want admin", got)
+	}
+
+	// New accounts are promoted when they are created
+	for _, user := range []string{"bob", "carol"} {
+		body := fmt.Sprintf(`{"email":"%s@example.com","password":"password123","username":%q}`, user, user)
+		if status, body := do(t, s.Handler(), "POST", "/register", "", body); status != http.StatusCreated {
+			t.Fatalf("register %s: %d %s", user, status, body)
+		}
+	}
+	if got := role("bob@example.com"); got != RoleAdmin {
+		t.Errorf("new configured account: role %q, want admin", got)
+	}
+	if got := role("carol@example.com"); got != RoleUser {
+		t.Errorf("new account: role %q, want user", got)
+	}
+
+	// A demotion survives restarts
+	if err := s.SetRole("ann", RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Config{DB: db, TokenSecret: "test secret", Admins: []string{"ann", "bob"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := role("ann@example.com"); got != RoleUser {
+		t.Errorf("demoted account after a restart: role %q, want user", got)
+	}
+}
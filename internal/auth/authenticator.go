@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"context"
+	"strings"
+)
+
+// Authenticator checks a login identifier (email or username) and password.
+// It returns ErrUserNotFound for users it doesn't know, so the next
+// authenticator gets a chance, and ErrInvalidCredentials for wrong passwords.
+// The returned user always has a row in the users table.
+type Authenticator interface {
+	Authenticate(ctx context.Context, identifier, password string) (*User, error)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface
+type AuthenticatorFunc func(ctx context.Context, identifier, password string) (*User, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, identifier, password string) (*User, error) {
+	return f(ctx, identifier, password)
+}
+
+// authenticateDatabase checks the bcrypt hash in the users table. Accounts
+// without a password (created through OIDC, LDAP or the proxy) are left to
+// the other authenticators.
+func (s *Service) authenticateDatabase(ctx context.Context, identifier, password string) (*User, error) {
+	var user *User
+	var err error
+	if strings.Contains(identifier, "@") {
+		user, err = s.store.GetUser(normalizeEmail(identifier))
+	} else {
+		user, err = s.store.GetUserByUsername(identifier)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Password == "" {
+		return nil, ErrUserNotFound
+	}
+	if !checkPassword(password, user.Password) {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+// Browsers get the session in an HttpOnly cookie instead of the response body
+// so scripts never see it. Requests authenticated by the cookie must echo the
+// CSRF token from the (script readable) CSRF cookie in the CSRF header.
+const (
+	SessionCookie = "session"
+	CSRFCookie    = "csrf"
+	CSRFHeader    = "X-CSRF-Token"
+	// OIDCStateCookie ties an OIDC login with the cookie transport to the
+	// browser that started it
+	OIDCStateCookie = "oidc_state"
+)
+
+// CookiePolicy configures the cookies of the cookie session transport
+type CookiePolicy struct {
+	Secure   bool // Only sent over HTTPS, disable for plain HTTP development
+	SameSite http.SameSite
+	MaxAge   time.Duration
+}
+
+func (s *Service) setCookiePolicy(policy CookiePolicy) {
+	if policy.SameSite == 0 {
+		policy.SameSite = http.SameSiteLaxMode
+	}
+	s.cookies = policy
+}
+
+// wantsCookie reports whether the client asked for the cookie transport with
+// ?transport=cookie on a login route
+func wantsCookie(r *http.Request) bool {
+	return r.URL.Query().Get("transport") == "cookie"
+}
+
+// csrfToken is derived from the session, so it needs no storage and a token
+// planted by a sibling domain never matches the victim's session
+func (s *Service) csrfToken(sessionID string) string {
+	mac := hmac.New(sha256.New, s.tokenSecret)
+	mac.Write([]byte("csrf:" + sessionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Service) setSessionCookies(w http.ResponseWriter, sessionID string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    sessionID,
+		Path:     "/",
+		MaxAge:   int(s.cookies.MaxAge.Seconds()),
+		Secure:   s.cookies.Secure,
+		HttpOnly: true,
+		SameSite: s.cookies.SameSite,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    s.csrfToken(sessionID),
+		Path:     "/",
+		MaxAge:   int(s.cookies.MaxAge.Seconds()),
+		Secure:   s.cookies.Secure,
+		SameSite: s.cookies.SameSite,
+	})
+}
+
+func (s *Service) clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{SessionCookie, CSRFCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			MaxAge:   -1,
+			Secure:   s.cookies.Secure,
+			HttpOnly: name == SessionCookie,
+			SameSite: s.cookies.SameSite,
+		})
+	}
+}
+
+// setOIDCStateCookie remembers value until the callback, which the provider
+// reaches by a cross-site redirect, so it is always SameSite=Lax
+func (s *Service) setOIDCStateCookie(w http.ResponseWriter, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDCStateCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		Secure:   s.cookies.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *Service) oidcStateCookieMatches(r *http.Request, value string) bool {
+	cookie, err := r.Cookie(OIDCStateCookie)
+	return err == nil && value != "" && hmac.Equal([]byte(cookie.Value), []byte(value))
+}
+
+func (s *Service) clearOIDCStateCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDCStateCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   s.cookies.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// SessionID returns the session of the request, taken from the Authorization
+// header or else the session cookie. Cookie sessions only pass on unsafe
+// methods with a matching CSRF header.
+func (s *Service) SessionID(r *http.Request) (string, error) {
+	if token, ok := bearerToken(r); ok {
+		return token, nil
+	}
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil || cookie.Value == "" {
+		return "", ErrNoSession
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return cookie.Value, nil
+	}
+	if !hmac.Equal([]byte(r.Header.Get(CSRFHeader)), []byte(s.csrfToken(cookie.Value))) {
+		return "", ErrCSRF
+	}
+	return cookie.Value, nil
+}
+
+// sessionStatus maps errors authenticating a request to HTTP status codes
+func sessionStatus(err error) int {
+	switch err {
+	case ErrCSRF, ErrUserDisabled, ErrEmailNotVerified:
+		return http.StatusForbidden
+	case ErrNoSession, ErrUserNotFound:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
@@ -1,18 +1,51 @@
 package auth
 
 import (
+	"codeserver/internal/database"
+	"codeserver/internal/migrate"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
 	"errors"
-	"log"
+	"log/slog"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+//go:embed migrations
+var migrations embed.FS
+
+// Schemas are the migrations of the auth tables for every dialect
+var Schemas = migrate.MustLoadDialects("auth", migrations, "migrations")
+
+// sqlStore is the Store of every SQL database, the dialect of db covers
+// placeholders, case folding and constraint errors
+type sqlStore struct {
+	db *database.DB
+}
+
+// NewStore returns the Store kept in db, which has to be migrated to
+// Schemas[db.Dialect]
+func NewStore(db *database.DB) Store {
+	return &sqlStore{db: db}
+}
+
 type User struct {
-	Email     string
-	Password  string
-	Username  string
-	CreatedAt string
+	ID          int64 // Referenced by objects when storage shares the database
+	Email       string
+	Password    string
+	Username    string
+	CreatedAt   string
+	TOTPSecret  string
+	TOTPEnabled bool
+	// Set once the user proved ownership of the email address
+	EmailVerified bool
+	InviteQuota   int
+	Role          string
+	Disabled      bool
+	EmailChanges  int // Incremented by ChangeEmail
 }
 
 type Session struct {
@@ -24,6 +57,29 @@ type Session struct {
 	CreatedAt string `json:"created_at"`
 }
 
+// LoginChallenge is a login that passed the first factor and waits for the
+// second one
+type LoginChallenge struct {
+	Email  string
+	Method string // How the first factor was passed
+}
+
+// Identity links an account at an external OpenID Connect provider to a user
+type Identity struct {
+	Provider  string
+	Subject   string
+	Email     string
+	CreatedAt string
+}
+
+type Invite struct {
+	Code      string `json:"code"`
+	CreatedBy string `json:"-"`
+	CreatedAt string `json:"created_at"`
+	UsedBy    string `json:"used_by,omitempty"`
+	UsedAt    string `json:"used_at,omitempty"`
+}
+
 type AuthError string
 
 // implement the error interface
@@ -33,33 +89,25 @@ func (e AuthError) Error() string {
 
 // define auth errors
 const (
-	ErrUserAlreadyExists AuthError = "user already exists"
-	ErrUserNotFound      AuthError = "user not found"
+	ErrUserAlreadyExists  AuthError = "user already exists"
+	ErrUserNotFound       AuthError = "user not found"
+	ErrInvalidCredentials AuthError = "invalid credentials"
+	ErrIdentityNotFound   AuthError = "identity not found"
+	ErrIdentityLinked     AuthError = "identity already linked"
+	ErrIdentityNotLinked  AuthError = "account exists, log in and link this identity"
+	ErrInvalidToken       AuthError = "invalid or expired token"
+	ErrEmailNotVerified   AuthError = "email not verified"
+	ErrUsernameForbidden  AuthError = "username forbidden"
+	ErrUsernameTaken      AuthError = "username taken"
+	ErrUsernameInvalid    AuthError = "invalid username"
+	ErrRegistrationClosed AuthError = "registration closed"
+	ErrDomainNotAllowed   AuthError = "email domain not allowed"
+	ErrInvalidInvite      AuthError = "invalid invite code"
+	ErrUserDisabled       AuthError = "account disabled"
+	ErrNoSession          AuthError = "unauthorized"
+	ErrCSRF               AuthError = "invalid CSRF token"
 )
 
-func createTable() error {
-	query := `
-        CREATE TABLE IF NOT EXISTS users (
-            email VARCHAR(255) PRIMARY KEY,
-			password VARCHAR(255),
-            username VARCHAR(255) UNIQUE,
-            created_at VARCHAR(255)
-        );
-		CREATE TABLE IF NOT EXISTS sessions (
-            id VARCHAR(255) PRIMARY KEY,
-            email VARCHAR(255),
-			location VARCHAR(255),
-			agent VARCHAR(255),
-			last_seen VARCHAR(255),
-            created_at VARCHAR(255),
-
-			FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
-	)`
-
-	_, err := db.db.Exec(query)
-	return err
-}
-
 // hash a plain text password
 func hashPassword(password string) (string, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -73,76 +121,45 @@ func hashPassword(password string) (string, error) {
 func checkPassword(password, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	if err != nil {
-		log.Println(err)
+		if err != bcrypt.ErrMismatchedHashAndPassword {
+			slog.Error("comparing password hash failed", "error", err)
+		}
 		return false
 	}
 	return err == nil
 }
 
-func (db *dbStruct) getUsers() ([]User, error) {
-	rows, err := db.db.Query("SELECT email, password, username, created_at FROM users")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	users := []User{}
-	for rows.Next() {
-		user := User{}
-		err := rows.Scan(&user.Email, &user.Password, &user.Username, &user.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		users = append(users, user)
-	}
-	return users, nil
-}
-
-func (db *dbStruct) getAllSessions() ([]Session, error) {
-	rows, err := db.db.Query("SELECT id, email, created_at FROM sessions")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	sessions := []Session{}
-	for rows.Next() {
-		session := Session{}
-		err := rows.Scan(&session.ID, &session.Email, &session.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		sessions = append(sessions, session)
-	}
-	return sessions, nil
-}
-
-func (db *dbStruct) reset(table string) error {
-	_, err := db.db.Exec("DELETE FROM " + table)
-	return err
-}
-
-func (db *dbStruct) createUser(email, password, username string) error {
-	user, err := db.getUser(email)
+func (db *sqlStore) CreateUser(email, password, username string, verified bool, inviteQuota int) error {
+	user, err := db.GetUser(email)
 	if err != nil && err != ErrUserNotFound {
 		return err
 	}
 	if user != nil {
 		return ErrUserAlreadyExists
 	}
-	hashed, err := hashPassword(password)
-	if err != nil {
-		return err
+	// Users registered through an external provider have no local password
+	hashed := ""
+	if password != "" {
+		hashed, err = hashPassword(password)
+		if err != nil {
+			return err
+		}
 	}
-	db.db.Exec(
-		"INSERT INTO users (email, password, username, created_at) VALUES (?, ?, ?, ?)",
-		email, hashed, username, time.Now().Format(time.RFC3339),
+	_, err = db.db.Exec(
+		"INSERT INTO users (email, password, username, created_at, email_verified, invite_quota) VALUES (?, ?, ?, ?, ?, ?)",
+		email, hashed, username, time.Now().UnixMilli(), verified, inviteQuota,
 	)
-	return nil
+	// Another request may have registered the address since the check
+	if db.db.Dialect.IsUnique(err) {
+		return ErrUserAlreadyExists
+	}
+	return err
 }
 
-func (db *dbStruct) getUser(email string) (*User, error) {
-	row := db.db.QueryRow("SELECT email, password, username FROM users WHERE email = ?", email)
+func (db *sqlStore) GetUser(email string) (*User, error) {
+	row := db.db.QueryRow("SELECT id, email, password, username, created_at, totp_secret, totp_enabled, email_verified, invite_quota, role, disabled, email_changes FROM users WHERE email = ?", email)
 	user := &User{}
-	err := row.Scan(&user.Email, &user.Password, &user.Username)
+	err := row.Scan(&user.ID, &user.Email, &user.Password, &user.Username, database.Timestamp(&user.CreatedAt), &user.TOTPSecret, &user.TOTPEnabled, &user.EmailVerified, &user.InviteQuota, &user.Role, &user.Disabled, &user.EmailChanges)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
 			return nil, ErrUserNotFound
@@ -152,36 +169,54 @@ func (db *dbStruct) getUser(email string) (*User, error) {
 	return user, nil
 }
 
-func (db *dbStruct) getUserFromSessionID(sessionID string) (*User, error) {
-	session, err := db.getSession(sessionID)
+// GetUserByUsername looks the user up ignoring the case of the username
+func (db *sqlStore) GetUserByUsername(username string) (*User, error) {
+	row := db.db.QueryRow("SELECT email FROM users WHERE "+db.db.Dialect.Fold("username")+" = "+db.db.Dialect.Fold("?"), username)
+	var email string
+	err := row.Scan(&email)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return db.GetUser(email)
+}
+
+func (db *sqlStore) GetUserFromSessionID(sessionID string) (*User, error) {
+	session, err := db.GetSession(sessionID)
 	if err != nil {
 		return nil, err
 	}
 	if session == nil {
 		return nil, errors.New("session not found")
 	}
-	return db.getUser(session.Email)
+	return db.GetUser(session.Email)
 }
 
-func (db *dbStruct) createSession(email, agent, ip string) (string, error) {
-	uniqueID := generateUniqueID()
-	location, err := ip2Location(ip)
+func (db *sqlStore) CreateSession(email, agent string) (string, error) {
+	uniqueID, err := randomToken(32)
 	if err != nil {
-		location = "unknown"
+		return "", err
 	}
 
 	query := "INSERT INTO sessions (id, email, location, agent, last_seen, created_at) VALUES (?, ?, ?, ?, ?, ?)"
-	_, err = db.db.Exec(query, uniqueID, email, location, agent, time.Now().Format(time.RFC3339), time.Now().Format(time.RFC3339))
+	_, err = db.db.Exec(query, uniqueID, email, "unknown", agent, time.Now().UnixMilli(), time.Now().UnixMilli())
 	if err != nil {
 		return "", err
 	}
 	return uniqueID, nil
 }
 
-func (db *dbStruct) getSession(sessionID string) (*Session, error) {
+func (db *sqlStore) SetSessionLocation(sessionID, location string) error {
+	_, err := db.db.Exec("UPDATE sessions SET location = ? WHERE id = ?", location, sessionID)
+	return err
+}
+
+func (db *sqlStore) GetSession(sessionID string) (*Session, error) {
 	row := db.db.QueryRow("SELECT id, email, location, agent, last_seen, created_at FROM sessions WHERE id = ?", sessionID)
 	session := &Session{}
-	err := row.Scan(&session.ID, &session.Email, &session.Location, &session.Agent, &session.LastSeen, &session.CreatedAt)
+	err := row.Scan(&session.ID, &session.Email, &session.Location, &session.Agent, database.Timestamp(&session.LastSeen), database.Timestamp(&session.CreatedAt))
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
 			return nil, ErrUserNotFound
@@ -191,7 +226,7 @@ func (db *dbStruct) getSession(sessionID string) (*Session, error) {
 	return session, nil
 }
 
-func (db *dbStruct) getSessions(email string) ([]Session, error) {
+func (db *sqlStore) GetSessions(email string) ([]Session, error) {
 	rows, err := db.db.Query("SELECT id, location, agent, last_seen, created_at FROM sessions WHERE email = ?", email)
 	if err != nil {
 		return nil, err
@@ -200,7 +235,7 @@ func (db *dbStruct) getSessions(email string) ([]Session, error) {
 	sessions := []Session{}
 	for rows.Next() {
 		session := Session{}
-		err := rows.Scan(&session.ID, &session.Location, &session.Agent, &session.LastSeen, &session.CreatedAt)
+		err := rows.Scan(&session.ID, &session.Location, &session.Agent, database.Timestamp(&session.LastSeen), database.Timestamp(&session.CreatedAt))
 		if err != nil {
 			return nil, err
 		}
@@ -209,7 +244,7 @@ func (db *dbStruct) getSessions(email string) ([]Session, error) {
 	return sessions, nil
 }
 
-func (db *dbStruct) deleteSession(sessionID string) error {
+func (db *sqlStore) DeleteSession(sessionID string) error {
 	query := "DELETE FROM sessions WHERE id = ?"
 	_, err := db.db.Exec(query, sessionID)
 	if err != nil {
@@ -218,8 +253,40 @@ func (db *dbStruct) deleteSession(sessionID string) error {
 	return nil
 }
 
-func (db *dbStruct) usernameExists(username string) bool {
-	row := db.db.QueryRow("SELECT username FROM users WHERE username = ?", username)
+// DeleteSessions logs the user out everywhere
+func (db *sqlStore) DeleteSessions(email string) error {
+	_, err := db.db.Exec("DELETE FROM sessions WHERE email = ?", email)
+	return err
+}
+
+// DeleteOtherSessions logs the user out everywhere except the given session
+func (db *sqlStore) DeleteOtherSessions(email, sessionID string) error {
+	_, err := db.db.Exec("DELETE FROM sessions WHERE email = ? AND id != ?", email, sessionID)
+	return err
+}
+
+func (db *sqlStore) CountSessions() (int, error) {
+	var n int
+	err := db.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&n)
+	return n, err
+}
+
+func (db *sqlStore) SetPassword(email, password string) error {
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec("UPDATE users SET password = ? WHERE email = ?", hashed, email)
+	return err
+}
+
+func (db *sqlStore) SetEmailVerified(email string) error {
+	_, err := db.db.Exec("UPDATE users SET email_verified = TRUE WHERE email = ?", email)
+	return err
+}
+
+func (db *sqlStore) UsernameExists(username string) bool {
+	row := db.db.QueryRow("SELECT username FROM users WHERE "+db.db.Dialect.Fold("username")+" = "+db.db.Dialect.Fold("?"), username)
 	user := &User{}
 	err := row.Scan(&user.Username)
 	if err != nil {
@@ -230,3 +297,407 @@ func (db *dbStruct) usernameExists(username string) bool {
 	}
 	return true
 }
+
+func (db *sqlStore) UsernameRenames() (map[string]string, error) {
+	rows, err := db.db.Query("SELECT old_username, new_username FROM username_renames")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	renames := map[string]string{}
+	for rows.Next() {
+		var oldUsername, newUsername string
+		if err := rows.Scan(&oldUsername, &newUsername); err != nil {
+			return nil, err
+		}
+		renames[oldUsername] = newUsername
+	}
+	return renames, rows.Err()
+}
+
+func (db *sqlStore) DeleteUsernameRename(oldUsername string) error {
+	_, err := db.db.Exec("DELETE FROM username_renames WHERE old_username = ?", oldUsername)
+	return err
+}
+
+func (db *sqlStore) GetIdentity(provider, subject string) (*Identity, error) {
+	row := db.db.QueryRow("SELECT provider, subject, email, created_at FROM identities WHERE provider = ? AND subject = ?", provider, subject)
+	identity := &Identity{}
+	err := row.Scan(&identity.Provider, &identity.Subject, &identity.Email, database.Timestamp(&identity.CreatedAt))
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, ErrIdentityNotFound
+		}
+		return nil, err
+	}
+	return identity, nil
+}
+
+func (db *sqlStore) LinkIdentity(provider, subject, email string) error {
+	identity, err := db.GetIdentity(provider, subject)
+	if err != nil && err != ErrIdentityNotFound {
+		return err
+	}
+	if identity != nil {
+		return ErrIdentityLinked
+	}
+	query := "INSERT INTO identities (provider, subject, email, created_at) VALUES (?, ?, ?, ?)"
+	_, err = db.db.Exec(query, provider, subject, email, time.Now().UnixMilli())
+	if db.db.Dialect.IsUnique(err) {
+		return ErrIdentityLinked
+	}
+	return err
+}
+
+// SetTOTPSecret stores a new, not yet enabled, TOTP secret for the user
+func (db *sqlStore) SetTOTPSecret(email, secret string) error {
+	query := "UPDATE users SET totp_secret = ?, totp_enabled = FALSE, totp_last_counter = 0 WHERE email = ?"
+	_, err := db.db.Exec(query, secret, email)
+	return err
+}
+
+// EnableTOTP turns on the second factor and replaces the recovery codes
+func (db *sqlStore) EnableTOTP(email string, recoveryCodes []string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE users SET totp_enabled = TRUE WHERE email = ?", email); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE email = ?", email); err != nil {
+		return err
+	}
+	for _, code := range recoveryCodes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (email, code_hash) VALUES (?, ?)", email, hashRecoveryCode(code)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *sqlStore) DisableTOTP(email string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := "UPDATE users SET totp_secret = '', totp_enabled = FALSE, totp_last_counter = 0 WHERE email = ?"
+	if _, err := tx.Exec(query, email); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE email = ?", email); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPCounter records the time step a code was accepted for, it fails if
+// that step (or a later one) was already used so a code can't be replayed
+func (db *sqlStore) UseTOTPCounter(email string, counter int64) (bool, error) {
+	query := "UPDATE users SET totp_last_counter = ? WHERE email = ? AND totp_last_counter < ?"
+	res, err := db.db.Exec(query, counter, email, counter)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// UseRecoveryCode consumes a recovery code, it returns false if the code
+// doesn't exist or was already used
+func (db *sqlStore) UseRecoveryCode(email, code string) (bool, error) {
+	query := "DELETE FROM recovery_codes WHERE email = ? AND code_hash = ?"
+	res, err := db.db.Exec(query, email, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+func (db *sqlStore) SetUsername(email, username string) error {
+	_, err := db.db.Exec("UPDATE users SET username = ? WHERE email = ?", username, email)
+	if db.db.Dialect.IsUnique(err) {
+		return ErrUsernameTaken
+	}
+	return err
+}
+
+// ChangeEmail moves the account and everything referencing it to the new
+// address, which counts as verified since the change had to be confirmed
+func (db *sqlStore) ChangeEmail(oldEmail, newEmail string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE email = ?", newEmail).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return ErrUserAlreadyExists
+	}
+	res, err := tx.Exec("UPDATE users SET email = ?, email_verified = TRUE, email_changes = email_changes + 1 WHERE email = ?", newEmail, oldEmail)
+	if db.db.Dialect.IsUnique(err) {
+		return ErrUserAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	for _, table := range []string{"sessions", "identities", "recovery_codes", "login_challenges"} {
+		if _, err := tx.Exec("UPDATE "+table+" SET email = ? WHERE email = ?", newEmail, oldEmail); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteUser removes the user and every row referencing it. Foreign keys are
+// not enforced by SQLite unless enabled, so the cascade is done explicitly.
+func (db *sqlStore) DeleteUser(email string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"sessions", "identities", "recovery_codes", "login_challenges", "users"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE email = ?", email); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *sqlStore) CreateLoginChallenge(email, method string, expires time.Time) (string, error) {
+	id, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	query := "INSERT INTO login_challenges (id, email, method, expires_at) VALUES (?, ?, ?, ?)"
+	if _, err := db.db.Exec(query, id, email, method, expires.UnixMilli()); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// TakeLoginChallenge deletes the challenge in the statement that reads it,
+// so concurrent requests can't both answer it
+func (db *sqlStore) TakeLoginChallenge(id string, now time.Time) (*LoginChallenge, error) {
+	// Forget the challenges nobody answered
+	if _, err := db.db.Exec("DELETE FROM login_challenges WHERE expires_at < ?", now.UnixMilli()); err != nil {
+		return nil, err
+	}
+	row := db.db.QueryRow("DELETE FROM login_challenges WHERE id = ? RETURNING email, method", id)
+	challenge := &LoginChallenge{}
+	err := row.Scan(&challenge.Email, &challenge.Method)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func (db *sqlStore) CreatePending(kind string, data []byte, expires time.Time) (string, error) {
+	id, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	query := "INSERT INTO oidc_pending (id, kind, data, expires_at) VALUES (?, ?, ?, ?)"
+	if _, err := db.db.Exec(query, id, kind, string(data), expires.UnixMilli()); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (db *sqlStore) GetPending(kind, id string, now time.Time) ([]byte, error) {
+	row := db.db.QueryRow("SELECT data FROM oidc_pending WHERE id = ? AND kind = ? AND expires_at >= ?", id, kind, now.UnixMilli())
+	var data string
+	if err := row.Scan(&data); err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+// TakePending deletes the data in the statement that reads it, so a step
+// can't be completed twice
+func (db *sqlStore) TakePending(kind, id string, now time.Time) ([]byte, error) {
+	// Forget the flows nobody continued
+	if _, err := db.db.Exec("DELETE FROM oidc_pending WHERE expires_at < ?", now.UnixMilli()); err != nil {
+		return nil, err
+	}
+	row := db.db.QueryRow("DELETE FROM oidc_pending WHERE id = ? AND kind = ? RETURNING data", id, kind)
+	var data string
+	if err := row.Scan(&data); err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+func (db *sqlStore) GetLoginFailures(key string) (int, time.Time, time.Time, error) {
+	row := db.db.QueryRow("SELECT failures, last_failure, locked_until FROM login_failures WHERE key = ?", key)
+	var failures int
+	var lastFailure, lockedUntil int64
+	err := row.Scan(&failures, &lastFailure, &lockedUntil)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return 0, time.Time{}, time.Time{}, nil
+		}
+		return 0, time.Time{}, time.Time{}, err
+	}
+	return failures, time.Unix(lastFailure, 0), time.Unix(lockedUntil, 0), nil
+}
+
+// AddLoginFailure increments the failure counter in a single statement, so
+// several server instances sharing the database count correctly. Failures
+// before windowStart are forgotten.
+func (db *sqlStore) AddLoginFailure(key string, now, windowStart time.Time) (int, error) {
+	query := `
+		INSERT INTO login_failures (key, failures, last_failure, locked_until) VALUES (?, 1, ?, 0)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure < ? THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure = excluded.last_failure
+		RETURNING failures`
+	var failures int
+	err := db.db.QueryRow(query, key, now.Unix(), windowStart.Unix()).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+	// Forget keys that neither failed recently nor are locked
+	_, err = db.db.Exec("DELETE FROM login_failures WHERE last_failure < ? AND locked_until < ?", windowStart.Unix(), now.Unix())
+	return failures, err
+}
+
+func (db *sqlStore) RemoveLoginFailure(key string) error {
+	_, err := db.db.Exec("UPDATE login_failures SET failures = failures - 1 WHERE key = ? AND failures > 0", key)
+	return err
+}
+
+// LockLogin locks the key until the given time, it returns false if the key
+// was already locked (by this or another instance)
+func (db *sqlStore) LockLogin(key string, now, until time.Time) (bool, error) {
+	res, err := db.db.Exec("UPDATE login_failures SET locked_until = ? WHERE key = ? AND locked_until < ?", until.Unix(), key, now.Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (db *sqlStore) DeleteLoginFailures(key string) error {
+	_, err := db.db.Exec("DELETE FROM login_failures WHERE key = ?", key)
+	return err
+}
+
+func (db *sqlStore) CreateInvite(code, createdBy string) error {
+	query := "INSERT INTO invites (code, created_by, created_at) VALUES (?, ?, ?)"
+	_, err := db.db.Exec(query, code, createdBy, time.Now().UnixMilli())
+	return err
+}
+
+func (db *sqlStore) GetInvites(createdBy string) ([]Invite, error) {
+	rows, err := db.db.Query("SELECT code, created_by, created_at, used_by, used_at FROM invites WHERE created_by = ?", createdBy)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invites := []Invite{}
+	for rows.Next() {
+		invite := Invite{}
+		err := rows.Scan(&invite.Code, &invite.CreatedBy, database.Timestamp(&invite.CreatedAt), &invite.UsedBy, database.Timestamp(&invite.UsedAt))
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, nil
+}
+
+// ClaimInvite marks an unused invite as used, it returns false if the code
+// doesn't exist, was already used or expired
+func (db *sqlStore) ClaimInvite(code, email string, createdAfter time.Time) (bool, error) {
+	query := "UPDATE invites SET used_by = ?, used_at = ? WHERE code = ? AND used_by = '' AND created_at >= ?"
+	res, err := db.db.Exec(query, email, time.Now().UnixMilli(), code, createdAfter.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (db *sqlStore) ReleaseInvite(code string) error {
+	_, err := db.db.Exec("UPDATE invites SET used_by = '', used_at = 0 WHERE code = ?", code)
+	return err
+}
+
+// UseInviteQuota takes one invite from the user's quota, it returns false if
+// none is left
+func (db *sqlStore) UseInviteQuota(email string) (bool, error) {
+	res, err := db.db.Exec("UPDATE users SET invite_quota = invite_quota - 1 WHERE email = ? AND invite_quota > 0", email)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// SearchUsers returns users whose email or username contains query, ordered
+// by username
+func (db *sqlStore) SearchUsers(query string, limit, offset int) ([]User, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+	like := db.db.Dialect.ILike()
+	rows, err := db.db.Query(`
+		SELECT id, email, username, created_at, email_verified, role, disabled FROM users
+		WHERE email `+like+` ? ESCAPE '\' OR username `+like+` ? ESCAPE '\'
+		ORDER BY username LIMIT ? OFFSET ?`,
+		pattern, pattern, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		user := User{}
+		err := rows.Scan(&user.ID, &user.Email, &user.Username, database.Timestamp(&user.CreatedAt), &user.EmailVerified, &user.Role, &user.Disabled)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (db *sqlStore) SetDisabled(email string, disabled bool) error {
+	_, err := db.db.Exec("UPDATE users SET disabled = ? WHERE email = ?", disabled, email)
+	return err
+}
+
+func (db *sqlStore) SetRole(email, role string) error {
+	_, err := db.db.Exec("UPDATE users SET role = ? WHERE email = ?", role, email)
+	return err
+}
+
+func (db *sqlStore) CountAdmins() (int, error) {
+	var n int
+	err := db.db.QueryRow("SELECT COUNT(*) FROM users WHERE role = ?", RoleAdmin).Scan(&n)
+	return n, err
+}
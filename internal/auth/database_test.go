@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"codeserver/internal/database"
+	"codeserver/internal/migrate"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// baselineSchema is what the last release without migrations created
+const baselineSchema = `
+	CREATE TABLE IF NOT EXISTS users (
+		email VARCHAR(255) PRIMARY KEY,
+		password VARCHAR(255),
+		username VARCHAR(255) UNIQUE,
+		created_at VARCHAR(255)
+	);
+	CREATE TABLE IF NOT EXISTS sessions (
+		id VARCHAR(255) PRIMARY KEY,
+		email VARCHAR(255),
+		location VARCHAR(255),
+		agent VARCHAR(255),
+		last_seen VARCHAR(255),
+		created_at VARCHAR(255),
+
+		FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+	)`
+
+func TestMigrateBaseline(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Open(filepath.Join(t.TempDir(), "auth.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	hash, err := hashPassword("password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		baselineSchema,
+		"INSERT INTO users VALUES ('ann@example.com', '" + hash + "', 'ann', '2024-05-01T10:00:00Z')",
+		"INSERT INTO sessions VALUES ('s1', 'ann@example.com', 'unknown', 'curl', '2024-05-02T10:00:00Z', '2024-05-01T10:00:00Z')",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	schema := Schemas[database.SQLite]
+	if _, err := migrate.Up(ctx, db, schema, 0); err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(db)
+	user, err := store.GetUser("ann@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "ann" || user.CreatedAt != "2024-05-01T10:00:00Z" || !checkPassword("password123", user.Password) {
+		t.Errorf("user %+v", user)
+	}
+	if !user.EmailVerified || user.Role != RoleUser || user.TOTPEnabled || user.ID == 0 {
+		t.Errorf("defaults of the new columns: %+v", user)
+	}
+	if user, err := store.GetUserFromSessionID("s1"); err != nil || user.Email != "ann@example.com" {
+		t.Errorf("session: %v, %v", user, err)
+	}
+
+	// Every later migration can be reverted to the baseline and applied again
+	if _, err := migrate.Down(ctx, db, schema, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrate.Up(ctx, db, schema, 0); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := store.GetUser("ann@example.com"); err != nil || user.CreatedAt != "2024-05-01T10:00:00Z" {
+		t.Errorf("after down and up: %v, %v", user, err)
+	}
+}
+
+func TestMigrateUsernameCollisions(t *testing.T) {
+	db, err := database.Open(filepath.Join(t.TempDir(), "auth.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, query := range []string{
+		baselineSchema,
+		"INSERT INTO users VALUES ('ann@example.com', '', 'ann', '2024-05-01T10:00:00Z')",
+		"INSERT INTO users VALUES ('ann2@example.com', '', 'Ann', '2024-05-02T10:00:00Z')",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := migrate.Up(context.Background(), db, Schemas[database.SQLite], 0); err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(db)
+	if user, err := store.GetUser("ann2@example.com"); err != nil || user.Username != "Ann-2" {
+		t.Fatalf("younger account: %v, %v", user, err)
+	}
+	if err := store.SetUsername("ann2@example.com", "ANN"); err == nil {
+		t.Error("username differing in case only set")
+	}
+
+	var moved []string
+	_, err = New(Config{DB: db, Hooks: AccountHooks{RenameUser: func(ctx context.Context, oldUsername, newUsername string) error {
+		moved = append(moved, oldUsername+" "+newUsername)
+		return nil
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 1 || moved[0] != "Ann Ann-2" {
+		t.Errorf("objects moved %v", moved)
+	}
+	if renames, err := store.UsernameRenames(); err != nil || len(renames) != 0 {
+		t.Errorf("renames left: %v, %v", renames, err)
+	}
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"codeserver/internal/audit"
+	"codeserver/internal/mail"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	verifyEmailTTL   = 48 * time.Hour
+	resetPasswordTTL = time.Hour
+)
+
+func (s *Service) sendVerificationEmail(ctx context.Context, email string) error {
+	token := s.newToken(purposeVerifyEmail, email, "", verifyEmailTTL)
+	link := s.baseURL + "/auth/verify-email?token=" + url.QueryEscape(token)
+	return s.mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Open the link below to verify your email address:\n\n%s\n\n"+
+			"The link expires in %s. If you didn't create an account, ignore this mail.\n", link, verifyEmailTTL),
+	})
+}
+
+func (s *Service) sendPasswordResetEmail(ctx context.Context, user *User) error {
+	token := s.newToken(purposeResetPassword, user.Email, fingerprint(user.Password), resetPasswordTTL)
+	return s.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Use the token below to choose a new password:\n\n%s\n\n"+
+			"The token expires in %s and can only be used once. If you didn't ask for a reset, ignore this mail.\n", token, resetPasswordTTL),
+	})
+}
+
+// verifyEmail marks the address in the token as verified
+// token: query parameter (link in the mail) or JSON body
+func (s *Service) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		var data struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(r.Body).Decode(&data)
+		token = data.Token
+	}
+	claims, err := s.parseToken(token, purposeVerifyEmail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.store.SetEmailVerified(claims.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "email verified", "email", claims.Email)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("email verified"))
+}
+
+// resendVerification sends a new verification mail to the logged in user
+func (s *Service) resendVerification(w http.ResponseWriter, r *http.Request) {
+	user := s.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	if user.EmailVerified {
+		http.Error(w, "email already verified", http.StatusConflict)
+		return
+	}
+	if err := s.sendVerificationEmail(r.Context(), user.Email); err != nil {
+		slog.ErrorContext(r.Context(), "resending verification email failed", "error", err)
+		http.Error(w, "failed to send mail", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("verification email sent"))
+}
+
+// forgotPassword mails a reset token. The response is the same whether or not
+// the account exists.
+func (s *Service) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := s.store.GetUser(normalizeEmail(data.Email))
+	if err != nil && err != ErrUserNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Accounts from external providers have no password to reset
+	if user != nil && user.Password != "" {
+		if err := s.sendPasswordResetEmail(r.Context(), user); err != nil {
+			slog.ErrorContext(r.Context(), "sending password reset email failed", "error", err)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("if the account exists, a reset email has been sent"))
+}
+
+// resetPassword sets a new password and logs out every session of the user
+func (s *Service) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data.Password == "" {
+		http.Error(w, "password is required", http.StatusBadRequest)
+		return
+	}
+	claims, err := s.parseToken(data.Token, purposeResetPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := s.store.GetUser(claims.Email)
+	if err != nil {
+		http.Error(w, ErrInvalidToken.Error(), http.StatusBadRequest)
+		return
+	}
+	// The fingerprint changes with the password, so every token works once
+	if claims.Fingerprint != fingerprint(user.Password) {
+		http.Error(w, ErrInvalidToken.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.store.SetPassword(user.Email, data.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Whoever received the mail proved ownership of the address
+	if err := s.store.SetEmailVerified(user.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.store.DeleteSessions(user.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.audit.Record(userEvent(r, audit.SessionRevoke, user, "reason=password reset scope=all"))
+	slog.InfoContext(r.Context(), "password reset, all sessions revoked", "username", user.Username)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("password reset"))
+}
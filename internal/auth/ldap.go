@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"codeserver/internal/audit"
+	"codeserver/internal/realip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig describes the directory LDAPAuthenticator binds against
+type LDAPConfig struct {
+	URL          string // ldap://host:389 or ldaps://host:636
+	StartTLS     bool   // Upgrade ldap:// connections before binding
+	TLSConfig    *tls.Config
+	BindDN       string // Service account used for the search, empty binds anonymously
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds the user, every %s is replaced by the escaped login
+	// identifier, e.g. (&(objectClass=person)(|(uid=%s)(mail=%s)))
+	UserFilter        string
+	UsernameAttribute string   // Default uid, sAMAccountName on Active Directory
+	EmailAttribute    string   // Default mail
+	GroupAttribute    string   // Default memberOf
+	AllowedGroups     []string // Group DNs, members of any may log in; empty allows everyone
+	Timeout           time.Duration
+}
+
+// LDAPAuthenticator searches the user with the service account and then
+// verifies the password with a simple bind as the user. Directory users get
+// a local users row (identity provider "ldap") on their first login so
+// storage ownership works as for everyone else. An existing local account
+// with the same email is never taken over, its owner links the directory
+// account at /auth/ldap/link.
+//
+// A throwaway directory for trying it out:
+//
+//	docker run -p 389:389 -e LDAP_ORGANISATION=Example -e LDAP_DOMAIN=example.org \
+//	    -e LDAP_ADMIN_PASSWORD=admin osixia/openldap
+//
+// with LDAP_URL=ldap://localhost:389, LDAP_BIND_DN=cn=admin,dc=example,dc=org,
+// LDAP_BIND_PASSWORD=admin and LDAP_BASE_DN=dc=example,dc=org.
+type LDAPAuthenticator struct {
+	config LDAPConfig
+	link   func(subject, email string) (*User, error) // Returns the linked local user
+}
+
+const ldapProvider = "ldap"
+
+// newLDAPAuthenticator fills in the defaults of config, directory users are
+// linked through ldapUser
+func (s *Service) newLDAPAuthenticator(config LDAPConfig) (*LDAPAuthenticator, error) {
+	if config.URL == "" || config.BaseDN == "" {
+		return nil, errors.New("ldap requires a URL and a base DN")
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(|(uid=%s)(mail=%s))"
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = "uid"
+	}
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "mail"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &LDAPAuthenticator{config: config, link: s.ldapUser}, nil
+}
+
+// dial connects to the directory, giving up when ctx is done
+func (a *LDAPAuthenticator) dial(ctx context.Context) (*ldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: a.config.Timeout}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+	conn, err := ldap.DialURL(a.config.URL,
+		ldap.DialWithDialer(dialer),
+		ldap.DialWithTLSConfig(a.config.TLSConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.config.Timeout)
+	if a.config.StartTLS {
+		tlsConfig := a.config.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, identifier, password string) (*User, error) {
+	subject, email, err := a.lookup(ctx, identifier, password)
+	if err != nil {
+		return nil, err
+	}
+	return a.link(subject, email)
+}
+
+// lookup verifies the password of the directory user and returns its
+// username and email
+func (a *LDAPAuthenticator) lookup(ctx context.Context, identifier, password string) (subject, email string, err error) {
+	// An empty password would be an unauthenticated bind, which succeeds
+	if password == "" {
+		return "", "", ErrInvalidCredentials
+	}
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("ldap: %w", err)
+	}
+	defer conn.Close()
+	// Closing the connection fails the operation in progress
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if a.config.BindDN != "" {
+		err = conn.Bind(a.config.BindDN, a.config.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("ldap: service bind: %w", err)
+	}
+
+	filter := strings.ReplaceAll(a.config.UserFilter, "%s", ldap.EscapeFilter(identifier))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.config.Timeout.Seconds()), false,
+		filter,
+		[]string{a.config.UsernameAttribute, a.config.EmailAttribute, a.config.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		return "", "", fmt.Errorf("ldap: search: %w", err)
+	}
+	switch len(result.Entries) {
+	case 0:
+		return "", "", ErrUserNotFound
+	case 1:
+	default:
+		slog.WarnContext(ctx, "LDAP identifier matches more than one entry", "identifier", identifier)
+		return "", "", ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", "", ErrInvalidCredentials
+		}
+		return "", "", fmt.Errorf("ldap: user bind: %w", err)
+	}
+	if !a.allowed(entry) {
+		slog.InfoContext(ctx, "LDAP user is in none of the allowed groups", "dn", entry.DN)
+		return "", "", ErrInvalidCredentials
+	}
+
+	subject = entry.GetAttributeValue(a.config.UsernameAttribute)
+	email = normalizeEmail(entry.GetAttributeValue(a.config.EmailAttribute))
+	if subject == "" || email == "" {
+		return "", "", fmt.Errorf("ldap: %s lacks %s or %s", entry.DN, a.config.UsernameAttribute, a.config.EmailAttribute)
+	}
+	return subject, email, nil
+}
+
+// allowed checks the group membership of the entry
+func (a *LDAPAuthenticator) allowed(entry *ldap.Entry) bool {
+	if len(a.config.AllowedGroups) == 0 {
+		return true
+	}
+	for _, group := range entry.GetAttributeValues(a.config.GroupAttribute) {
+		for _, allowed := range a.config.AllowedGroups {
+			if strings.EqualFold(group, allowed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ldapUser returns the local user linked to the directory user, creating it
+// on the first login. A local account with the same email has to link the
+// directory account itself, the directory may not vouch for the address.
+func (s *Service) ldapUser(subject, email string) (*User, error) {
+	identity, err := s.store.GetIdentity(ldapProvider, subject)
+	if err == nil {
+		return s.store.GetUser(identity.Email)
+	}
+	if err != ErrIdentityNotFound {
+		return nil, err
+	}
+
+	if _, err := s.store.GetUser(email); err == nil {
+		return nil, ErrIdentityNotLinked
+	} else if err != ErrUserNotFound {
+		return nil, err
+	}
+	local, _, _ := strings.Cut(email, "@")
+	username, err := s.availableUsername(subject, local)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.createUser(email, "", username, true); err != nil {
+		return nil, err
+	}
+	slog.Info("user created", "method", "ldap", "email", email, "username", username)
+	user, err := s.store.GetUser(email)
+	if err != nil {
+		return nil, err
+	}
+	s.audit.Record(audit.Event{
+		Type:     audit.Register,
+		Actor:    user.Username,
+		ActorID:  user.ID,
+		Username: user.Username,
+		UserID:   user.ID,
+		Subject:  email,
+		Success:  true,
+		Detail:   "method=ldap",
+	})
+	if err := s.store.LinkIdentity(ldapProvider, subject, email); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ldapLink links the directory account to the signed in user, who proves
+// owning it with its password
+// identifier: the directory username or email
+func (s *Service) ldapLink(w http.ResponseWriter, r *http.Request) {
+	if s.ldap == nil {
+		http.Error(w, "ldap is not configured", http.StatusNotFound)
+		return
+	}
+	user := s.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	var data struct {
+		Identifier string `json:"identifier"`
+		Password   string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip := realip.FromRequest(r)
+	wait, err := s.countLoginAttempt(user.Email, ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		s.loginFailure(r, user.Email, "throttled")
+		writeThrottled(w, wait)
+		return
+	}
+	subject, _, err := s.ldap.lookup(r.Context(), data.Identifier, data.Password)
+	if err == ErrUserNotFound || err == ErrInvalidCredentials {
+		s.recordLoginFailure(r, user.Email, ip, "invalid directory credentials")
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "LDAP link failed", "error", err)
+		http.Error(w, "directory unavailable", http.StatusBadGateway)
+		return
+	}
+	s.loginAttemptPassed(ip)
+	if err := s.store.LinkIdentity(ldapProvider, subject, user.Email); err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrIdentityLinked {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	slog.InfoContext(r.Context(), "LDAP identity linked", "subject", subject, "email", user.Email)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("directory account linked"))
+}
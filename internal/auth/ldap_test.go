@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// mockDirectory is a minimal LDAP server: it answers simple binds and
+// searches with equality, and and or filters, and ignores everything else
+type mockDirectory struct {
+	listener net.Listener
+	entries  map[string]mockEntry // By DN
+}
+
+type mockEntry struct {
+	password   string
+	attributes map[string][]string
+}
+
+const (
+	ldapBindRequest    = 0
+	ldapBindResponse   = 1
+	ldapUnbindRequest  = 2
+	ldapSearchRequest  = 3
+	ldapSearchEntry    = 4
+	ldapSearchDone     = 5
+	ldapSuccess        = 0
+	ldapBadCredentials = 49
+)
+
+func newMockDirectory(t *testing.T, entries map[string]mockEntry) *mockDirectory {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	m := &mockDirectory{listener: l, entries: entries}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *mockDirectory) URL() string {
+	return "ldap://" + m.listener.Addr().String()
+}
+
+func (m *mockDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldapBindRequest:
+			dn := op.Children[1].Data.String()
+			entry, ok := m.entries[dn]
+			code := ldapBadCredentials
+			if ok && entry.password == op.Children[2].Data.String() {
+				code = ldapSuccess
+			}
+			writeLDAP(conn, id, ldapResult(ldapBindResponse, code))
+		case ldapSearchRequest:
+			filter := op.Children[6]
+			for dn, entry := range m.entries {
+				if !matches(filter, entry) {
+					continue
+				}
+				result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapSearchEntry, nil, "")
+				result.AppendChild(octetString(dn))
+				attributes := ber.NewSequence("")
+				for name, values := range entry.attributes {
+					attribute := ber.NewSequence("")
+					attribute.AppendChild(octetString(name))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, value := range values {
+						set.AppendChild(octetString(value))
+					}
+					attribute.AppendChild(set)
+					attributes.AppendChild(attribute)
+				}
+				result.AppendChild(attributes)
+				writeLDAP(conn, id, result)
+			}
+			writeLDAP(conn, id, ldapResult(ldapSearchDone, ldapSuccess))
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+// matches evaluates and (0), or (1) and equality (3) filters
+func matches(filter *ber.Packet, entry mockEntry) bool {
+	switch filter.Tag {
+	case 0:
+		for _, child := range filter.Children {
+			if !matches(child, entry) {
+				return false
+			}
+		}
+		return true
+	case 1:
+		for _, child := range filter.Children {
+			if matches(child, entry) {
+				return true
+			}
+		}
+		return false
+	case 3:
+		name, value := filter.Children[0].Data.String(), filter.Children[1].Data.String()
+		for _, v := range entry.attributes[name] {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func octetString(s string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, s, "")
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	result.AppendChild(octetString(""))
+	result.AppendChild(octetString(""))
+	return result
+}
+
+func writeLDAP(conn net.Conn, id int64, op *ber.Packet) {
+	message := ber.NewSequence("")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	message.AppendChild(op)
+	conn.Write(message.Bytes())
+}
+
+func TestLDAP(t *testing.T) {
+	directory := newMockDirectory(t, map[string]mockEntry{
+		"cn=admin,dc=example,dc=org": {password: "admin"},
+		"uid=alice,ou=people,dc=example,dc=org": {password: "alice secret", attributes: map[string][]string{
+			"uid":  {"alice"},
+			"mail": {"alice@example.org"},
+		}},
+		"uid=bob,ou=people,dc=example,dc=org": {password: "bob secret", attributes: map[string][]string{
+			"uid":  {"bob"},
+			"mail": {"bob@example.org"},
+		}},
+	})
+	s := newTestService(t, Config{LDAP: &LDAPConfig{
+		URL:          directory.URL(),
+		BindDN:       "cn=admin,dc=example,dc=org",
+		BindPassword: "admin",
+		BaseDN:       "dc=example,dc=org",
+	}})
+	handler := s.Handler()
+
+	t.Run("first login creates the user", func(t *testing.T) {
+		status, body := do(t, handler, "POST", "/login", "", `{"username":"alice","password":"alice secret"}`)
+		if status != http.StatusOK {
+			t.Fatalf("login: %d %s", status, body)
+		}
+		user, err := s.store.GetUser("alice@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Username != "alice" {
+			t.Errorf("username %q, want alice", user.Username)
+		}
+		if status, body := do(t, handler, "POST", "/login", "", `{"email":"alice@example.org","password":"alice secret"}`); status != http.StatusOK {
+			t.Errorf("second login: %d %s", status, body)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		if _, err := s.ldap.Authenticate(context.Background(), "alice", "wrong"); err != ErrInvalidCredentials {
+			t.Errorf("got %v, want ErrInvalidCredentials", err)
+		}
+		if _, err := s.ldap.Authenticate(context.Background(), "nobody", "wrong"); err != ErrUserNotFound {
+			t.Errorf("got %v, want ErrUserNotFound", err)
+		}
+	})
+
+	t.Run("existing account needs an explicit link", func(t *testing.T) {
+		// A local bob whose password differs from the directory
+		session := newTestUser(t, s, "bob@example.org", "bobby")
+		status, body := do(t, handler, "POST", "/login", "", `{"username":"bob","password":"bob secret"}`)
+		if status != http.StatusConflict {
+			t.Fatalf("login before linking: %d %s", status, body)
+		}
+		if _, err := s.store.GetIdentity(ldapProvider, "bob"); err != ErrIdentityNotFound {
+			t.Fatalf("identity linked without asking: %v", err)
+		}
+
+		if status, _ := do(t, handler, "POST", "/ldap/link", "", `{"identifier":"bob","password":"bob secret"}`); status != http.StatusUnauthorized {
+			t.Errorf("link without a session: %d", status)
+		}
+		if status, _ := do(t, handler, "POST", "/ldap/link", session, `{"identifier":"bob","password":"wrong"}`); status != http.StatusUnauthorized {
+			t.Errorf("link with a wrong password: %d", status)
+		}
+		if status, body := do(t, handler, "POST", "/ldap/link", session, `{"identifier":"bob","password":"bob secret"}`); status != http.StatusOK {
+			t.Fatalf("link: %d %s", status, body)
+		}
+		if status, body := do(t, handler, "POST", "/login", "", `{"username":"bob","password":"bob secret"}`); status != http.StatusOK {
+			t.Errorf("login after linking: %d %s", status, body)
+		}
+		// Alice's directory account is taken
+		if status, _ := do(t, handler, "POST", "/ldap/link", session, `{"identifier":"alice","password":"alice secret"}`); status != http.StatusConflict {
+			t.Errorf("linking a linked identity: %d", status)
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		// A directory that accepts and never answers
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(io.Discard, conn)
+					conn.Close()
+				}()
+			}
+		}()
+		stalled := &LDAPAuthenticator{config: s.ldap.config, link: s.ldapUser}
+		stalled.config.URL = "ldap://" + l.Addr().String()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err = stalled.Authenticate(ctx, "alice", "alice secret")
+		if err == nil || errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("got %v, want a connection error", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("took %s, the context was ignored", elapsed)
+		}
+	})
+}
@@ -1,13 +0,0 @@
-package auth
-
-func UsernameFromSessionID(sessionID string) (string, error) {
-	session, err := db.getSession(sessionID)
-	if err != nil {
-		return "", err
-	}
-	user, err := db.getUser(session.Email)
-	if err != nil {
-		return "", err
-	}
-	return user.Username, nil
-}
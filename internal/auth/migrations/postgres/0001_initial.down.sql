@@ -0,0 +1,6 @@
+DROP TABLE invites;
+DROP TABLE login_failures;
+DROP TABLE recovery_codes;
+DROP TABLE identities;
+DROP TABLE sessions;
+DROP TABLE users;
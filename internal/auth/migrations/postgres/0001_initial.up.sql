@@ -0,0 +1,58 @@
+-- Postgres starts at the current schema, timestamps are Unix time in
+-- milliseconds like in SQLite after 0008_integer_timestamps
+CREATE TABLE users (
+    email VARCHAR(255) PRIMARY KEY,
+    password VARCHAR(255) NOT NULL DEFAULT '',
+    username VARCHAR(255) NOT NULL UNIQUE,
+    created_at BIGINT NOT NULL DEFAULT 0,
+    totp_secret VARCHAR(255) NOT NULL DEFAULT '',
+    totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    totp_last_counter BIGINT NOT NULL DEFAULT 0,
+    email_verified BOOLEAN NOT NULL DEFAULT TRUE,
+    invite_quota INTEGER NOT NULL DEFAULT 0,
+    role VARCHAR(255) NOT NULL DEFAULT 'user',
+    disabled BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE UNIQUE INDEX users_username_nocase ON users (lower(username));
+
+-- Foreign keys are enforced, ON UPDATE CASCADE lets email changes through
+CREATE TABLE sessions (
+    id VARCHAR(255) PRIMARY KEY,
+    email VARCHAR(255) NOT NULL REFERENCES users(email) ON DELETE CASCADE ON UPDATE CASCADE,
+    location VARCHAR(255) NOT NULL DEFAULT '',
+    agent VARCHAR(255) NOT NULL DEFAULT '',
+    last_seen BIGINT NOT NULL DEFAULT 0,
+    created_at BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX sessions_email ON sessions (email);
+
+CREATE TABLE identities (
+    provider VARCHAR(255),
+    subject VARCHAR(255),
+    email VARCHAR(255) NOT NULL REFERENCES users(email) ON DELETE CASCADE ON UPDATE CASCADE,
+    created_at BIGINT NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (provider, subject)
+);
+
+CREATE TABLE recovery_codes (
+    email VARCHAR(255) REFERENCES users(email) ON DELETE CASCADE ON UPDATE CASCADE,
+    code_hash VARCHAR(255),
+
+    PRIMARY KEY (email, code_hash)
+);
+
+CREATE TABLE login_failures (
+    key VARCHAR(255) PRIMARY KEY,             -- account:<email> or ip:<address>
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure BIGINT NOT NULL DEFAULT 0,   -- Unix seconds
+    locked_until BIGINT NOT NULL DEFAULT 0    -- Unix seconds
+);
+
+CREATE TABLE invites (
+    code VARCHAR(255) PRIMARY KEY,
+    created_by VARCHAR(255) NOT NULL,         -- Email of the user, or "admin"
+    created_at BIGINT NOT NULL DEFAULT 0,
+    used_by VARCHAR(255) NOT NULL DEFAULT '', -- Email of the registered user
+    used_at BIGINT NOT NULL DEFAULT 0
+);
@@ -0,0 +1,3 @@
+-- Users get a numeric ID, which objects reference when auth and storage
+-- share a database
+ALTER TABLE users ADD COLUMN id BIGINT GENERATED BY DEFAULT AS IDENTITY UNIQUE;
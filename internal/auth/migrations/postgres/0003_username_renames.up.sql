@@ -0,0 +1,6 @@
+-- Postgres had users_username_nocase from the start, the table only exists
+-- like in SQLite, where 0010_username_nocase renames colliding usernames
+CREATE TABLE username_renames (
+    old_username VARCHAR(255) PRIMARY KEY,
+    new_username VARCHAR(255) NOT NULL
+);
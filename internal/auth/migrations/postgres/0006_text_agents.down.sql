@@ -0,0 +1 @@
+ALTER TABLE sessions ALTER COLUMN agent TYPE VARCHAR(255) USING left(agent, 255);
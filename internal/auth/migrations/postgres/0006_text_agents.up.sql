@@ -0,0 +1,2 @@
+-- User agents have no length limit, a longer one failed the login
+ALTER TABLE sessions ALTER COLUMN agent TYPE TEXT;
@@ -0,0 +1,19 @@
+-- The schema of the last release without versioned migrations. IF NOT EXISTS
+-- adopts databases created by it, later columns are added by migrations.
+CREATE TABLE IF NOT EXISTS users (
+    email VARCHAR(255) PRIMARY KEY,
+    password VARCHAR(255),
+    username VARCHAR(255) UNIQUE,
+    created_at VARCHAR(255)
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id VARCHAR(255) PRIMARY KEY,
+    email VARCHAR(255),
+    location VARCHAR(255),
+    agent VARCHAR(255),
+    last_seen VARCHAR(255),
+    created_at VARCHAR(255),
+
+    FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+);
@@ -0,0 +1,10 @@
+-- Accounts at OpenID Connect providers linked to users
+CREATE TABLE identities (
+    provider VARCHAR(255),
+    subject VARCHAR(255),
+    email VARCHAR(255),
+    created_at VARCHAR(255),
+
+    PRIMARY KEY (provider, subject),
+    FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+);
@@ -0,0 +1,13 @@
+-- TOTP second factor, the secret is set on enrollment and enabled once a code
+-- was verified
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN totp_last_counter INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+    email VARCHAR(255),
+    code_hash VARCHAR(255),
+
+    PRIMARY KEY (email, code_hash),
+    FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+-- Accounts registered before verification existed count as verified
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT 1;
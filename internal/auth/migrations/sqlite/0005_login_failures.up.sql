@@ -0,0 +1,6 @@
+CREATE TABLE login_failures (
+    key VARCHAR(255) PRIMARY KEY,             -- account:<email> or ip:<address>
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure INTEGER NOT NULL DEFAULT 0,  -- Unix seconds
+    locked_until INTEGER NOT NULL DEFAULT 0   -- Unix seconds
+);
@@ -0,0 +1,9 @@
+ALTER TABLE users ADD COLUMN invite_quota INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE invites (
+    code VARCHAR(255) PRIMARY KEY,
+    created_by VARCHAR(255),                  -- Email of the user, or "admin"
+    created_at VARCHAR(255),
+    used_by VARCHAR(255) NOT NULL DEFAULT '', -- Email of the registered user
+    used_at VARCHAR(255) NOT NULL DEFAULT ''
+);
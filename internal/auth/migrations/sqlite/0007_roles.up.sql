@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN role VARCHAR(255) NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT 0;
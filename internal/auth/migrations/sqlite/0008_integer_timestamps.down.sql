@@ -0,0 +1,68 @@
+CREATE TABLE users_old (
+    email VARCHAR(255) PRIMARY KEY,
+    password VARCHAR(255),
+    username VARCHAR(255) UNIQUE,
+    created_at VARCHAR(255),
+    totp_secret VARCHAR(255) NOT NULL DEFAULT '',
+    totp_enabled BOOLEAN NOT NULL DEFAULT 0,
+    totp_last_counter INTEGER NOT NULL DEFAULT 0,
+    email_verified BOOLEAN NOT NULL DEFAULT 1,
+    invite_quota INTEGER NOT NULL DEFAULT 0,
+    role VARCHAR(255) NOT NULL DEFAULT 'user',
+    disabled BOOLEAN NOT NULL DEFAULT 0
+);
+INSERT INTO users_old
+    SELECT email, password, username, strftime('%Y-%m-%dT%H:%M:%SZ', created_at / 1000, 'unixepoch'),
+        totp_secret, totp_enabled, totp_last_counter, email_verified, invite_quota, role, disabled
+    FROM users;
+DROP TABLE users;
+ALTER TABLE users_old RENAME TO users;
+
+CREATE TABLE sessions_old (
+    id VARCHAR(255) PRIMARY KEY,
+    email VARCHAR(255),
+    location VARCHAR(255),
+    agent VARCHAR(255),
+    last_seen VARCHAR(255),
+    created_at VARCHAR(255),
+
+    FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+);
+INSERT INTO sessions_old
+    SELECT id, email, location, agent,
+        strftime('%Y-%m-%dT%H:%M:%SZ', last_seen / 1000, 'unixepoch'),
+        strftime('%Y-%m-%dT%H:%M:%SZ', created_at / 1000, 'unixepoch')
+    FROM sessions;
+DROP TABLE sessions;
+ALTER TABLE sessions_old RENAME TO sessions;
+
+CREATE TABLE identities_old (
+    provider VARCHAR(255),
+    subject VARCHAR(255),
+    email VARCHAR(255),
+    created_at VARCHAR(255),
+
+    PRIMARY KEY (provider, subject),
+    FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+);
+INSERT INTO identities_old
+    SELECT provider, subject, email, strftime('%Y-%m-%dT%H:%M:%SZ', created_at / 1000, 'unixepoch')
+    FROM identities;
+DROP TABLE identities;
+ALTER TABLE identities_old RENAME TO identities;
+
+CREATE TABLE invites_old (
+    code VARCHAR(255) PRIMARY KEY,
+    created_by VARCHAR(255),
+    created_at VARCHAR(255),
+    used_by VARCHAR(255) NOT NULL DEFAULT '',
+    used_at VARCHAR(255) NOT NULL DEFAULT ''
+);
+INSERT INTO invites_old
+    SELECT code, created_by,
+        strftime('%Y-%m-%dT%H:%M:%SZ', created_at / 1000, 'unixepoch'),
+        used_by,
+        CASE used_at WHEN 0 THEN '' ELSE strftime('%Y-%m-%dT%H:%M:%SZ', used_at / 1000, 'unixepoch') END
+    FROM invites;
+DROP TABLE invites;
+ALTER TABLE invites_old RENAME TO invites;
@@ -0,0 +1,71 @@
+-- RFC 3339 strings become Unix time in milliseconds, 0 where unknown. SQLite
+-- can't change column types, so the tables are rebuilt.
+CREATE TABLE users_new (
+    email VARCHAR(255) PRIMARY KEY,
+    password VARCHAR(255),
+    username VARCHAR(255) UNIQUE,
+    created_at INTEGER NOT NULL DEFAULT 0,
+    totp_secret VARCHAR(255) NOT NULL DEFAULT '',
+    totp_enabled BOOLEAN NOT NULL DEFAULT 0,
+    totp_last_counter INTEGER NOT NULL DEFAULT 0,
+    email_verified BOOLEAN NOT NULL DEFAULT 1,
+    invite_quota INTEGER NOT NULL DEFAULT 0,
+    role VARCHAR(255) NOT NULL DEFAULT 'user',
+    disabled BOOLEAN NOT NULL DEFAULT 0
+);
+INSERT INTO users_new
+    SELECT email, password, username, COALESCE(CAST(strftime('%s', created_at) AS INTEGER) * 1000, 0),
+        totp_secret, totp_enabled, totp_last_counter, email_verified, invite_quota, role, disabled
+    FROM users;
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+
+CREATE TABLE sessions_new (
+    id VARCHAR(255) PRIMARY KEY,
+    email VARCHAR(255),
+    location VARCHAR(255),
+    agent VARCHAR(255),
+    last_seen INTEGER NOT NULL DEFAULT 0,
+    created_at INTEGER NOT NULL DEFAULT 0,
+
+    FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+);
+INSERT INTO sessions_new
+    SELECT id, email, location, agent,
+        COALESCE(CAST(strftime('%s', last_seen) AS INTEGER) * 1000, 0),
+        COALESCE(CAST(strftime('%s', created_at) AS INTEGER) * 1000, 0)
+    FROM sessions;
+DROP TABLE sessions;
+ALTER TABLE sessions_new RENAME TO sessions;
+CREATE INDEX sessions_email ON sessions (email);
+
+CREATE TABLE identities_new (
+    provider VARCHAR(255),
+    subject VARCHAR(255),
+    email VARCHAR(255),
+    created_at INTEGER NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (provider, subject),
+    FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+);
+INSERT INTO identities_new
+    SELECT provider, subject, email, COALESCE(CAST(strftime('%s', created_at) AS INTEGER) * 1000, 0)
+    FROM identities;
+DROP TABLE identities;
+ALTER TABLE identities_new RENAME TO identities;
+
+CREATE TABLE invites_new (
+    code VARCHAR(255) PRIMARY KEY,
+    created_by VARCHAR(255),                  -- Email of the user, or "admin"
+    created_at INTEGER NOT NULL DEFAULT 0,
+    used_by VARCHAR(255) NOT NULL DEFAULT '', -- Email of the registered user
+    used_at INTEGER NOT NULL DEFAULT 0        -- 0 while unused
+);
+INSERT INTO invites_new
+    SELECT code, created_by,
+        COALESCE(CAST(strftime('%s', created_at) AS INTEGER) * 1000, 0),
+        used_by,
+        COALESCE(CAST(strftime('%s', NULLIF(used_at, '')) AS INTEGER) * 1000, 0)
+    FROM invites;
+DROP TABLE invites;
+ALTER TABLE invites_new RENAME TO invites;
@@ -0,0 +1,19 @@
+CREATE TABLE users_old (
+    email VARCHAR(255) PRIMARY KEY,
+    password VARCHAR(255),
+    username VARCHAR(255) UNIQUE,
+    created_at INTEGER NOT NULL DEFAULT 0,
+    totp_secret VARCHAR(255) NOT NULL DEFAULT '',
+    totp_enabled BOOLEAN NOT NULL DEFAULT 0,
+    totp_last_counter INTEGER NOT NULL DEFAULT 0,
+    email_verified BOOLEAN NOT NULL DEFAULT 1,
+    invite_quota INTEGER NOT NULL DEFAULT 0,
+    role VARCHAR(255) NOT NULL DEFAULT 'user',
+    disabled BOOLEAN NOT NULL DEFAULT 0
+);
+INSERT INTO users_old
+    SELECT email, password, username, created_at, totp_secret, totp_enabled,
+        totp_last_counter, email_verified, invite_quota, role, disabled
+    FROM users;
+DROP TABLE users;
+ALTER TABLE users_old RENAME TO users;
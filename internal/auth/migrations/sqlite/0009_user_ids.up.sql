@@ -0,0 +1,24 @@
+-- Users get a numeric ID, which objects reference when auth and storage
+-- share a database. SQLite can't change the primary key of a table, so users
+-- is rebuilt with the email as unique key. IDs follow registration order.
+CREATE TABLE users_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    password VARCHAR(255),
+    username VARCHAR(255) UNIQUE,
+    created_at INTEGER NOT NULL DEFAULT 0,
+    totp_secret VARCHAR(255) NOT NULL DEFAULT '',
+    totp_enabled BOOLEAN NOT NULL DEFAULT 0,
+    totp_last_counter INTEGER NOT NULL DEFAULT 0,
+    email_verified BOOLEAN NOT NULL DEFAULT 1,
+    invite_quota INTEGER NOT NULL DEFAULT 0,
+    role VARCHAR(255) NOT NULL DEFAULT 'user',
+    disabled BOOLEAN NOT NULL DEFAULT 0
+);
+INSERT INTO users_new (email, password, username, created_at, totp_secret, totp_enabled,
+        totp_last_counter, email_verified, invite_quota, role, disabled)
+    SELECT email, password, username, created_at, totp_secret, totp_enabled,
+        totp_last_counter, email_verified, invite_quota, role, disabled
+    FROM users ORDER BY created_at, email;
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
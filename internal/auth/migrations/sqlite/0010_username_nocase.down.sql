@@ -0,0 +1,2 @@
+DROP INDEX users_username_nocase;
+DROP TABLE username_renames;
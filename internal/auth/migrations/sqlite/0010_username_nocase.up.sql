@@ -0,0 +1,13 @@
+-- Usernames are unique ignoring case. A name colliding with the one of an
+-- older account gets the user ID appended (Ann becomes Ann-7), the rename is
+-- kept in username_renames until the server moved the objects of the user.
+CREATE TABLE username_renames (
+    old_username VARCHAR(255) PRIMARY KEY,
+    new_username VARCHAR(255) NOT NULL
+);
+INSERT INTO username_renames (old_username, new_username)
+    SELECT username, username || '-' || id FROM users
+    WHERE EXISTS (SELECT 1 FROM users older WHERE older.username = users.username COLLATE NOCASE AND older.id < users.id);
+UPDATE users SET username = (SELECT new_username FROM username_renames WHERE old_username = users.username)
+    WHERE username IN (SELECT old_username FROM username_renames);
+CREATE UNIQUE INDEX users_username_nocase ON users (username COLLATE NOCASE);
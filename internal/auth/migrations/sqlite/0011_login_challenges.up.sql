@@ -0,0 +1,8 @@
+-- Challenges of logins waiting for the second factor, in the database so any
+-- server instance can complete the login
+CREATE TABLE login_challenges (
+    id VARCHAR(255) PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    method VARCHAR(255) NOT NULL,      -- How the first factor was passed
+    expires_at INTEGER NOT NULL        -- Unix time in milliseconds
+);
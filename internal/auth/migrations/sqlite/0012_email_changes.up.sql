@@ -0,0 +1,3 @@
+-- Counts the email changes, change links are bound to it so one issued
+-- before the address changed and changed back can't be replayed
+ALTER TABLE users ADD COLUMN email_changes INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+-- Steps of OIDC flows waiting for the next request (state, pending links and
+-- registrations), in the database so any server instance can continue them
+CREATE TABLE oidc_pending (
+    id VARCHAR(255) PRIMARY KEY,
+    kind VARCHAR(32) NOT NULL,         -- state, link or registration
+    data TEXT NOT NULL,                -- JSON
+    expires_at INTEGER NOT NULL        -- Unix time in milliseconds
+);
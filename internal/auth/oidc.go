@@ -0,0 +1,518 @@
+package auth
+
+import (
+	"codeserver/internal/audit"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcStateTTL is how long users have to log in at the provider
+const oidcStateTTL = 10 * time.Minute
+
+// OIDCConfig describes an OpenID Connect provider users can log in with
+type OIDCConfig struct {
+	Name         string // Used in the routes, e.g. /auth/oidc/{name}/login
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // Must point to /auth/oidc/{name}/callback
+	Scopes       []string
+
+	// HTTPClient is used for discovery, JWKS and token requests, mainly so a
+	// local mock issuer with a self-signed certificate can be used in tests
+	HTTPClient *http.Client
+}
+
+type oidcProvider struct {
+	config OIDCConfig
+
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// oidcState is what we remember between the redirect to the provider and the
+// callback; link is set when an authenticated user links a new identity
+type oidcState struct {
+	Provider string      `json:"provider"`
+	Verifier string      `json:"verifier"`
+	Nonce    string      `json:"nonce"`
+	ReturnTo string      `json:"return_to"`
+	Link     *oidcLinker `json:"link,omitempty"`
+	Cookie   bool        `json:"cookie"`  // Use the cookie session transport
+	Browser  string      `json:"browser"` // With cookie, the OIDCStateCookie of the browser that started it
+}
+
+// oidcLinker is who started linking an identity. Anyone can open the URL at
+// the provider, so the identity is only linked to a request of the same
+// session (or proxy user, whose session is empty).
+type oidcLinker struct {
+	Email   string `json:"email"`
+	Session string `json:"session"`
+}
+
+// matches reports whether the request was made by the linker
+func (l *oidcLinker) matches(s *Service, r *http.Request) bool {
+	user, sessionID, err := s.currentUser(r)
+	return err == nil && user.Email == l.Email && sessionID == l.Session
+}
+
+// oidcPendingLink is a verified identity waiting for the linker to confirm it
+type oidcPendingLink struct {
+	Provider string     `json:"provider"`
+	Subject  string     `json:"subject"`
+	Linker   oidcLinker `json:"linker"`
+}
+
+// oidcRegistration is a verified identity without a local account, waiting
+// for the user to choose a username
+type oidcRegistration struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+	Email    string `json:"email"`
+}
+
+// addOIDCProviders registers the OpenID Connect providers. Discovery happens lazily on
+// first use so an unreachable issuer doesn't prevent the server from starting.
+func (s *Service) addOIDCProviders(configs ...OIDCConfig) {
+	for _, config := range configs {
+		if len(config.Scopes) == 0 {
+			config.Scopes = []string{"email", "profile"}
+		}
+		s.oidcProviders[config.Name] = &oidcProvider{config: config}
+	}
+}
+
+func (p *oidcProvider) context(ctx context.Context) context.Context {
+	if p.config.HTTPClient != nil {
+		return oidc.ClientContext(ctx, p.config.HTTPClient)
+	}
+	return ctx
+}
+
+// discover fetches the provider metadata and JWKS location once
+func (p *oidcProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth2 != nil {
+		return p.oauth2, p.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(p.context(ctx), p.config.Issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       append([]string{oidc.ScopeOpenID}, p.config.Scopes...),
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+	return p.oauth2, p.verifier, nil
+}
+
+// authCodeURL creates the state for a new flow and returns the URL the user
+// has to visit at the provider. browser is the value of the state cookie of
+// cookie flows, empty otherwise.
+func (s *Service) authCodeURL(ctx context.Context, p *oidcProvider, returnTo string, link *oidcLinker, browser string) (string, error) {
+	config, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+	state, err := s.oidcStates.put(oidcState{
+		Provider: p.config.Name,
+		Verifier: verifier,
+		Nonce:    nonce,
+		ReturnTo: returnTo,
+		Link:     link,
+		Cookie:   browser != "",
+		Browser:  browser,
+	})
+	if err != nil {
+		return "", err
+	}
+	return config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce)), nil
+}
+
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Username      string `json:"preferred_username"`
+}
+
+// exchange trades the authorization code for tokens and validates the ID token
+func (p *oidcProvider) exchange(ctx context.Context, state oidcState, code string) (*oidc.IDToken, *oidcClaims, error) {
+	config, verifier, err := p.discover(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx = p.context(ctx)
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		return nil, nil, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, nil, errors.New("no id_token in token response")
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if idToken.Nonce != state.Nonce {
+		return nil, nil, errors.New("nonce mismatch")
+	}
+	claims := &oidcClaims{}
+	if err := idToken.Claims(claims); err != nil {
+		return nil, nil, err
+	}
+	claims.Email = normalizeEmail(claims.Email)
+	return idToken, claims, nil
+}
+
+// validReturnTo only accepts loopback http URLs, which is where the CLI listens
+// for the result; anything else would leak session IDs to arbitrary hosts
+func validReturnTo(returnTo string) bool {
+	u, err := url.Parse(returnTo)
+	if err != nil || u.Scheme != "http" {
+		return false
+	}
+	host := u.Hostname()
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// oidcRespond sends the outcome of the callback either back to the client's
+// loopback listener or directly in the response body
+func oidcRespond(w http.ResponseWriter, r *http.Request, returnTo string, status int, values map[string]string) {
+	if returnTo != "" {
+		u, _ := url.Parse(returnTo)
+		query := u.Query()
+		for k, v := range values {
+			query.Set(k, v)
+		}
+		u.RawQuery = query.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(values)
+}
+
+func (s *Service) lookupOIDCProvider(w http.ResponseWriter, r *http.Request) *oidcProvider {
+	provider, ok := s.oidcProviders[r.PathValue("provider")]
+	if !ok {
+		http.Error(w, "unknown provider", http.StatusNotFound)
+		return nil
+	}
+	return provider
+}
+
+// oidcLogin redirects the user to the provider
+// return_to: optional loopback URL that receives the result
+// transport: optional, "cookie" sets the session cookies in the callback
+func (s *Service) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	provider := s.lookupOIDCProvider(w, r)
+	if provider == nil {
+		return
+	}
+	returnTo := r.URL.Query().Get("return_to")
+	if returnTo != "" && !validReturnTo(returnTo) {
+		http.Error(w, "invalid return_to", http.StatusBadRequest)
+		return
+	}
+	// Cookie sessions end up in the browser that opens the callback, which
+	// has to be the one that started the login; otherwise anyone could log
+	// a victim into their own account by sending them the callback URL
+	var browser string
+	if wantsCookie(r) {
+		var err error
+		if browser, err = randomToken(16); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	authURL, err := s.authCodeURL(r.Context(), provider, returnTo, nil, browser)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OIDC login failed", "provider", provider.config.Name, "error", err)
+		http.Error(w, "provider unavailable", http.StatusBadGateway)
+		return
+	}
+	if browser != "" {
+		s.setOIDCStateCookie(w, browser)
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcLink returns the URL the authenticated user has to visit to link an
+// identity at the provider to their account. The callback links it right
+// away if the browser has the same session cookie, otherwise it returns a
+// link token this session has to confirm at /auth/oidc/link/confirm.
+func (s *Service) oidcLink(w http.ResponseWriter, r *http.Request) {
+	provider := s.lookupOIDCProvider(w, r)
+	if provider == nil {
+		return
+	}
+	user, sessionID, err := s.currentUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), sessionStatus(err))
+		return
+	}
+	returnTo := r.URL.Query().Get("return_to")
+	if returnTo != "" && !validReturnTo(returnTo) {
+		http.Error(w, "invalid return_to", http.StatusBadRequest)
+		return
+	}
+	authURL, err := s.authCodeURL(r.Context(), provider, returnTo, &oidcLinker{Email: user.Email, Session: sessionID}, "")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OIDC link failed", "provider", provider.config.Name, "error", err)
+		http.Error(w, "provider unavailable", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": authURL})
+}
+
+// oidcCallback completes the flow. Known identities are logged in, new ones
+// are either linked to the user who started the flow or parked as a pending
+// registration until a username is chosen via /auth/oidc/register.
+func (s *Service) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	provider := s.lookupOIDCProvider(w, r)
+	if provider == nil {
+		return
+	}
+	query := r.URL.Query()
+	state, err := s.oidcStates.take(query.Get("state"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if state == nil || state.Provider != provider.config.Name {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	if state.Cookie {
+		if !s.oidcStateCookieMatches(r, state.Browser) {
+			http.Error(w, "login was started in another browser", http.StatusBadRequest)
+			return
+		}
+		s.clearOIDCStateCookie(w)
+	}
+	if errCode := query.Get("error"); errCode != "" {
+		oidcRespond(w, r, state.ReturnTo, http.StatusUnauthorized, map[string]string{"error": errCode})
+		return
+	}
+
+	idToken, claims, err := provider.exchange(r.Context(), *state, query.Get("code"))
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC callback failed", "provider", provider.config.Name, "error", err)
+		oidcRespond(w, r, state.ReturnTo, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+
+	if state.Link != nil {
+		pending := oidcPendingLink{Provider: provider.config.Name, Subject: idToken.Subject, Linker: *state.Link}
+		if state.Link.matches(s, r) {
+			s.completeLink(w, r, state.ReturnTo, pending)
+			return
+		}
+		token, err := s.oidcLinks.put(pending)
+		if err != nil {
+			oidcRespond(w, r, state.ReturnTo, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		oidcRespond(w, r, state.ReturnTo, http.StatusAccepted, map[string]string{"link_token": token})
+		return
+	}
+
+	identity, err := s.store.GetIdentity(provider.config.Name, idToken.Subject)
+	if err == nil {
+		user, err := s.store.GetUser(identity.Email)
+		if err != nil {
+			oidcRespond(w, r, state.ReturnTo, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if user.Disabled {
+			s.loginFailure(r, user.Email, "disabled")
+			oidcRespond(w, r, state.ReturnTo, http.StatusForbidden, map[string]string{"error": ErrUserDisabled.Error()})
+			return
+		}
+		if user.TOTPEnabled {
+			challenge, err := s.store.CreateLoginChallenge(user.Email, "oidc:"+provider.config.Name, s.now().Add(loginChallengeTTL))
+			if err != nil {
+				oidcRespond(w, r, state.ReturnTo, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			oidcRespond(w, r, state.ReturnTo, http.StatusAccepted, map[string]string{"challenge": challenge, "second_factor": "totp"})
+			return
+		}
+		sessionID, err := s.newSession(r, user, "oidc:"+provider.config.Name)
+		if err != nil {
+			oidcRespond(w, r, state.ReturnTo, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if state.Cookie {
+			s.setSessionCookies(w, sessionID)
+			oidcRespond(w, r, state.ReturnTo, http.StatusOK, map[string]string{"session": "cookie"})
+			return
+		}
+		w.Header().Set("X-Session-ID", sessionID)
+		oidcRespond(w, r, state.ReturnTo, http.StatusOK, map[string]string{"session_id": sessionID})
+		return
+	}
+	if err != ErrIdentityNotFound {
+		oidcRespond(w, r, state.ReturnTo, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Unknown identity, only a verified email may create an account
+	if claims.Email == "" || !claims.EmailVerified {
+		oidcRespond(w, r, state.ReturnTo, http.StatusForbidden, map[string]string{"error": "verified email required"})
+		return
+	}
+	if err := s.checkRegistration(claims.Email); err != nil {
+		oidcRespond(w, r, state.ReturnTo, registrationStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	// Never link to an existing account by email alone, the owner has to log
+	// in and link the identity explicitly
+	if user, _ := s.store.GetUser(claims.Email); user != nil {
+		oidcRespond(w, r, state.ReturnTo, http.StatusConflict, map[string]string{"error": "account exists, log in and link this provider"})
+		return
+	}
+	token, err := s.oidcRegistrations.put(oidcRegistration{
+		Provider: provider.config.Name,
+		Subject:  idToken.Subject,
+		Email:    claims.Email,
+	})
+	if err != nil {
+		oidcRespond(w, r, state.ReturnTo, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	oidcRespond(w, r, state.ReturnTo, http.StatusAccepted, map[string]string{
+		"registration_token": token,
+		"email":              claims.Email,
+		"username":           claims.Username, // Suggestion only
+	})
+}
+
+// oidcConfirmLink links the identity of a link token, it has to be called
+// by the session that started linking
+func (s *Service) oidcConfirmLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string `json:"link_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pending, err := s.oidcLinks.take(data.Token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if pending == nil {
+		http.Error(w, "invalid or expired link token", http.StatusBadRequest)
+		return
+	}
+	if !pending.Linker.matches(s, r) {
+		http.Error(w, "the link was started by another session", http.StatusForbidden)
+		return
+	}
+	s.completeLink(w, r, "", *pending)
+}
+
+func (s *Service) completeLink(w http.ResponseWriter, r *http.Request, returnTo string, pending oidcPendingLink) {
+	err := s.store.LinkIdentity(pending.Provider, pending.Subject, pending.Linker.Email)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrIdentityLinked {
+			status = http.StatusConflict
+		}
+		oidcRespond(w, r, returnTo, status, map[string]string{"error": err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "OIDC identity linked", "provider", pending.Provider, "email", pending.Linker.Email)
+	oidcRespond(w, r, returnTo, http.StatusOK, map[string]string{"linked": pending.Provider})
+}
+
+// oidcRegister creates the account for a pending registration with the chosen
+// username and logs the user in
+func (s *Service) oidcRegister(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token    string `json:"registration_token"`
+		Username string `json:"username"`
+		Invite   string `json:"invite"` // Required in invite mode
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data.Username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	if err := s.checkUsername(data.Username); err != nil {
+		http.Error(w, err.Error(), usernameStatus(err))
+		return
+	}
+	// The token is only used up once the policy lets the user register, so
+	// a wrong invite can be corrected
+	pending, err := s.oidcRegistrations.peek(data.Token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if pending == nil {
+		http.Error(w, "invalid or expired registration token", http.StatusBadRequest)
+		return
+	}
+	if err := s.checkRegistration(pending.Email); err != nil {
+		http.Error(w, err.Error(), registrationStatus(err))
+		return
+	}
+	release, err := s.claimInvite(data.Invite, pending.Email)
+	if err != nil {
+		http.Error(w, err.Error(), registrationStatus(err))
+		return
+	}
+	if taken, err := s.oidcRegistrations.take(data.Token); err != nil || taken == nil {
+		release()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "invalid or expired registration token", http.StatusBadRequest)
+		return
+	}
+	if err := s.createUser(pending.Email, "", data.Username, true); err != nil {
+		release()
+		http.Error(w, err.Error(), registrationStatus(err))
+		return
+	}
+	if err := s.store.LinkIdentity(pending.Provider, pending.Subject, pending.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "user created", "method", "oidc", "provider", pending.Provider, "email", pending.Email)
+
+	user := &User{Email: pending.Email, Username: data.Username}
+	s.audit.Record(userEvent(r, audit.Register, user, "method=oidc:"+pending.Provider))
+	s.startSession(w, r, user, "oidc:"+pending.Provider)
+}
@@ -0,0 +1,351 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a minimal OpenID Connect provider: the authorization
+// endpoint logs in whoever is set as next without asking and the token
+// endpoint checks PKCE
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	next   mockIdentity
+	grants map[string]mockGrant // By code
+}
+
+type mockIdentity struct {
+	subject  string
+	email    string
+	verified bool
+}
+
+type mockGrant struct {
+	identity  mockIdentity
+	nonce     string
+	challenge string
+	clientID  string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, grants: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "alg": "RS256", "use": "sig", "kid": "test",
+			"n": b64(key.N.Bytes()),
+			"e": b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code, _ := randomToken(16)
+		m.mu.Lock()
+		m.grants[code] = mockGrant{identity: m.next, nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), clientID: q.Get("client_id")}
+		m.mu.Unlock()
+		redirect, _ := url.Parse(q.Get("redirect_uri"))
+		redirect.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		grant, ok := m.grants[r.FormValue("code")]
+		delete(m.grants, r.FormValue("code"))
+		m.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || b64(verifier[:]) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     m.idToken(t, grant),
+		})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (m *mockIssuer) login(identity mockIdentity) {
+	m.mu.Lock()
+	m.next = identity
+	m.mu.Unlock()
+}
+
+func (m *mockIssuer) idToken(t *testing.T, grant mockGrant) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":            m.URL,
+		"sub":            grant.identity.subject,
+		"aud":            grant.clientID,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          grant.nonce,
+		"email":          grant.identity.email,
+		"email_verified": grant.identity.verified,
+	})
+	signed := b64(header) + "." + b64(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+// get follows the redirects through the provider and decodes the JSON the
+// callback responds with
+func get(t *testing.T, client *http.Client, target string) (int, map[string]string) {
+	t.Helper()
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	values := map[string]string{}
+	json.NewDecoder(resp.Body).Decode(&values)
+	return resp.StatusCode, values
+}
+
+func TestOIDC(t *testing.T) {
+	issuer := newMockIssuer(t)
+	// callbacks serves the callbacks if set, standing for another instance
+	var s, callbacks *Service
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if callbacks != nil && strings.HasSuffix(r.URL.Path, "/callback") {
+			callbacks.Handler().ServeHTTP(w, r)
+			return
+		}
+		s.Handler().ServeHTTP(w, r)
+	}))
+	defer app.Close()
+	config := Config{OIDC: []OIDCConfig{{
+		Name:         "mock",
+		Issuer:       issuer.URL,
+		ClientID:     "codeserver",
+		ClientSecret: "secret",
+		RedirectURL:  app.URL + "/oidc/mock/callback",
+		HTTPClient:   issuer.Client(),
+	}}}
+	s = newTestService(t, config)
+	handler := s.Handler()
+	browser := app.Client()
+
+	// userOf returns the email of the user a session belongs to
+	userOf := func(session string) string {
+		t.Helper()
+		user, err := s.store.GetUserFromSessionID(session)
+		if err != nil {
+			t.Fatalf("session %q: %v", session, err)
+		}
+		return user.Email
+	}
+	// link starts linking for the session and returns the provider URL
+	link := func(session string) string {
+		t.Helper()
+		status, body := do(t, handler, "POST", "/oidc/mock/link", session, "")
+		var data struct{ URL string }
+		if err := json.Unmarshal([]byte(body), &data); status != http.StatusOK || err != nil {
+			t.Fatalf("link: %d %s", status, body)
+		}
+		return data.URL
+	}
+
+	t.Run("registration", func(t *testing.T) {
+		issuer.login(mockIdentity{subject: "carol-sub", email: "carol@example.com"})
+		if status, _ := get(t, browser, app.URL+"/oidc/mock/login"); status != http.StatusForbidden {
+			t.Errorf("unverified email: status %d, want 403", status)
+		}
+
+		issuer.login(mockIdentity{subject: "carol-sub", email: "carol@example.com", verified: true})
+		status, values := get(t, browser, app.URL+"/oidc/mock/login")
+		if status != http.StatusAccepted || values["registration_token"] == "" {
+			t.Fatalf("new identity: %d %v", status, values)
+		}
+		body, _ := json.Marshal(map[string]string{"registration_token": values["registration_token"], "username": "carol"})
+		status, session := do(t, handler, "POST", "/oidc/register", "", string(body))
+		if status != http.StatusOK {
+			t.Fatalf("register: %d %s", status, session)
+		}
+		if email := userOf(session); email != "carol@example.com" {
+			t.Errorf("registered %s", email)
+		}
+
+		status, values = get(t, browser, app.URL+"/oidc/mock/login")
+		if status != http.StatusOK || userOf(values["session_id"]) != "carol@example.com" {
+			t.Errorf("login: %d %v", status, values)
+		}
+	})
+
+	t.Run("cookie login", func(t *testing.T) {
+		issuer.login(mockIdentity{subject: "carol-sub", email: "carol@example.com", verified: true})
+		// A client without the state cookie stands for a victim opening the
+		// callback URL of a login someone else started
+		if status, values := get(t, browser, app.URL+"/oidc/mock/login?transport=cookie"); status != http.StatusBadRequest {
+			t.Errorf("callback without the state cookie: %d %v", status, values)
+		}
+
+		jar, _ := cookiejar.New(nil)
+		status, values := get(t, &http.Client{Jar: jar}, app.URL+"/oidc/mock/login?transport=cookie")
+		if status != http.StatusOK || values["session"] != "cookie" {
+			t.Fatalf("callback: %d %v", status, values)
+		}
+		appURL, _ := url.Parse(app.URL)
+		var session string
+		for _, cookie := range jar.Cookies(appURL) {
+			switch cookie.Name {
+			case SessionCookie:
+				session = cookie.Value
+			case OIDCStateCookie:
+				t.Error("state cookie kept after the callback")
+			}
+		}
+		if session == "" || userOf(session) != "carol@example.com" {
+			t.Errorf("session cookie %q", session)
+		}
+	})
+
+	t.Run("registration with an invite", func(t *testing.T) {
+		s.registration.Mode = RegistrationInvite
+		defer func() { s.registration.Mode = RegistrationOpen }()
+		issuer.login(mockIdentity{subject: "erin-sub", email: "erin@example.com", verified: true})
+		status, values := get(t, browser, app.URL+"/oidc/mock/login")
+		if status != http.StatusAccepted || values["registration_token"] == "" {
+			t.Fatalf("new identity: %d %v", status, values)
+		}
+		token := values["registration_token"]
+		body, _ := json.Marshal(map[string]string{"registration_token": token, "username": "erin", "invite": "wrong"})
+		if status, body := do(t, handler, "POST", "/oidc/register", "", string(body)); status != http.StatusForbidden {
+			t.Errorf("wrong invite: %d %s", status, body)
+		}
+		// The token wasn't used up by the refused attempt
+		invite, err := s.newInvite("carol@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = json.Marshal(map[string]string{"registration_token": token, "username": "erin", "invite": invite})
+		status, session := do(t, handler, "POST", "/oidc/register", "", string(body))
+		if status != http.StatusOK || userOf(session) != "erin@example.com" {
+			t.Errorf("register: %d %s", status, session)
+		}
+	})
+
+	t.Run("link confirmed by the session", func(t *testing.T) {
+		bob := newTestUser(t, s, "bob@example.com", "bob")
+		issuer.login(mockIdentity{subject: "bob-sub", email: "bob@other.example", verified: true})
+		status, values := get(t, browser, link(bob))
+		if status != http.StatusAccepted || values["link_token"] == "" {
+			t.Fatalf("callback: %d %v", status, values)
+		}
+		body, _ := json.Marshal(map[string]string{"link_token": values["link_token"]})
+		if status, body := do(t, handler, "POST", "/oidc/link/confirm", bob, string(body)); status != http.StatusOK {
+			t.Fatalf("confirm: %d %s", status, body)
+		}
+		status, values = get(t, browser, app.URL+"/oidc/mock/login")
+		if status != http.StatusOK || userOf(values["session_id"]) != "bob@example.com" {
+			t.Errorf("login with linked identity: %d %v", status, values)
+		}
+	})
+
+	t.Run("link in the browser of the session", func(t *testing.T) {
+		dave := newTestUser(t, s, "dave@example.com", "dave")
+		jar, _ := cookiejar.New(nil)
+		appURL, _ := url.Parse(app.URL)
+		jar.SetCookies(appURL, []*http.Cookie{{Name: SessionCookie, Value: dave}})
+		client := &http.Client{Jar: jar}
+		issuer.login(mockIdentity{subject: "dave-sub", verified: true})
+		if status, values := get(t, client, link(dave)); status != http.StatusOK || values["linked"] != "mock" {
+			t.Fatalf("callback: %d %v", status, values)
+		}
+		if identity, err := s.store.GetIdentity("mock", "dave-sub"); err != nil || identity.Email != "dave@example.com" {
+			t.Errorf("identity %v, %v", identity, err)
+		}
+	})
+
+	t.Run("forwarded link", func(t *testing.T) {
+		mallory := newTestUser(t, s, "mallory@example.com", "mallory")
+		victim := newTestUser(t, s, "victim@example.com", "victim")
+		// The victim opens the URL mallory sent while logged in as themself
+		jar, _ := cookiejar.New(nil)
+		appURL, _ := url.Parse(app.URL)
+		jar.SetCookies(appURL, []*http.Cookie{{Name: SessionCookie, Value: victim}})
+		issuer.login(mockIdentity{subject: "victim-sub", email: "victim@example.com", verified: true})
+		status, values := get(t, &http.Client{Jar: jar}, link(mallory))
+		if status != http.StatusAccepted {
+			t.Fatalf("callback: %d %v", status, values)
+		}
+		body, _ := json.Marshal(map[string]string{"link_token": values["link_token"]})
+		if status, _ := do(t, handler, "POST", "/oidc/link/confirm", victim, string(body)); status != http.StatusForbidden {
+			t.Errorf("confirm by another session: status %d, want 403", status)
+		}
+		if _, err := s.store.GetIdentity("mock", "victim-sub"); err != ErrIdentityNotFound {
+			t.Errorf("victim identity linked: %v", err)
+		}
+	})
+
+	t.Run("another instance", func(t *testing.T) {
+		config.DB = s.store.(*sqlStore).db
+		config.TokenSecret = "test secret"
+		other, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		callbacks = other
+		defer func() { callbacks = nil }()
+
+		// Started on one instance, continued on the other and registered on
+		// the first again
+		issuer.login(mockIdentity{subject: "frank-sub", email: "frank@example.com", verified: true})
+		status, values := get(t, browser, app.URL+"/oidc/mock/login")
+		if status != http.StatusAccepted || values["registration_token"] == "" {
+			t.Fatalf("callback: %d %v", status, values)
+		}
+		body, _ := json.Marshal(map[string]string{"registration_token": values["registration_token"], "username": "frank"})
+		status, session := do(t, handler, "POST", "/oidc/register", "", string(body))
+		if status != http.StatusOK || userOf(session) != "frank@example.com" {
+			t.Errorf("register: %d %s", status, session)
+		}
+		body, _ = json.Marshal(map[string]string{"registration_token": values["registration_token"], "username": "frank2"})
+		if status, _ := do(t, other.Handler(), "POST", "/oidc/register", "", string(body)); status != http.StatusBadRequest {
+			t.Errorf("registration token used twice: %d, want 400", status)
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// pendingStore keeps short-lived, single-use values keyed by a random token.
+// It backs the multi-step flows (OIDC state, pending registrations) that must
+// survive between two requests. The values are kept in the database as JSON,
+// so the next request may be served by another instance.
+type pendingStore[T any] struct {
+	store Store
+	kind  string
+	ttl   time.Duration
+	now   func() time.Time
+}
+
+func newPendingStore[T any](s *Service, kind string, ttl time.Duration) *pendingStore[T] {
+	return &pendingStore[T]{store: s.store, kind: kind, ttl: ttl, now: s.now}
+}
+
+// put stores value and returns the token to retrieve it with
+func (p *pendingStore[T]) put(value T) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return p.store.CreatePending(p.kind, data, p.now().Add(p.ttl))
+}
+
+// take returns the value stored under token and removes it, nil if there is
+// none or it expired
+func (p *pendingStore[T]) take(token string) (*T, error) {
+	data, err := p.store.TakePending(p.kind, token, p.now())
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return p.decode(data)
+}
+
+// peek returns the value stored under token without removing it
+func (p *pendingStore[T]) peek(token string) (*T, error) {
+	data, err := p.store.GetPending(p.kind, token, p.now())
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return p.decode(data)
+}
+
+func (p *pendingStore[T]) decode(data []byte) (*T, error) {
+	value := new(T)
+	if err := json.Unmarshal(data, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"codeserver/internal/audit"
+	"codeserver/internal/principal"
+	"codeserver/internal/realip"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ProxyAuthConfig lets a reverse proxy that already authenticated the user,
+// such as oauth2-proxy, pass the identity in request headers. Users are
+// created on their first request.
+type ProxyAuthConfig struct {
+	EmailHeader    string   // e.g. X-Forwarded-Email, required
+	UserHeader     string   // e.g. X-Forwarded-User, preferred username of new users
+	TrustedProxies []string // Only requests from these addresses may set the headers
+	DisableLogin   bool     // Turn off registration and the built-in logins
+}
+
+// proxySettings is the active proxy authentication, zero if it is off
+type proxySettings struct {
+	config  ProxyAuthConfig
+	trusted []netip.Prefix
+}
+
+// setProxyAuth enables proxy header authentication. The trusted proxies are
+// separate from realip's on purpose, a CDN may be trusted to report client
+// addresses but certainly not identities.
+func (s *Service) setProxyAuth(config ProxyAuthConfig) error {
+	if config.EmailHeader == "" {
+		return errors.New("proxy auth requires an email header")
+	}
+	trusted, err := realip.ParsePrefixes(config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	if len(trusted) == 0 {
+		return errors.New("proxy auth requires at least one trusted proxy")
+	}
+	s.proxyAuth.config = config
+	s.proxyAuth.trusted = trusted
+	return nil
+}
+
+// loginDisabled reports whether users may only authenticate through the proxy
+func (s *Service) loginDisabled() bool {
+	return s.proxyAuth.config.DisableLogin
+}
+
+func (s *Service) fromTrustedProxy(r *http.Request) bool {
+	peer, ok := realip.Peer(r)
+	if !ok {
+		return false
+	}
+	for _, prefix := range s.proxyAuth.trusted {
+		if prefix.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyUser returns the user named by the proxy headers. ok is false if proxy
+// authentication is off or the request didn't come through a trusted proxy.
+func (s *Service) proxyUser(r *http.Request) (user *User, ok bool, err error) {
+	if s.proxyAuth.config.EmailHeader == "" || !s.fromTrustedProxy(r) {
+		return nil, false, nil
+	}
+	email := normalizeEmail(r.Header.Get(s.proxyAuth.config.EmailHeader))
+	if email == "" {
+		return nil, false, nil
+	}
+	// The proxy's cookie is sent along with cross-site requests just like ours
+	if !sameOrigin(r) {
+		return nil, true, ErrCSRF
+	}
+	user, err = s.store.GetUser(email)
+	if err == ErrUserNotFound {
+		user, err = s.provisionUser(r, email)
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	if user.Disabled {
+		return nil, true, ErrUserDisabled
+	}
+	return user, true, nil
+}
+
+// sameOrigin rejects unsafe requests a browser made on behalf of another site
+func sameOrigin(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host == r.Host
+	}
+	return true
+}
+
+// provisionUser creates the account for an email the proxy vouched for
+func (s *Service) provisionUser(r *http.Request, email string) (*User, error) {
+	local, _, _ := strings.Cut(email, "@")
+	username, err := s.availableUsername(r.Header.Get(s.proxyAuth.config.UserHeader), local)
+	if err != nil {
+		return nil, err
+	}
+	err = s.createUser(email, "", username, true)
+	if err == ErrUserAlreadyExists {
+		// Another request provisioned the user first
+		return s.store.GetUser(email)
+	}
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(r.Context(), "user created", "method", "proxy", "email", email, "username", username)
+	user, err := s.store.GetUser(email)
+	if err != nil {
+		return nil, err
+	}
+	s.audit.Record(userEvent(r, audit.Register, user, "method=proxy"))
+	return user, nil
+}
+
+// availableUsername returns the first candidate that is valid and free,
+// trying numbered variants of the last one
+func (s *Service) availableUsername(candidates ...string) (string, error) {
+	var base string
+	for _, candidate := range candidates {
+		candidate = s.sanitizeUsername(candidate)
+		if candidate == "" {
+			continue
+		}
+		base = candidate
+		if s.checkUsername(candidate) == nil {
+			return candidate, nil
+		}
+	}
+	if base == "" {
+		base = "user"
+	}
+	for i := 2; i < 100; i++ {
+		suffix := "-" + strconv.Itoa(i)
+		candidate := base[:min(len(base), s.usernamePolicy.MaxLength-len(suffix))] + suffix
+		if s.checkUsername(candidate) == nil {
+			return candidate, nil
+		}
+	}
+	return "", ErrUsernameTaken
+}
+
+// sanitizeUsername drops characters the username grammar doesn't allow
+func (s *Service) sanitizeUsername(name string) string {
+	name = strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+			return c
+		}
+		return -1
+	}, name)
+	return name[:min(len(name), s.usernamePolicy.MaxLength)]
+}
+
+// currentUser returns the user authenticated by the proxy or the session of
+// the request, the session ID is empty for the proxy
+func (s *Service) currentUser(r *http.Request) (*User, string, error) {
+	if user, ok, err := s.proxyUser(r); ok {
+		return user, "", err
+	}
+	sessionID, err := s.SessionID(r)
+	if err != nil {
+		return nil, "", err
+	}
+	user, err := s.store.GetUserFromSessionID(sessionID)
+	if err != nil {
+		return nil, "", ErrNoSession
+	}
+	if user.Disabled {
+		return nil, "", ErrUserDisabled
+	}
+	return user, sessionID, nil
+}
+
+// RequestPrincipal authenticates the request like RequestUser and describes
+// the result as a principal
+func (s *Service) RequestPrincipal(r *http.Request) (*principal.Principal, error) {
+	user, sessionID, err := s.RequestUser(r)
+	if err != nil {
+		return nil, err
+	}
+	method := principal.MethodProxy
+	if _, ok := bearerToken(r); ok && sessionID != "" {
+		method = principal.MethodBearer
+	} else if sessionID != "" {
+		method = principal.MethodCookie
+	}
+	return &principal.Principal{
+		Username:  user.Username,
+		Email:     user.Email,
+		Role:      user.Role,
+		SessionID: sessionID,
+		Method:    method,
+		Scopes:    []string{principal.ScopeAll},
+	}, nil
+}
+
+// RequestUser authenticates the request by the headers of a trusted proxy or
+// by its session. The session ID is empty for proxy authenticated requests.
+func (s *Service) RequestUser(r *http.Request) (*User, string, error) {
+	user, sessionID, err := s.currentUser(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if !user.EmailVerified {
+		return nil, "", ErrEmailNotVerified
+	}
+	return user, sessionID, nil
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyAuth(t *testing.T) {
+	s := newTestService(t, Config{Proxy: &ProxyAuthConfig{
+		EmailHeader:    "X-Forwarded-Email",
+		UserHeader:     "X-Forwarded-User",
+		TrustedProxies: []string{"10.0.0.0/8", "::1"},
+		DisableLogin:   true,
+	}})
+	// request comes from peer with the proxy headers if email isn't empty
+	request := func(method, peer, email, user string) *http.Request {
+		r := httptest.NewRequest(method, "/me", nil)
+		r.RemoteAddr = peer
+		if email != "" {
+			r.Header.Set("X-Forwarded-Email", email)
+			r.Header.Set("X-Forwarded-User", user)
+		}
+		return r
+	}
+
+	t.Run("trusted proxy provisions the user", func(t *testing.T) {
+		user, sessionID, err := s.RequestUser(request("GET", "10.1.2.3:4567", " ann@Example.COM ", "ann smith"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Email != "ann@example.com" || user.Username != "annsmith" || !user.EmailVerified || sessionID != "" {
+			t.Errorf("got %+v, session %q", user, sessionID)
+		}
+		again, _, err := s.RequestUser(request("GET", "[::1]:4567", "ann@example.com", "someone else"))
+		if err != nil || again.ID != user.ID || again.Username != "annsmith" {
+			t.Errorf("second request: %+v, %v", again, err)
+		}
+	})
+
+	t.Run("taken usernames get a suffix", func(t *testing.T) {
+		user, _, err := s.RequestUser(request("GET", "10.1.2.3:4567", "annsmith@example.org", "annsmith"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Username != "annsmith-2" {
+			t.Errorf("username %q, want annsmith-2", user.Username)
+		}
+	})
+
+	t.Run("untrusted peers are ignored", func(t *testing.T) {
+		for _, peer := range []string{"192.0.2.1:4567", "[::ffff:192.0.2.1]:4567", "[2001:db8::1]:4567", "not an address"} {
+			if _, _, err := s.RequestUser(request("GET", peer, "mallory@example.com", "mallory")); err != ErrNoSession {
+				t.Errorf("%s: got %v, want ErrNoSession", peer, err)
+			}
+		}
+		if _, err := s.store.GetUser("mallory@example.com"); err != ErrUserNotFound {
+			t.Errorf("user provisioned for an untrusted peer: %v", err)
+		}
+
+		// The session decides, not the headers
+		session := newTestUser(t, s, "bob@example.com", "bob")
+		r := request("GET", "192.0.2.1:4567", "ann@example.com", "")
+		r.Header.Set("Authorization", "Bearer "+session)
+		user, sessionID, err := s.RequestUser(r)
+		if err != nil || user.Email != "bob@example.com" || sessionID != session {
+			t.Errorf("got %+v, %q, %v, want bob's session", user, sessionID, err)
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, request("GET", "192.0.2.1:4567", "ann@example.com", ""))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("GET /me from an untrusted peer: %d, want 401", w.Code)
+		}
+	})
+
+	t.Run("cross-site requests", func(t *testing.T) {
+		r := request("POST", "10.1.2.3:4567", "ann@example.com", "")
+		r.Header.Set("Sec-Fetch-Site", "cross-site")
+		if _, _, err := s.RequestUser(r); err != ErrCSRF {
+			t.Errorf("got %v, want ErrCSRF", err)
+		}
+	})
+
+	t.Run("disabled users", func(t *testing.T) {
+		if err := s.store.SetDisabled("annsmith@example.org", true); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.RequestUser(request("GET", "10.1.2.3:4567", "annsmith@example.org", "")); err != ErrUserDisabled {
+			t.Errorf("got %v, want ErrUserDisabled", err)
+		}
+	})
+
+	t.Run("login is disabled", func(t *testing.T) {
+		for _, target := range []string{"/login", "/register"} {
+			if status, _ := do(t, s.Handler(), "POST", target, "", `{"username":"bob","password":"password123"}`); status != http.StatusNotFound {
+				t.Errorf("POST %s: %d, want 404", target, status)
+			}
+		}
+	})
+}
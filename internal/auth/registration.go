@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type RegistrationMode string
+
+const (
+	RegistrationOpen   RegistrationMode = "open"
+	RegistrationClosed RegistrationMode = "closed"
+	RegistrationInvite RegistrationMode = "invite" // A single-use invite code is required
+)
+
+// RegistrationPolicy decides who may create an account, it applies to both
+// /auth/register and just-in-time registration through OIDC
+type RegistrationPolicy struct {
+	Mode           RegistrationMode
+	AllowedDomains []string      // Email domains allowed to register, empty allows all
+	InviteQuota    int           // Invite codes every new user may mint
+	InviteTTL      time.Duration // How long invite codes are valid, 0 never expires
+}
+
+func (s *Service) setRegistrationPolicy(policy RegistrationPolicy) error {
+	switch policy.Mode {
+	case RegistrationOpen, RegistrationClosed, RegistrationInvite:
+	case "":
+		policy.Mode = RegistrationOpen
+	default:
+		return fmt.Errorf("unknown registration mode %q", policy.Mode)
+	}
+	domains := make([]string, 0, len(policy.AllowedDomains))
+	for _, domain := range policy.AllowedDomains {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	policy.AllowedDomains = domains
+	s.registration = policy
+	return nil
+}
+
+// checkRegistration validates mode and email domain, the invite code itself
+// is consumed by claimInvite
+func (s *Service) checkRegistration(email string) error {
+	if s.registration.Mode == RegistrationClosed {
+		return ErrRegistrationClosed
+	}
+	if len(s.registration.AllowedDomains) > 0 {
+		_, domain, _ := strings.Cut(email, "@")
+		if !slices.Contains(s.registration.AllowedDomains, strings.ToLower(domain)) {
+			return ErrDomainNotAllowed
+		}
+	}
+	return nil
+}
+
+// claimInvite marks the invite as used by email when invites are required.
+// The returned function gives the invite back if the registration fails.
+func (s *Service) claimInvite(code, email string) (func(), error) {
+	if s.registration.Mode != RegistrationInvite {
+		return func() {}, nil
+	}
+	if code == "" {
+		return nil, ErrInvalidInvite
+	}
+	var createdAfter time.Time
+	if s.registration.InviteTTL > 0 {
+		createdAfter = s.now().Add(-s.registration.InviteTTL)
+	}
+	claimed, err := s.store.ClaimInvite(code, email, createdAfter)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, ErrInvalidInvite
+	}
+	return func() {
+		if err := s.store.ReleaseInvite(code); err != nil {
+			slog.Error("releasing invite failed", "error", err)
+		}
+	}, nil
+}
+
+// registrationStatus maps registration errors to HTTP status codes
+func registrationStatus(err error) int {
+	switch err {
+	case ErrRegistrationClosed, ErrDomainNotAllowed, ErrInvalidInvite:
+		return http.StatusForbidden
+	case ErrUserAlreadyExists:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// config reports the policies clients need to adapt their UI
+func (s *Service) config(w http.ResponseWriter, r *http.Request) {
+	providers := make([]string, 0, len(s.oidcProviders))
+	if !s.loginDisabled() {
+		for name := range s.oidcProviders {
+			providers = append(providers, name)
+		}
+	}
+	slices.Sort(providers)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"registration": map[string]any{
+			"mode":            s.registration.Mode,
+			"invite_required": s.registration.Mode == RegistrationInvite,
+			"allowed_domains": s.registration.AllowedDomains,
+		},
+		"oidc_providers": providers,
+		"two_factor":     !s.loginDisabled(),
+		"proxy_auth":     s.proxyAuth.config.EmailHeader != "",
+		"login":          !s.loginDisabled(),
+	})
+}
+
+// createInvite mints a single-use invite code from the user's quota
+func (s *Service) createInvite(w http.ResponseWriter, r *http.Request) {
+	user := s.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	ok, err := s.store.UseInviteQuota(user.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "no invites left", http.StatusForbidden)
+		return
+	}
+	s.writeInvite(w, user.Email)
+}
+
+func (s *Service) writeInvite(w http.ResponseWriter, createdBy string) {
+	code, err := s.newInvite(createdBy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"code": code})
+}
+
+func (s *Service) newInvite(createdBy string) (string, error) {
+	code, err := randomToken(8)
+	if err != nil {
+		return "", err
+	}
+	if err := s.store.CreateInvite(code, createdBy); err != nil {
+		return "", err
+	}
+	slog.Info("invite created", "created_by", createdBy)
+	return code, nil
+}
+
+// listInvites returns the invites the user created and the remaining quota
+func (s *Service) listInvites(w http.ResponseWriter, r *http.Request) {
+	user := s.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	invites, err := s.store.GetInvites(user.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"invites": invites,
+		"quota":   user.InviteQuota,
+	})
+}
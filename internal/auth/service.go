@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"codeserver/internal/audit"
+	"codeserver/internal/database"
+	"codeserver/internal/geoip"
+	"codeserver/internal/mail"
+	"context"
+	"errors"
+	"time"
+)
+
+// Config holds the dependencies of a Service. Only DB is required, the zero
+// value of everything else is a sensible development default.
+type Config struct {
+	DB      *database.DB
+	Audit   *audit.Log    // nil only logs events
+	Locator geoip.Locator // Resolves session locations, nil skips them
+	Mailer  mail.Mailer   // Default writes mails to the log
+	BaseURL string        // Public URL of the server, used for links in mails
+	// TokenSecret signs email and password reset tokens and derives CSRF
+	// tokens, a random one is used if empty, e.g. in development
+	TokenSecret  string
+	Registration RegistrationPolicy
+	Usernames    UsernamePolicy // Default 3 to 32 characters
+	Cookies      CookiePolicy
+	Proxy        *ProxyAuthConfig // nil disables proxy authentication
+	LDAP         *LDAPConfig      // nil disables the directory login
+	OIDC         []OIDCConfig
+	Hooks        AccountHooks
+	Clock        func() time.Time // Default time.Now
+	// Admins are usernames given the admin role when their account is
+	// created, or on start while there is no administrator at all
+	Admins []string
+}
+
+// Service is the authentication service: accounts, sessions and every way of
+// logging in. It is safe for concurrent use once created.
+type Service struct {
+	store          Store
+	audit          *audit.Log
+	locator        geoip.Locator
+	mailer         mail.Mailer
+	baseURL        string
+	tokenSecret    []byte
+	registration   RegistrationPolicy
+	usernamePolicy UsernamePolicy
+	cookies        CookiePolicy
+	proxyAuth      proxySettings
+	authenticators []Authenticator    // Asked in order by verify
+	ldap           *LDAPAuthenticator // Also in authenticators, nil without LDAP
+	hooks          AccountHooks
+	now            func() time.Time
+	admins         []string
+
+	oidcProviders     map[string]*oidcProvider
+	oidcStates        *pendingStore[oidcState]
+	oidcRegistrations *pendingStore[oidcRegistration]
+	oidcLinks         *pendingStore[oidcPendingLink]
+}
+
+// New returns the service, config.DB has to be migrated to Schemas
+func New(config Config) (*Service, error) {
+	if config.DB == nil {
+		return nil, errors.New("auth requires a database")
+	}
+	s := &Service{
+		store:         NewStore(config.DB),
+		audit:         config.Audit,
+		locator:       config.Locator,
+		mailer:        config.Mailer,
+		baseURL:       config.BaseURL,
+		hooks:         config.Hooks,
+		now:           config.Clock,
+		admins:        config.Admins,
+		oidcProviders: map[string]*oidcProvider{},
+	}
+	s.audit.SetUserLookup(s.userID)
+	if s.locator == nil {
+		s.locator = geoip.Nop{}
+	}
+	if s.mailer == nil {
+		s.mailer = &mail.LogMailer{}
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	s.oidcStates = newPendingStore[oidcState](s, "state", oidcStateTTL)
+	s.oidcRegistrations = newPendingStore[oidcRegistration](s, "registration", 15*time.Minute)
+	s.oidcLinks = newPendingStore[oidcPendingLink](s, "link", 15*time.Minute)
+	if config.Usernames.MaxLength == 0 {
+		config.Usernames.MinLength, config.Usernames.MaxLength = 3, 32
+	}
+	if config.Cookies.MaxAge == 0 {
+		config.Cookies.MaxAge = 30 * 24 * time.Hour
+	}
+
+	s.setTokenSecret(config.TokenSecret)
+	s.setCookiePolicy(config.Cookies)
+	if err := s.setRegistrationPolicy(config.Registration); err != nil {
+		return nil, err
+	}
+	if err := s.setUsernamePolicy(config.Usernames); err != nil {
+		return nil, err
+	}
+	if config.Proxy != nil {
+		if err := s.setProxyAuth(*config.Proxy); err != nil {
+			return nil, err
+		}
+	}
+	s.authenticators = []Authenticator{AuthenticatorFunc(s.authenticateDatabase)}
+	if config.LDAP != nil {
+		ldap, err := s.newLDAPAuthenticator(*config.LDAP)
+		if err != nil {
+			return nil, err
+		}
+		s.ldap = ldap
+		s.authenticators = append(s.authenticators, ldap)
+	}
+	s.addOIDCProviders(config.OIDC...)
+	if err := s.bootstrapAdmins(); err != nil {
+		return nil, err
+	}
+
+	s.moveRenamedObjects(context.Background())
+	return s, nil
+}
@@ -0,0 +1,100 @@
+package auth
+
+import "time"
+
+// Store keeps the accounts, sessions and everything else the service
+// persists. NewStore returns the one for SQL databases, every implementation
+// has to pass storetest.Auth.
+type Store interface {
+	// CreateUser hashes password, an empty one means the user can only log
+	// in through an external provider. It returns ErrUserAlreadyExists if
+	// the email is taken.
+	CreateUser(email, password, username string, verified bool, inviteQuota int) error
+	// GetUser returns ErrUserNotFound if there is no user with the email
+	GetUser(email string) (*User, error)
+	// GetUserByUsername looks the user up ignoring the case of the username
+	GetUserByUsername(username string) (*User, error)
+	GetUserFromSessionID(sessionID string) (*User, error)
+	SetPassword(email, password string) error
+	SetEmailVerified(email string) error
+	// UsernameExists ignores the case of the username
+	UsernameExists(username string) bool
+	// SetUsername returns ErrUsernameTaken if another user has it
+	SetUsername(email, username string) error
+	// ChangeEmail moves the account and everything referencing it, it
+	// returns ErrUserAlreadyExists if the new address is taken
+	ChangeEmail(oldEmail, newEmail string) error
+	// DeleteUser removes the user and every row referencing it
+	DeleteUser(email string) error
+	// SearchUsers returns users whose email or username contains query
+	// ignoring case, ordered by username
+	SearchUsers(query string, limit, offset int) ([]User, error)
+	SetDisabled(email string, disabled bool) error
+	SetRole(email, role string) error
+	CountAdmins() (int, error)
+	// UsernameRenames returns the usernames the migrations changed because
+	// they collided ignoring case, new by old username
+	UsernameRenames() (map[string]string, error)
+	DeleteUsernameRename(oldUsername string) error
+
+	// CreateSession returns the ID of the new session
+	CreateSession(email, agent string) (string, error)
+	SetSessionLocation(sessionID, location string) error
+	GetSession(sessionID string) (*Session, error)
+	GetSessions(email string) ([]Session, error)
+	DeleteSession(sessionID string) error
+	DeleteSessions(email string) error
+	DeleteOtherSessions(email, sessionID string) error
+	CountSessions() (int, error)
+
+	// GetIdentity returns ErrIdentityNotFound if the account isn't linked
+	GetIdentity(provider, subject string) (*Identity, error)
+	// LinkIdentity returns ErrIdentityLinked if the account is linked already
+	LinkIdentity(provider, subject, email string) error
+
+	SetTOTPSecret(email, secret string) error
+	EnableTOTP(email string, recoveryCodes []string) error
+	DisableTOTP(email string) error
+	// UseTOTPCounter returns false if the counter or a later one was used
+	UseTOTPCounter(email string, counter int64) (bool, error)
+	// UseRecoveryCode returns false if the code doesn't exist or was used
+	UseRecoveryCode(email, code string) (bool, error)
+
+	// CreateLoginChallenge returns the ID of a new challenge of a login
+	// waiting for the second factor
+	CreateLoginChallenge(email, method string, expires time.Time) (string, error)
+	// TakeLoginChallenge removes the challenge and returns it, nil if it
+	// doesn't exist or expired before now
+	TakeLoginChallenge(id string, now time.Time) (*LoginChallenge, error)
+
+	// CreatePending stores the data of the next step of an OIDC flow and
+	// returns its ID
+	CreatePending(kind string, data []byte, expires time.Time) (string, error)
+	// GetPending returns the data, nil if it doesn't exist or expired before
+	// now
+	GetPending(kind, id string, now time.Time) ([]byte, error)
+	// TakePending removes the data and returns it like GetPending
+	TakePending(kind, id string, now time.Time) ([]byte, error)
+
+	// GetLoginFailures returns the failures, the time of the last one and
+	// until when the key is locked, all zero for an unknown key
+	GetLoginFailures(key string) (int, time.Time, time.Time, error)
+	// AddLoginFailure returns the failures since windowStart, counting
+	// correctly with several servers sharing the store
+	AddLoginFailure(key string, now, windowStart time.Time) (int, error)
+	// RemoveLoginFailure takes back one failure, the time of the last one
+	// stays
+	RemoveLoginFailure(key string) error
+	// LockLogin returns false if the key was already locked at now
+	LockLogin(key string, now, until time.Time) (bool, error)
+	DeleteLoginFailures(key string) error
+
+	CreateInvite(code, createdBy string) error
+	GetInvites(createdBy string) ([]Invite, error)
+	// ClaimInvite returns false if the code doesn't exist, was used or was
+	// created before createdAfter
+	ClaimInvite(code, email string, createdAfter time.Time) (bool, error)
+	ReleaseInvite(code string) error
+	// UseInviteQuota returns false if the user has no invites left
+	UseInviteQuota(email string) (bool, error)
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"codeserver/internal/audit"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// throttlePolicy decides how long a key (account or source IP) has to wait
+// after repeated failed logins. The first freeAttempts failures are free,
+// after that the delay doubles with every failure up to maxDelay, and at
+// lockAfter failures the key is locked for lockFor.
+type throttlePolicy struct {
+	freeAttempts int
+	maxDelay     time.Duration
+	lockAfter    int
+	lockFor      time.Duration
+}
+
+var (
+	accountPolicy = throttlePolicy{freeAttempts: 3, maxDelay: time.Minute, lockAfter: 10, lockFor: 15 * time.Minute}
+	ipPolicy      = throttlePolicy{freeAttempts: 10, maxDelay: time.Minute, lockAfter: 50, lockFor: 15 * time.Minute}
+
+	// Failures older than this no longer count
+	failureWindow = time.Hour
+)
+
+// delay returns how long to wait after the given number of failures
+func (p throttlePolicy) delay(failures int) time.Duration {
+	if failures <= p.freeAttempts {
+		return 0
+	}
+	delay := time.Duration(math.Pow(2, float64(failures-p.freeAttempts))) * time.Second
+	return min(delay, p.maxDelay)
+}
+
+func accountKey(account string) string {
+	return "account:" + strings.ToLower(account)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// throttleKeys are the keys an attempt on the account from ip is counted
+// under
+func throttleKeys(account, ip string) map[string]throttlePolicy {
+	return map[string]throttlePolicy{accountKey(account): accountPolicy, ipKey(ip): ipPolicy}
+}
+
+// countLoginAttempt counts an attempt as failed before the credentials are
+// checked, so concurrent guesses can't all pass the check of the same count.
+// It returns how long the client has to wait if the attempt isn't allowed,
+// the credentials must not be checked then. Attempts that turn out right are
+// taken back by loginAttemptPassed.
+func (s *Service) countLoginAttempt(account, ip string) (time.Duration, error) {
+	now := s.now()
+	var wait time.Duration
+	seen := map[string]int{}
+	for key, policy := range throttleKeys(account, ip) {
+		failures, lastFailure, lockedUntil, err := s.store.GetLoginFailures(key)
+		if err != nil {
+			return 0, err
+		}
+		if now.Sub(lastFailure) > failureWindow {
+			failures = 0
+		}
+		seen[key] = failures
+		until := lastFailure.Add(policy.delay(failures))
+		if lockedUntil.After(until) {
+			until = lockedUntil
+		}
+		wait = max(wait, until.Sub(now))
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+	for key, policy := range throttleKeys(account, ip) {
+		failures, err := s.store.AddLoginFailure(key, now, now.Add(-failureWindow))
+		if err != nil {
+			return 0, err
+		}
+		// Attempts counted since the check above were made just now, this
+		// one has to wait for them like a later request would
+		if failures-1 > seen[key] {
+			wait = max(wait, policy.delay(failures-1))
+		}
+	}
+	return wait, nil
+}
+
+// loginAttemptPassed takes back the IP's count of an attempt whose factor
+// was right. The account keeps it until all factors passed, see
+// clearLoginFailures.
+func (s *Service) loginAttemptPassed(ip string) {
+	if err := s.store.RemoveLoginFailure(ipKey(ip)); err != nil {
+		slog.Error("taking back login attempt failed", "throttle_key", ipKey(ip), "error", err)
+	}
+}
+
+// recordLoginFailure audits a failed attempt counted by countLoginAttempt and
+// locks the account or the IP once the policy says so
+func (s *Service) recordLoginFailure(r *http.Request, account, ip, detail string) {
+	s.loginFailure(r, account, detail)
+	now := s.now()
+	for key, policy := range throttleKeys(account, ip) {
+		failures, _, _, err := s.store.GetLoginFailures(key)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "reading login failures failed", "throttle_key", key, "error", err)
+			continue
+		}
+		if failures < policy.lockAfter {
+			continue
+		}
+		locked, err := s.store.LockLogin(key, now, now.Add(policy.lockFor))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "locking login failed", "throttle_key", key, "error", err)
+			continue
+		}
+		if locked {
+			e := audit.FromRequest(r, audit.LoginLockout)
+			e.Subject = key
+			e.Success = true
+			e.Detail = "failures=" + strconv.Itoa(failures) + " until=" + now.Add(policy.lockFor).Format(time.RFC3339)
+			if user, err := s.store.GetUser(account); err == nil {
+				e.Username, e.UserID = user.Username, user.ID
+			}
+			s.audit.Record(e)
+		}
+	}
+}
+
+// clearLoginFailures resets the account after a successful login. The IP is
+// left alone so one valid account can't be used to reset an IP's counter.
+func (s *Service) clearLoginFailures(account string) {
+	if err := s.store.DeleteLoginFailures(accountKey(account)); err != nil {
+		slog.Error("clearing login failures failed", "throttle_key", account, "error", err)
+	}
+}
+
+// accountFor maps the login identifier to the key the throttle is counted
+// under, so email and username of the same account share one counter
+func (s *Service) accountFor(identifier string) string {
+	var user *User
+	if strings.Contains(identifier, "@") {
+		user, _ = s.store.GetUser(normalizeEmail(identifier))
+	} else {
+		user, _ = s.store.GetUserByUsername(identifier)
+	}
+	if user != nil {
+		return user.Email
+	}
+	return identifier
+}
+
+func writeThrottled(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "too many failed attempts, try again later", http.StatusTooManyRequests)
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	// The clock stands still, so no delay runs out during the test
+	now := time.Unix(1700000000, 0)
+	s := newTestService(t, Config{Clock: func() time.Time { return now }})
+	// SQLite fails concurrent writes instead of waiting, the requests take
+	// turns on one connection and their statements still interleave
+	s.store.(*sqlStore).db.SetMaxOpenConns(1)
+	newTestUser(t, s, "ann@example.com", "ann")
+	handler := s.Handler()
+
+	// Successful logins don't count against the IP
+	for i := range ipPolicy.freeAttempts + 2 {
+		if status, body := do(t, handler, "POST", "/login", "", `{"username":"ann","password":"password123"}`); status != http.StatusOK {
+			t.Fatalf("login %d: %d %s", i, status, body)
+		}
+	}
+
+	// Concurrent guesses are counted before the password is checked, so no
+	// more of them are checked than sequential ones would be
+	var mu sync.Mutex
+	statuses := map[int]int{}
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, _ := do(t, handler, "POST", "/login", "", `{"username":"ann","password":"wrong"}`)
+			mu.Lock()
+			statuses[status]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if checked := statuses[http.StatusUnauthorized]; checked == 0 || checked > accountPolicy.freeAttempts+1 {
+		t.Errorf("%d guesses checked, want at most %d: %v", checked, accountPolicy.freeAttempts+1, statuses)
+	}
+	if status, _ := do(t, handler, "POST", "/login", "", `{"username":"ann","password":"password123"}`); status != http.StatusTooManyRequests {
+		t.Errorf("login after the guesses: status %d, want 429", status)
+	}
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Purposes of signed tokens, a token is only accepted for its own purpose
+const (
+	purposeVerifyEmail   = "verify-email"
+	purposeResetPassword = "reset-password"
+	purposeChangeEmail   = "change-email"
+)
+
+// tokenClaims is the payload of a signed token. Fingerprint ties the token to
+// the state it was issued for (e.g. the current password hash) so it stops
+// working once that state changed.
+type tokenClaims struct {
+	Purpose     string `json:"p"`
+	Email       string `json:"e"`
+	Expires     int64  `json:"x"`
+	Fingerprint string `json:"f,omitempty"`
+	NewEmail    string `json:"n,omitempty"` // Only for email changes
+}
+
+// setTokenSecret sets the key used to sign email verification and password reset
+// tokens. Without a key a random one is generated, which means outstanding
+// tokens stop working when the server restarts.
+func (s *Service) setTokenSecret(secret string) {
+	if secret != "" {
+		s.tokenSecret = []byte(secret)
+		return
+	}
+	slog.Warn("no token secret configured, using a random one")
+	s.tokenSecret = make([]byte, 32)
+	if _, err := rand.Read(s.tokenSecret); err != nil {
+		panic(err)
+	}
+}
+
+func (s *Service) signToken(claims tokenClaims) string {
+	payload, _ := json.Marshal(claims)
+	mac := hmac.New(sha256.New, s.tokenSecret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newToken issues a token for purpose that expires after ttl
+func (s *Service) newToken(purpose, email, fingerprint string, ttl time.Duration) string {
+	return s.signToken(tokenClaims{
+		Purpose:     purpose,
+		Email:       email,
+		Expires:     s.now().Add(ttl).Unix(),
+		Fingerprint: fingerprint,
+	})
+}
+
+// parseToken checks signature, purpose and expiry of the token
+func (s *Service) parseToken(token, purpose string) (*tokenClaims, error) {
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	mac := hmac.New(sha256.New, s.tokenSecret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrInvalidToken
+	}
+
+	claims := &tokenClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Purpose != purpose || s.now().Unix() > claims.Expires {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// emailFingerprint ties an email change token to the address and the number
+// of changes of the account
+func emailFingerprint(user *User) string {
+	return fingerprint(fmt.Sprintf("%s %d", user.Email, user.EmailChanges))
+}
+
+// fingerprint returns a short digest of value, used to bind tokens to the
+// current password hash without putting the hash itself into the token
+func fingerprint(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"codeserver/internal/realip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 parameters, these are the defaults every authenticator app supports
+const (
+	totpIssuer  = "codesfer"
+	totpPeriod  = 30
+	totpDigits  = 6
+	totpSkew    = 1 // Accepted time steps before and after the current one
+	totpSecretN = 20
+
+	recoveryCodeCount = 10
+
+	// loginChallengeTTL is how long users have to enter the code once the
+	// first factor passed
+	loginChallengeTTL = 5 * time.Minute
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretN)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(b), nil
+}
+
+// totpURI returns the otpauth URI authenticator apps import, usually as QR code
+func totpURI(account, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// totpCode computes the HOTP value (RFC 4226) for the given counter
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for range totpDigits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// matchTOTP returns the counter the code is valid for, or -1
+func matchTOTP(secret, code string, now time.Time) int64 {
+	current := now.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		expected, err := totpCode(secret, current+int64(i))
+		if err != nil {
+			return -1
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return current + int64(i)
+		}
+	}
+	return -1
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(b)) // 8 characters
+		codes[i] = code[:4] + "-" + code[4:]
+	}
+	return codes, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code, both can only be used once
+func (s *Service) verifySecondFactor(user *User, code string) (bool, error) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if code == "" {
+		return false, nil
+	}
+	if counter := matchTOTP(user.TOTPSecret, code, s.now()); counter >= 0 {
+		return s.store.UseTOTPCounter(user.Email, counter)
+	}
+	return s.store.UseRecoveryCode(user.Email, code)
+}
+
+// completeLogin is called once the first factor succeeded. Accounts with TOTP
+// enabled get a challenge to exchange via /auth/login/totp, everyone else a
+// session right away. Failed attempts are only forgotten once all factors
+// passed, otherwise the password would reset the counter for TOTP guesses.
+func (s *Service) completeLogin(w http.ResponseWriter, r *http.Request, user *User, method string) {
+	if user.Disabled {
+		s.loginFailure(r, user.Email, "disabled")
+		http.Error(w, ErrUserDisabled.Error(), http.StatusForbidden)
+		slog.InfoContext(r.Context(), "login refused, user disabled", "username", user.Username)
+		return
+	}
+	if !user.TOTPEnabled {
+		s.clearLoginFailures(user.Email)
+		s.startSession(w, r, user, method)
+		return
+	}
+	challenge, err := s.store.CreateLoginChallenge(user.Email, method, s.now().Add(loginChallengeTTL))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"challenge":     challenge,
+		"second_factor": "totp",
+	})
+}
+
+// sessionUser returns the user owning the session of the request, or the one
+// a trusted proxy authenticated
+func (s *Service) sessionUser(w http.ResponseWriter, r *http.Request) *User {
+	user, _, err := s.currentUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), sessionStatus(err))
+		return nil
+	}
+	return user
+}
+
+// loginTOTP exchanges a login challenge and a TOTP or recovery code for a
+// session. A wrong code invalidates the challenge.
+func (s *Service) loginTOTP(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	challenge, err := s.store.TakeLoginChallenge(data.Challenge, s.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if challenge == nil {
+		http.Error(w, "invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	user, err := s.store.GetUser(challenge.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ip := realip.FromRequest(r)
+	wait, err := s.countLoginAttempt(user.Email, ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		s.loginFailure(r, user.Email, "throttled")
+		writeThrottled(w, wait)
+		return
+	}
+	verified, err := s.verifySecondFactor(user, data.Code)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !verified {
+		s.recordLoginFailure(r, user.Email, ip, "invalid second factor")
+		slog.InfoContext(r.Context(), "login failed, invalid second factor", "username", user.Username)
+		http.Error(w, "invalid code", http.StatusUnauthorized)
+		return
+	}
+	s.loginAttemptPassed(ip)
+	s.clearLoginFailures(user.Email)
+	s.startSession(w, r, user, challenge.Method+"+totp")
+}
+
+// totpEnroll generates a new secret, it only becomes active after the first
+// code was confirmed through /auth/totp/verify
+func (s *Service) totpEnroll(w http.ResponseWriter, r *http.Request) {
+	user := s.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "two-factor authentication already enabled", http.StatusConflict)
+		return
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.store.SetTOTPSecret(user.Email, secret); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret": secret,
+		"uri":    totpURI(user.Email, secret),
+	})
+}
+
+// totpVerify confirms the enrollment and returns the recovery codes, which
+// are only ever shown this once
+func (s *Service) totpVerify(w http.ResponseWriter, r *http.Request) {
+	user := s.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	var data struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "two-factor authentication already enabled", http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "no pending enrollment", http.StatusBadRequest)
+		return
+	}
+	counter := matchTOTP(user.TOTPSecret, strings.TrimSpace(data.Code), s.now())
+	if counter < 0 {
+		http.Error(w, "invalid code", http.StatusUnauthorized)
+		return
+	}
+	// A concurrent request may have used the code already (RFC 6238 5.2)
+	used, err := s.store.UseTOTPCounter(user.Email, counter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !used {
+		http.Error(w, "invalid code", http.StatusUnauthorized)
+		return
+	}
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.store.EnableTOTP(user.Email, codes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "two-factor authentication enabled", "username", user.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// totpDisable turns the second factor off, it requires the password (if the
+// account has one) and a current TOTP or recovery code
+func (s *Service) totpDisable(w http.ResponseWriter, r *http.Request) {
+	user := s.sessionUser(w, r)
+	if user == nil {
+		return
+	}
+	var data struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !user.TOTPEnabled {
+		http.Error(w, "two-factor authentication not enabled", http.StatusBadRequest)
+		return
+	}
+	if !s.reauthenticate(w, r, user, data.Password, data.Code) {
+		return
+	}
+	if err := s.store.DisableTOTP(user.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "two-factor authentication disabled", "username", user.Username)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("two-factor authentication disabled"))
+}
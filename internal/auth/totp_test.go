@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTOTPVerifyReplay(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	s := newTestService(t, Config{Clock: func() time.Time { return now }})
+	handler := s.Handler()
+	session := newTestUser(t, s, "erin@example.com", "erin")
+
+	status, body := do(t, handler, "POST", "/totp/enroll", session, "")
+	var enrollment struct{ Secret string }
+	if err := json.Unmarshal([]byte(body), &enrollment); status != http.StatusOK || err != nil {
+		t.Fatalf("enroll: %d %s", status, body)
+	}
+	counter := now.Unix() / totpPeriod
+	code, err := totpCode(enrollment.Secret, counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another request used the code in the meantime
+	if ok, err := s.store.UseTOTPCounter("erin@example.com", counter); !ok || err != nil {
+		t.Fatalf("use counter: %v, %v", ok, err)
+	}
+	if status, body := do(t, handler, "POST", "/totp/verify", session, `{"code":"`+code+`"}`); status != http.StatusUnauthorized {
+		t.Errorf("replayed code: %d %s, want 401", status, body)
+	}
+
+	now = now.Add(totpPeriod * time.Second)
+	code, _ = totpCode(enrollment.Secret, counter+1)
+	if status, body := do(t, handler, "POST", "/totp/verify", session, `{"code":"`+code+`"}`); status != http.StatusOK {
+		t.Errorf("next code: %d %s", status, body)
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	clock := func() time.Time { return now }
+	s := newTestService(t, Config{Clock: clock})
+	session := newTestUser(t, s, "frank@example.com", "frank")
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.SetTOTPSecret("frank@example.com", secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.EnableTOTP("frank@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The challenge is kept in the database, another instance can take it
+	status, body := do(t, s.Handler(), "POST", "/login", "", `{"username":"frank","password":"password123"}`)
+	var login struct{ Challenge string }
+	if err := json.Unmarshal([]byte(body), &login); status != http.StatusAccepted || err != nil {
+		t.Fatalf("login: %d %s", status, body)
+	}
+	other, err := New(Config{DB: s.store.(*sqlStore).db, TokenSecret: "test secret", Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := totpCode(secret, now.Unix()/totpPeriod)
+	answer := `{"challenge":"` + login.Challenge + `","code":"` + code + `"}`
+	if status, body := do(t, other.Handler(), "POST", "/login/totp", "", answer); status != http.StatusOK {
+		t.Fatalf("code at another instance: %d %s", status, body)
+	}
+	if status, _ := do(t, s.Handler(), "POST", "/login/totp", "", answer); status != http.StatusUnauthorized {
+		t.Errorf("challenge answered twice: status %d, want 401", status)
+	}
+
+	// Guessing codes to turn the second factor off is throttled like logins
+	for i := 0; ; i++ {
+		status, body := do(t, s.Handler(), "POST", "/totp/disable", session, `{"password":"password123","code":"000000"}`)
+		if status == http.StatusTooManyRequests {
+			break
+		}
+		if status != http.StatusUnauthorized || i > accountPolicy.freeAttempts {
+			t.Fatalf("guess %d: %d %s", i, status, body)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// UsernamePolicy is the grammar for usernames. Usernames end up in object
+// keys (<username>/<path>) and R2 paths, so they must never contain a slash.
+type UsernamePolicy struct {
+	MinLength int
+	MaxLength int
+	Reserved  []string // In addition to routeUsernames
+}
+
+// routeUsernames are always reserved, they collide with route prefixes or are
+// used internally (anon owns anonymous uploads)
+var routeUsernames = []string{
+	"anon", "anonymous", "admin", "root", "auth", "storage", "ping",
+	"api", "metrics", "config", "system", "www",
+}
+
+func (s *Service) setUsernamePolicy(policy UsernamePolicy) error {
+	if policy.MinLength < 1 || policy.MaxLength < policy.MinLength {
+		return fmt.Errorf("invalid username length %d-%d", policy.MinLength, policy.MaxLength)
+	}
+	reserved := make([]string, 0, len(policy.Reserved))
+	for _, name := range policy.Reserved {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			reserved = append(reserved, name)
+		}
+	}
+	policy.Reserved = reserved
+	s.usernamePolicy = policy
+	return nil
+}
+
+// validateUsername checks the grammar: letters, digits, '.', '_' and '-',
+// with at least one letter or digit so names like ".." are rejected
+func (s *Service) validateUsername(username string) error {
+	if len(username) < s.usernamePolicy.MinLength || len(username) > s.usernamePolicy.MaxLength {
+		return fmt.Errorf("%w: must be %d to %d characters", ErrUsernameInvalid, s.usernamePolicy.MinLength, s.usernamePolicy.MaxLength)
+	}
+	alnum := false
+	for _, c := range username {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			alnum = true
+		case c == '.', c == '_', c == '-':
+		default:
+			return fmt.Errorf("%w: only letters, digits, '.', '_' and '-' are allowed", ErrUsernameInvalid)
+		}
+	}
+	if !alnum {
+		return fmt.Errorf("%w: must contain a letter or digit", ErrUsernameInvalid)
+	}
+	return nil
+}
+
+func (s *Service) reservedUsername(username string) bool {
+	username = strings.ToLower(username)
+	for _, list := range [][]string{routeUsernames, s.usernamePolicy.Reserved} {
+		for _, reserved := range list {
+			if username == reserved {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkUsername reports whether username can be given to a new or renamed
+// account; uniqueness ignores case
+func (s *Service) checkUsername(username string) error {
+	if err := s.validateUsername(username); err != nil {
+		return err
+	}
+	if s.reservedUsername(username) {
+		return ErrUsernameForbidden
+	}
+	if s.store.UsernameExists(username) {
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+// usernameStatus maps checkUsername errors to HTTP status codes
+func usernameStatus(err error) int {
+	if errors.Is(err, ErrUsernameInvalid) {
+		return http.StatusBadRequest
+	}
+	return http.StatusConflict
+}
+
+// moveRenamedObjects lets the hooks follow the usernames the migrations
+// changed to make them unique ignoring case. Renames that fail are retried on
+// the next start.
+func (s *Service) moveRenamedObjects(ctx context.Context) {
+	renames, err := s.store.UsernameRenames()
+	if err != nil {
+		slog.ErrorContext(ctx, "reading username renames failed", "error", err)
+		return
+	}
+	for oldUsername, newUsername := range renames {
+		if s.hooks.RenameUser != nil {
+			if err := s.hooks.RenameUser(ctx, oldUsername, newUsername); err != nil {
+				slog.ErrorContext(ctx, "moving objects of a renamed user failed", "old_username", oldUsername, "username", newUsername, "error", err)
+				continue
+			}
+		}
+		if err := s.store.DeleteUsernameRename(oldUsername); err != nil {
+			slog.ErrorContext(ctx, "forgetting username rename failed", "old_username", oldUsername, "error", err)
+			continue
+		}
+		slog.WarnContext(ctx, "username collided ignoring case and was renamed", "old_username", oldUsername, "username", newUsername)
+	}
+}
@@ -1,71 +1,63 @@
 package auth
 
 import (
-	"crypto/sha256"
+	"context"
+	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"log"
 	"net/http"
-	"time"
+	"strings"
+	"sync"
 )
 
-func generateUniqueID() string {
-	// Get the current time in nanoseconds
-	currentTime := time.Now().UnixNano()
-
-	// Convert the current time to a byte array
-	timeBytes := fmt.Appendf(nil, "%d", currentTime)
-
-	// Create a new SHA256 hash
-	hash := sha256.New()
-	hash.Write(timeBytes)
-
-	// Get the hashed bytes and convert to a hex string
-	hashedID := hash.Sum(nil)
-	return hex.EncodeToString(hashedID)
-}
-
-type LocationResponse struct {
-	City    string `json:"city"`
-	Region  string `json:"region"`
-	Country string `json:"country"`
-}
-
-// getLocation returns the location as a string based on the IP address
-func ip2Location(ip string) (string, error) {
-	// Example API endpoint (you can use any geolocation API)
-	apiURL := fmt.Sprintf("https://ipinfo.io/%s/json", ip)
-
-	resp, err := http.Get(apiURL)
-	if err != nil {
+// randomToken returns a hex encoded random token of n bytes, used wherever the
+// token must not be guessable (sessions, OIDC state, nonces, challenges)
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
+	return hex.EncodeToString(b), nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to get location: status code %d", resp.StatusCode)
+// bearerToken returns the session ID from the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
 	}
+	return token, true
+}
 
-	var locResp LocationResponse
-	if err := json.NewDecoder(resp.Body).Decode(&locResp); err != nil {
-		return "", err
+// normalizeEmail trims the address and lowercases the domain. The local part
+// is left alone since it may be case sensitive.
+func normalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
 	}
-
-	location := fmt.Sprintf("%s, %s, %s", locResp.City, locResp.Region, locResp.Country)
-	return location, nil
+	return email[:at+1] + strings.ToLower(email[at+1:])
 }
 
-// verify will verify the user with it's email and password
-func verify(email, password string) (bool, error) {
-	user, err := db.getUser(email)
-	if err != nil {
-		return false, err
-	}
-	if user == nil {
-		log.Printf("[verify] user not found: %s", email)
-		return false, errors.New("user not found")
+// dummyHash is compared against when the user doesn't exist, so a failed
+// login takes as long whether or not the account exists
+var dummyHash = sync.OnceValue(func() string {
+	password, _ := randomToken(16)
+	hash, _ := hashPassword(password)
+	return hash
+})
+
+// verify will verify the user by email or username and password, asking the
+// authenticators in order. Unknown users and wrong passwords both result in
+// ErrInvalidCredentials.
+func (s *Service) verify(ctx context.Context, identifier, password string) (*User, error) {
+	for _, authenticator := range s.authenticators {
+		user, err := authenticator.Authenticate(ctx, identifier, password)
+		if err == ErrUserNotFound {
+			continue
+		}
+		return user, err
 	}
-	return checkPassword(password, user.Password), nil
+	checkPassword(password, dummyHash())
+	return nil, ErrInvalidCredentials
 }
@@ -0,0 +1,101 @@
+// Package certfile serves a TLS certificate from a certificate and a key
+// file, reloading them when they change. Connections keep the certificate
+// they were established with, new handshakes get the reloaded one.
+package certfile
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader holds the certificate loaded from its files
+type Reloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // Latest modification of the two files when loaded
+}
+
+// Load reads the certificate and key files, which have to be PEM encoded
+func Load(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. The certificate in use is kept if they are
+// invalid, e.g. while only one of them was replaced.
+func (r *Reloader) Reload() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert, r.modTime = &cert, modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate is tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch reloads the files when they were modified, which is checked every
+// interval, and whenever something is received from reload, e.g. SIGHUP. It
+// returns when ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var tried time.Time // Files that failed to load are only retried once changed
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+		case <-ticker.C:
+			modTime, err := r.filesModTime()
+			r.mu.RLock()
+			unchanged := modTime.Equal(r.modTime) || modTime.Equal(tried)
+			r.mu.RUnlock()
+			if err != nil || unchanged {
+				continue
+			}
+			tried = modTime
+		}
+		if err := r.Reload(); err != nil {
+			slog.Warn("keeping the current TLS certificate, reloading failed", "file", r.certFile, "error", err)
+			continue
+		}
+		slog.Info("TLS certificate reloaded", "file", r.certFile)
+	}
+}
+
+// filesModTime returns the latest modification time of the files, following
+// symlinks as they are swapped by e.g. Kubernetes secrets
+func (r *Reloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,151 @@
+package certfile
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for localhost with serial to
+// the files, the latest modification time is modTime
+func writeCert(t *testing.T, certFile, keyFile string, serial int64, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	// Replaced like a deployment would, the key first so the watcher never
+	// sees a new modification time before the pair is complete
+	for _, f := range []struct {
+		name    string
+		data    []byte
+		modTime time.Time
+	}{{keyFile, keyPEM, modTime.Add(-time.Second)}, {certFile, certPEM, modTime}} {
+		tmp := f.name + ".tmp"
+		if err := os.WriteFile(tmp, f.data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// Explicit times, the file system's resolution may be too coarse
+		if err := os.Chtimes(tmp, f.modTime, f.modTime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, f.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serial returns the serial number of the certificate the listener presents
+// in a new handshake
+func serial(t *testing.T, addr string) int64 {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeCert(t, certFile, keyFile, 1, start)
+	r, err := Load(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: r.GetCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	addr := l.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan os.Signal, 1)
+	go r.Watch(ctx, 10*time.Millisecond, reload)
+
+	// waitFor polls the handshakes until they present want
+	waitFor := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for got := serial(t, addr); got != want; got = serial(t, addr) {
+			if time.Now().After(deadline) {
+				t.Fatalf("serving serial %d, want %d", got, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(1)
+
+	t.Run("modified files", func(t *testing.T) {
+		writeCert(t, certFile, keyFile, 2, start.Add(time.Minute))
+		waitFor(2)
+	})
+
+	t.Run("invalid files keep the certificate", func(t *testing.T) {
+		if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(certFile, start.Add(2*time.Minute), start.Add(2*time.Minute))
+		time.Sleep(50 * time.Millisecond)
+		if got := serial(t, addr); got != 2 {
+			t.Errorf("serving serial %d after an invalid reload, want 2", got)
+		}
+	})
+
+	t.Run("reload signal", func(t *testing.T) {
+		// Same modification time as the invalid files, only the signal
+		// reloads them
+		writeCert(t, certFile, keyFile, 3, start.Add(2*time.Minute))
+		time.Sleep(50 * time.Millisecond)
+		if got := serial(t, addr); got != 2 {
+			t.Fatalf("serving serial %d before the signal, want 2", got)
+		}
+		reload <- os.Interrupt
+		waitFor(3)
+	})
+}
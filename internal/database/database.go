@@ -0,0 +1,144 @@
+// Package database opens the SQL databases of the server, local SQLite files,
+// libsql/Turso or Postgres.
+package database
+
+import (
+	"codeserver/internal/config"
+	"codeserver/internal/metrics"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/tursodatabase/libsql-client-go/libsql"
+	_ "modernc.org/sqlite"
+)
+
+// DB is a database and the dialect it speaks. Queries are written with ?
+// placeholders, Exec, Query and QueryRow rebind them for the dialect and
+// time them in the metrics.
+type DB struct {
+	*sql.DB
+	Dialect Dialect
+	Name    string // Labels the metrics, e.g. auth
+}
+
+// Open returns the database at url: a SQLite file such as file:auth.db, a
+// libsql URL which is authenticated with token or a postgres:// URL
+func Open(url, token string) (*DB, error) {
+	var conn *sql.DB
+	var err error
+	dialect := SQLite
+	switch {
+	case IsPostgres(url):
+		dialect = Postgres
+		conn, err = sql.Open("pgx", url)
+	case config.IsRemote(url):
+		conn, err = sql.Open("libsql", url+"?authToken="+token)
+	default:
+		conn, err = sql.Open("sqlite", url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DB{DB: conn, Dialect: dialect}, nil
+}
+
+// IsPostgres reports whether the database URL is a Postgres connection string
+func IsPostgres(url string) bool {
+	return strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://")
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	defer observe(db.Name, "exec", time.Now())
+	return db.DB.Exec(db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	defer observe(db.Name, "exec", time.Now())
+	return db.DB.ExecContext(ctx, db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	defer observe(db.Name, "query", time.Now())
+	return db.DB.Query(db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	defer observe(db.Name, "query", time.Now())
+	return db.DB.QueryRow(db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	defer observe(db.Name, "query", time.Now())
+	return db.DB.QueryRowContext(ctx, db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	return db.BeginTx(context.Background(), nil)
+}
+
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, dialect: db.Dialect, name: db.Name}, nil
+}
+
+// Tx is a transaction which rebinds and times its queries like DB
+type Tx struct {
+	*sql.Tx
+	dialect Dialect
+	name    string
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	defer observe(tx.name, "exec", time.Now())
+	return tx.Tx.Exec(tx.dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	defer observe(tx.name, "exec", time.Now())
+	return tx.Tx.ExecContext(ctx, tx.dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	defer observe(tx.name, "query", time.Now())
+	return tx.Tx.Query(tx.dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	defer observe(tx.name, "query", time.Now())
+	return tx.Tx.QueryRow(tx.dialect.Rebind(query), args...)
+}
+
+// observe records a statement of the database which started at start
+func observe(database, operation string, start time.Time) {
+	metrics.DBDuration.WithLabelValues(database, operation).Observe(time.Since(start).Seconds())
+}
+
+// Timestamp scans a Unix time in milliseconds into dst as RFC 3339, 0 and
+// NULL become the empty string
+func Timestamp(dst *string) sql.Scanner {
+	return (*timestamp)(dst)
+}
+
+type timestamp string
+
+func (t *timestamp) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*t = ""
+	case int64:
+		*t = ""
+		if v != 0 {
+			*t = timestamp(time.UnixMilli(v).UTC().Format(time.RFC3339))
+		}
+	default:
+		return fmt.Errorf("timestamp: unexpected %T", src)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Dialect is the flavor of SQL a database speaks. Queries are written for
+// SQLite, the few differences are covered by the methods below.
+type Dialect int
+
+const (
+	SQLite   Dialect = iota // modernc SQLite and libsql/Turso
+	Postgres                // Postgres through pgx
+)
+
+func (d Dialect) String() string {
+	if d == Postgres {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// Rebind replaces the ? placeholders of query with the dialect's, question
+// marks in string literals are left alone
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n, quoted := 0, false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Fold returns expr for comparisons ignoring the case of ASCII letters,
+// Fold("username") + " = " + Fold("?") is a case-insensitive equality
+func (d Dialect) Fold(expr string) string {
+	if d == Postgres {
+		return "lower(" + expr + ")"
+	}
+	return expr + " COLLATE NOCASE"
+}
+
+// ILike is the operator for LIKE ignoring case, which SQLite's LIKE already
+// does for ASCII letters
+func (d Dialect) ILike() string {
+	if d == Postgres {
+		return "ILIKE"
+	}
+	return "LIKE"
+}
+
+// IsUnique reports whether err is a violated unique or primary key constraint
+func (d Dialect) IsUnique(err error) bool {
+	if err == nil {
+		return false
+	}
+	if d == Postgres {
+		var pgErr *pgconn.PgError
+		return errors.As(err, &pgErr) && pgErr.Code == "23505"
+	}
+	// libsql reports errors as text only, so match the message of both
+	return strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
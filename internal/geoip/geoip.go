@@ -0,0 +1,194 @@
+package geoip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Locator resolves an IP address to a human readable location such as
+// "Taipei, Taiwan, TW". An empty string means the location is unknown.
+type Locator interface {
+	Locate(ctx context.Context, ip string) (string, error)
+}
+
+// locatable reports whether looking the address up can yield anything,
+// private and loopback addresses never have a location
+func locatable(ip string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
+
+func join(parts ...string) string {
+	nonEmpty := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, ", ")
+}
+
+// Nop never knows the location, for deployments that don't want any lookup
+type Nop struct{}
+
+func (Nop) Locate(ctx context.Context, ip string) (string, error) {
+	return "", nil
+}
+
+// MMDB looks addresses up in a local MaxMind or DB-IP city database, so no
+// address ever leaves the server
+type MMDB struct {
+	reader *maxminddb.Reader
+}
+
+func OpenMMDB(path string) (*MMDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open mmdb: %w", err)
+	}
+	return &MMDB{reader: reader}, nil
+}
+
+// The subset of the GeoIP2/GeoLite2 City schema we need, DB-IP uses the same
+type mmdbRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+func (m *MMDB) Locate(ctx context.Context, ip string) (string, error) {
+	addr, ok := locatable(ip)
+	if !ok {
+		return "", nil
+	}
+	var record mmdbRecord
+	if err := m.reader.Lookup(addr.AsSlice(), &record); err != nil {
+		return "", fmt.Errorf("mmdb lookup: %w", err)
+	}
+	region := ""
+	if len(record.Subdivisions) > 0 {
+		region = record.Subdivisions[0].Names["en"]
+	}
+	return join(record.City.Names["en"], region, record.Country.ISOCode), nil
+}
+
+func (m *MMDB) Close() error {
+	return m.reader.Close()
+}
+
+// HTTP queries an ipinfo.io compatible JSON API. URL is a format string with
+// one %s for the address, e.g. https://ipinfo.io/%s/json
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func (h *HTTP) Locate(ctx context.Context, ip string) (string, error) {
+	if _, ok := locatable(ip); !ok {
+		return "", nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(h.URL, ip), nil)
+	if err != nil {
+		return "", err
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get location: status code %d", resp.StatusCode)
+	}
+
+	var locResp struct {
+		City    string `json:"city"`
+		Region  string `json:"region"`
+		Country string `json:"country"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&locResp); err != nil {
+		return "", err
+	}
+	return join(locResp.City, locResp.Region, locResp.Country), nil
+}
+
+// Cached remembers results of another locator in memory. Failed lookups are
+// not cached so they are retried next time.
+type Cached struct {
+	locator Locator
+	ttl     time.Duration
+	size    int
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	location string
+	expires  time.Time
+}
+
+func NewCached(locator Locator, ttl time.Duration, size int) *Cached {
+	return &Cached{
+		locator: locator,
+		ttl:     ttl,
+		size:    size,
+		entries: map[string]cacheEntry{},
+	}
+}
+
+func (c *Cached) Locate(ctx context.Context, ip string) (string, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[ip]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.location, nil
+	}
+
+	location, err := c.locator.Locate(ctx, ip)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		// Drop expired entries first, and everything if that wasn't enough
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= c.size {
+			clear(c.entries)
+		}
+	}
+	c.entries[ip] = cacheEntry{location: location, expires: now.Add(c.ttl)}
+	return location, nil
+}
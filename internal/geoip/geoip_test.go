@@ -0,0 +1,208 @@
+package geoip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// mmdbValue encodes v in the data section format of the MaxMind DB spec,
+// enough of it for strings, unsigned integers, maps and arrays
+func mmdbValue(v any) []byte {
+	control := func(typ, size int) []byte {
+		if typ > 7 {
+			return []byte{byte(size), byte(typ - 7)}
+		}
+		return []byte{byte(typ<<5 | size)}
+	}
+	uint := func(typ int, n uint64) []byte {
+		var b []byte
+		for ; n > 0; n >>= 8 {
+			b = append([]byte{byte(n)}, b...)
+		}
+		return append(control(typ, len(b)), b...)
+	}
+	switch v := v.(type) {
+	case string:
+		return append(control(2, len(v)), v...)
+	case uint16:
+		return uint(5, uint64(v))
+	case uint32:
+		return uint(6, uint64(v))
+	case uint64:
+		return uint(9, v)
+	case []any:
+		b := control(11, len(v))
+		for _, item := range v {
+			b = append(b, mmdbValue(item)...)
+		}
+		return b
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b := control(7, len(v))
+		for _, key := range keys {
+			b = append(b, mmdbValue(key)...)
+			b = append(b, mmdbValue(v[key])...)
+		}
+		return b
+	}
+	panic(fmt.Sprintf("unsupported type %T", v))
+}
+
+// writeMMDB writes an IPv4 database in which the /24 of prefix has record
+// and every other address has none
+func writeMMDB(t *testing.T, prefix [3]byte, record map[string]any) string {
+	t.Helper()
+	const nodeCount = 24 // One per bit of the prefix
+	var tree []byte
+	for depth := range nodeCount {
+		bit := prefix[depth/8] >> (7 - depth%8) & 1
+		next := uint32(depth + 1)
+		if depth == nodeCount-1 {
+			next = nodeCount + 16 // The record at the start of the data section
+		}
+		records := [2]uint32{nodeCount, nodeCount} // No data
+		records[bit] = next
+		for _, r := range records {
+			tree = append(tree, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	db := append(tree, make([]byte, 16)...)
+	db = append(db, mmdbValue(record)...)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	db = append(db, mmdbValue(map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               "GeoIP2-City",
+		"description":                 map[string]any{"en": "test"},
+		"ip_version":                  uint16(4),
+		"languages":                   []any{"en"},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(24),
+	})...)
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	if err := os.WriteFile(path, db, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMMDB(t *testing.T) {
+	path := writeMMDB(t, [3]byte{81, 2, 69}, map[string]any{
+		"city":         map[string]any{"names": map[string]any{"en": "London"}},
+		"subdivisions": []any{map[string]any{"names": map[string]any{"en": "England"}}},
+		"country":      map[string]any{"iso_code": "GB"},
+	})
+	m, err := OpenMMDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	for ip, want := range map[string]string{
+		"81.2.69.142":        "London, England, GB",
+		"::ffff:81.2.69.160": "London, England, GB",
+		"81.2.70.1":          "", // Not in the database
+		"10.0.0.1":           "", // Private, not looked up
+		"not an address":     "",
+	} {
+		got, err := m.Locate(context.Background(), ip)
+		if err != nil {
+			t.Errorf("%s: %v", ip, err)
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", ip, got, want)
+		}
+	}
+	if _, err := OpenMMDB(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("opened a missing database")
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/203.0.113.9/json" {
+			http.Error(w, "unknown", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"ip":"203.0.113.9","city":"Taipei","region":"","country":"TW"}`))
+	}))
+	defer ts.Close()
+	h := &HTTP{URL: ts.URL + "/%s/json"}
+	if got, err := h.Locate(context.Background(), "203.0.113.9"); err != nil || got != "Taipei, TW" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if _, err := h.Locate(context.Background(), "198.51.100.1"); err == nil {
+		t.Error("no error for a failed lookup")
+	}
+	if got, err := h.Locate(context.Background(), "127.0.0.1"); err != nil || got != "" {
+		t.Errorf("loopback: got %q, %v", got, err)
+	}
+}
+
+// countingLocator answers with the address and counts the lookups, it fails
+// while err is set
+type countingLocator struct {
+	lookups int
+	err     error
+}
+
+func (l *countingLocator) Locate(ctx context.Context, ip string) (string, error) {
+	l.lookups++
+	if l.err != nil {
+		return "", l.err
+	}
+	return "near " + ip, nil
+}
+
+func TestCached(t *testing.T) {
+	ctx := context.Background()
+	locator := &countingLocator{}
+	c := NewCached(locator, time.Hour, 2)
+
+	for range 3 {
+		if got, err := c.Locate(ctx, "192.0.2.1"); err != nil || got != "near 192.0.2.1" {
+			t.Fatalf("got %q, %v", got, err)
+		}
+	}
+	if locator.lookups != 1 {
+		t.Errorf("%d lookups of a cached address, want 1", locator.lookups)
+	}
+
+	// Failures are retried
+	locator.err = errors.New("unavailable")
+	if _, err := c.Locate(ctx, "192.0.2.2"); err == nil {
+		t.Error("error not passed on")
+	}
+	locator.err = nil
+	if got, _ := c.Locate(ctx, "192.0.2.2"); got != "near 192.0.2.2" {
+		t.Errorf("after a failure: got %q", got)
+	}
+
+	// A full cache makes room
+	c.Locate(ctx, "192.0.2.3")
+	if len(c.entries) > 2 {
+		t.Errorf("%d entries, want at most 2", len(c.entries))
+	}
+
+	// Expired entries are looked up again
+	expiring := NewCached(locator, time.Nanosecond, 2)
+	expiring.Locate(ctx, "192.0.2.4")
+	lookups := locator.lookups
+	time.Sleep(time.Millisecond)
+	expiring.Locate(ctx, "192.0.2.4")
+	if locator.lookups != lookups+1 {
+		t.Errorf("expired entry not looked up again")
+	}
+}
@@ -0,0 +1,173 @@
+// Package logging sets up the structured server log. Every record passes a
+// redaction layer: attributes named like secrets are replaced and secrets
+// written as key=value or bearer tokens are scrubbed from all strings, the
+// message included. Records logged with a request's context carry its ID.
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets in the log
+const Redacted = "[REDACTED]"
+
+// New returns a logger writing format ("json" or "text") to w, level is the
+// name of the lowest level logged, e.g. "info"
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log level: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: l, ReplaceAttr: redact}
+	var h slog.Handler
+	switch format {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, errors.New("log format: unknown format " + format + ", use json or text")
+	}
+	return slog.New(contextHandler{h}), nil
+}
+
+// secretKeys are parts of attribute keys whose values are never logged
+var secretKeys = []string{"password", "passwd", "secret", "token", "authorization", "cookie", "session_id", "recovery_code", "api_key"}
+
+var (
+	// password=..., "token": "...", code: ... in free text such as URLs and
+	// error messages, also prefixed like reset_token= or new_password=
+	secretPair = regexp.MustCompile(`(?i)\b([a-z_]*(?:password|passwd|secret|token)|pwd|session_id|recovery_code|code)("?\s*[:=]\s*"?)([^\s&"',;]+)`)
+	bearer     = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[^\s"',;]+`)
+)
+
+// Scrub removes secrets written as key=value or bearer tokens from s
+func Scrub(s string) string {
+	s = secretPair.ReplaceAllString(s, "${1}${2}"+Redacted)
+	return bearer.ReplaceAllString(s, "${1} "+Redacted)
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact is the ReplaceAttr of the handlers, it sees every attribute and
+// the message after LogValuers are resolved
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindGroup {
+		return a
+	}
+	if isSecretKey(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Scrub(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case error:
+			return slog.String(a.Key, Scrub(v.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, Scrub(v.String()))
+		}
+	}
+	return a
+}
+
+type contextKey struct{}
+
+// request is what the log knows about the request in a context, the user and
+// route are set by the handlers after the context was made
+type request struct {
+	id    string
+	mu    sync.Mutex
+	user  string
+	route string
+}
+
+// NewContext returns ctx with the request ID, which is added to the records
+// logged with the returned context
+func NewContext(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, contextKey{}, &request{id: requestID})
+}
+
+// RequestID returns the request ID in ctx, empty if there is none
+func RequestID(ctx context.Context) string {
+	if r, ok := ctx.Value(contextKey{}).(*request); ok {
+		return r.id
+	}
+	return ""
+}
+
+// SetUser records who made the request in ctx, it is read back by User even
+// from the context the request started with
+func SetUser(ctx context.Context, user string) {
+	if r, ok := ctx.Value(contextKey{}).(*request); ok {
+		r.mu.Lock()
+		r.user = user
+		r.mu.Unlock()
+	}
+}
+
+// User returns the user set by SetUser, empty for anonymous requests
+func User(ctx context.Context) string {
+	if r, ok := ctx.Value(contextKey{}).(*request); ok {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.user
+	}
+	return ""
+}
+
+// SetRoute records the pattern the request matched, read back by Route like
+// the user
+func SetRoute(ctx context.Context, route string) {
+	if r, ok := ctx.Value(contextKey{}).(*request); ok {
+		r.mu.Lock()
+		r.route = route
+		r.mu.Unlock()
+	}
+}
+
+// Route returns the route set by SetRoute, empty if none matched
+func Route(ctx context.Context) string {
+	if r, ok := ctx.Value(contextKey{}).(*request); ok {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.route
+	}
+	return ""
+}
+
+// contextHandler adds the request ID of the context to records
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"password=hunter2", "password=" + Redacted},
+		{"/download?key=abc&password=hunter2", "/download?key=abc&password=" + Redacted},
+		{"token=abc", "token=" + Redacted},
+		{"link_token=abc&x=1", "link_token=" + Redacted + "&x=1"},
+		{"registration_token=abc", "registration_token=" + Redacted},
+		{"reset_token=abc", "reset_token=" + Redacted},
+		{"new_password: hunter2", "new_password: " + Redacted},
+		{`{"client_secret": "abc"}`, `{"client_secret": "` + Redacted + `"}`},
+		{"code=123456", "code=" + Redacted},
+		{"recovery_code=abcd-efgh", "recovery_code=" + Redacted},
+		{"session_id=abc", "session_id=" + Redacted},
+		{"Authorization: Bearer abc.def", "Authorization: Bearer " + Redacted},
+		{"status_code=500 key=abc", "status_code=500 key=abc"},
+		{"nothing secret here", "nothing secret here"},
+	}
+	for _, test := range tests {
+		if got := Scrub(test.in); got != test.want {
+			t.Errorf("Scrub(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := NewContext(context.Background(), "req-1")
+	logger.InfoContext(ctx, "login with password=hunter2",
+		"reset_token", "abc",
+		"query", "key=abc&password=hunter2",
+		"error", errors.New("invalid token=abc"),
+		"user", "ann",
+	)
+	logger.Debug("not logged")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	want := map[string]any{
+		"msg":         "login with password=" + Redacted,
+		"reset_token": Redacted,
+		"query":       "key=abc&password=" + Redacted,
+		"error":       "invalid token=" + Redacted,
+		"user":        "ann",
+		"request_id":  "req-1",
+	}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%s = %v, want %v", key, record[key], value)
+		}
+	}
+	if strings.Contains(buf.String(), "hunter2") || strings.Contains(buf.String(), "not logged") {
+		t.Errorf("log %s", buf.String())
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := NewContext(context.Background(), "req-2")
+	SetUser(ctx, "ann")
+	SetRoute(ctx, "/storage/list")
+	if RequestID(ctx) != "req-2" || User(ctx) != "ann" || Route(ctx) != "/storage/list" {
+		t.Errorf("request %q user %q route %q", RequestID(ctx), User(ctx), Route(ctx))
+	}
+	// Without a request nothing is recorded
+	SetUser(context.Background(), "ann")
+	if User(context.Background()) != "" || RequestID(context.Background()) != "" {
+		t.Error("values without a request context")
+	}
+	var buf bytes.Buffer
+	logger, _ := New(&buf, "text", "info")
+	logger.Info("no request")
+	if strings.Contains(buf.String(), "request_id") {
+		t.Errorf("request ID without a request: %s", buf.String())
+	}
+}
@@ -0,0 +1,43 @@
+package mail
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSMTPMailerStalledServer(t *testing.T) {
+	// Accepts connections but never greets
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			// Held open until the client hangs up
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	port := lis.Addr().(*net.TCPAddr).Port
+	m := &SMTPMailer{Host: "127.0.0.1", Port: port, From: "server@example.com"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := m.Send(ctx, Message{To: "user@example.com", Subject: "hi"}); err == nil {
+		t.Fatal("sent to a server that never answered")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("send returned after %s, the context ended after 200ms", elapsed)
+	}
+}
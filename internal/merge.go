@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"codeserver/internal/auth"
+	"codeserver/internal/config"
+	"codeserver/internal/database"
+	"codeserver/internal/migrate"
+	"codeserver/internal/storage"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// mergeTable is a table copied as is from the auth database. Columns are
+// typed so NULLs left by old SQLite schemas become zero values and SQLite's
+// integer booleans fit Postgres.
+type mergeTable struct {
+	name    string
+	columns []string
+	kinds   string // s string, i integer, b boolean, one per column
+	clause  string // Appended to the SELECT to filter or order the rows
+}
+
+var mergeTables = []mergeTable{
+	// IDs are left to the shared database, users are inserted in
+	// registration order so they count up like in the migration
+	{"users", []string{"email", "password", "username", "created_at", "totp_secret", "totp_enabled",
+		"totp_last_counter", "email_verified", "invite_quota", "role", "disabled", "email_changes"}, "sssisbibisbi", "ORDER BY created_at, email"},
+	{"sessions", []string{"id", "email", "location", "agent", "last_seen", "created_at"}, "ssssii", "WHERE email IN (SELECT email FROM users)"},
+	{"identities", []string{"provider", "subject", "email", "created_at"}, "sssi", "WHERE email IN (SELECT email FROM users)"},
+	{"recovery_codes", []string{"email", "code_hash"}, "ss", "WHERE email IN (SELECT email FROM users)"},
+	{"login_failures", []string{"key", "failures", "last_failure", "locked_until"}, "siii", ""},
+	{"invites", []string{"code", "created_by", "created_at", "used_by", "used_at"}, "ssisi", ""},
+}
+
+// mergeCommand copies the split auth and storage databases into the shared
+// one, which has to be empty. Everything is copied in one transaction.
+func mergeCommand(c *config.Config) error {
+	if c.Database.Shared.URL == "" {
+		return errors.New("merge requires database.shared.url")
+	}
+	ctx := context.Background()
+	authDB, err := database.Open(c.Database.Auth.URL, c.Database.Auth.Token)
+	if err != nil {
+		return err
+	}
+	storageDB, err := database.Open(c.Database.Storage.URL, c.Database.Storage.Token)
+	if err != nil {
+		return err
+	}
+	shared, err := database.Open(c.Database.Shared.URL, c.Database.Shared.Token)
+	if err != nil {
+		return err
+	}
+
+	// The copy only knows the latest schemas, the sources are migrated like
+	// a server start would
+	for _, db := range []struct {
+		conn   *database.DB
+		schema migrate.Schema
+	}{
+		{authDB, auth.Schemas[authDB.Dialect]},
+		{storageDB, storage.Schemas[storageDB.Dialect]},
+		{shared, auth.Schemas[shared.Dialect]},
+		{shared, storage.SharedSchemas[shared.Dialect]},
+	} {
+		if err := prepareSchema(db.conn, db.schema, true); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"users", "objects"} {
+		var n int
+		if err := shared.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("shared database already has %d rows in %s", n, table)
+		}
+	}
+
+	tx, err := shared.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range mergeTables {
+		n, err := table.copy(authDB, tx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", table.name, err)
+		}
+		fmt.Printf("%s: copied %d rows\n", table.name, n)
+	}
+	// Usernames the migrations renamed whose objects weren't moved yet
+	renames, err := auth.NewStore(authDB).UsernameRenames()
+	if err != nil {
+		return err
+	}
+	if err := mergeObjects(storageDB, renames, tx); err != nil {
+		return fmt.Errorf("objects: %w", err)
+	}
+	return tx.Commit()
+}
+
+// copy inserts the rows of the table in src into tx
+func (t mergeTable) copy(src *database.DB, tx *database.Tx) (int, error) {
+	rows, err := src.Query("SELECT " + strings.Join(t.columns, ", ") + " FROM " + t.name + " " + t.clause)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	insert := "INSERT INTO " + t.name + " (" + strings.Join(t.columns, ", ") + ") VALUES (?" + strings.Repeat(", ?", len(t.columns)-1) + ")"
+	n := 0
+	for rows.Next() {
+		dest := make([]any, len(t.columns))
+		for i, kind := range t.kinds {
+			switch kind {
+			case 's':
+				dest[i] = &sql.NullString{}
+			case 'i':
+				dest[i] = &sql.NullInt64{}
+			case 'b':
+				dest[i] = &sql.NullBool{}
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		values := make([]any, len(dest))
+		for i, d := range dest {
+			switch v := d.(type) {
+			case *sql.NullString:
+				values[i] = v.String
+			case *sql.NullInt64:
+				values[i] = v.Int64
+			case *sql.NullBool:
+				values[i] = v.Bool
+			}
+		}
+		if _, err := tx.Exec(insert, values...); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// mergeObjects copies the objects, replacing the username by the ID of the
+// user, anonymous objects get no owner. Owners in renames are looked up by
+// their new username. Objects of users that no longer exist are skipped,
+// their R2 keys are logged so they can be cleaned up.
+func mergeObjects(src *database.DB, renames map[string]string, tx *database.Tx) error {
+	owners := map[string]int64{}
+	users, err := tx.Query("SELECT id, username FROM users")
+	if err != nil {
+		return err
+	}
+	for users.Next() {
+		var id int64
+		var username string
+		if err := users.Scan(&id, &username); err != nil {
+			users.Close()
+			return err
+		}
+		owners[username] = id
+	}
+	users.Close()
+
+	rows, err := src.Query("SELECT id, username, filename, password, path, created_at, size FROM objects")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	copied, skipped := 0, 0
+	for rows.Next() {
+		var id, username string
+		var filename, password, path sql.NullString
+		var createdAt, size int64
+		if err := rows.Scan(&id, &username, &filename, &password, &path, &createdAt, &size); err != nil {
+			return err
+		}
+		var ownerID sql.NullInt64
+		if newUsername, ok := renames[username]; ok {
+			username = newUsername
+		}
+		if username != storage.AnonymousOwner {
+			userID, ok := owners[username]
+			if !ok {
+				slog.Warn("skipping object without owner", "id", id, "path", path.String, "owner", username)
+				skipped++
+				continue
+			}
+			ownerID = sql.NullInt64{Int64: userID, Valid: true}
+		}
+		query := "INSERT INTO objects (id, owner_id, filename, password, path, created_at, size) VALUES (?, ?, ?, ?, ?, ?, ?)"
+		if _, err := tx.Exec(query, id, ownerID, filename.String, password.String, path.String, createdAt, size); err != nil {
+			return err
+		}
+		copied++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	fmt.Printf("objects: copied %d rows, skipped %d without owner\n", copied, skipped)
+	return nil
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"codeserver/internal/auth"
+	"codeserver/internal/config"
+	"codeserver/internal/database"
+	"codeserver/internal/migrate"
+	"codeserver/internal/storage"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMergeRenamedOwners(t *testing.T) {
+	dir := t.TempDir()
+	c := &config.Config{}
+	c.Database.Auth.URL = filepath.Join(dir, "auth.db")
+	c.Database.Storage.URL = filepath.Join(dir, "storage.db")
+	c.Database.Shared.URL = filepath.Join(dir, "shared.db")
+	open := func(url string) *database.DB {
+		db, err := database.Open(url, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	ctx := context.Background()
+
+	// Usernames differing in case only, from before 0010_username_nocase
+	authDB := open(c.Database.Auth.URL)
+	if _, err := migrate.Up(ctx, authDB, auth.Schemas[authDB.Dialect], 9); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []struct{ email, username string }{{"ann@example.com", "ann"}, {"ann2@example.com", "Ann"}} {
+		if _, err := authDB.Exec("INSERT INTO users (email, password, username, created_at) VALUES (?, '', ?, ?)", user.email, user.username, time.Now().UnixMilli()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storageDB := open(c.Database.Storage.URL)
+	if _, err := migrate.Up(ctx, storageDB, storage.Schemas[storageDB.Dialect], 0); err != nil {
+		t.Fatal(err)
+	}
+	objects := storage.NewStore(storageDB)
+	for id, owner := range map[string]string{"id0": "ann", "id1": "Ann", "id2": storage.AnonymousOwner} {
+		if err := objects.Insert(id, owner, id+".txt", "", owner+"/"+id, 1, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := mergeCommand(c); err != nil {
+		t.Fatal(err)
+	}
+	shared := open(c.Database.Shared.URL)
+	for id, want := range map[string]string{"id0": "ann", "id1": "Ann-2", "id2": ""} {
+		var owner string
+		err := shared.QueryRow("SELECT COALESCE(u.username, '') FROM objects o LEFT JOIN users u ON u.id = o.owner_id WHERE o.id = ?", id).Scan(&owner)
+		if err != nil {
+			t.Errorf("object %s: %v", id, err)
+			continue
+		}
+		if owner != want {
+			t.Errorf("owner of %s = %q, want %q", id, owner, want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Package metrics holds the Prometheus metrics of the server. They are
+// registered in the registry of NewRegistry, which Handler exposes.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "codeserver"
+
+var (
+	// Labelled method, route and status. The route is the pattern it
+	// matched, e.g. /admin/users/{username}/role, or "unmatched".
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "http_requests_total",
+		Help: "HTTP requests served.",
+	}, []string{"method", "route", "status"})
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Name: "http_request_duration_seconds",
+		Help:    "Time to serve HTTP requests.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 1800},
+	}, []string{"method", "route", "status"})
+
+	UploadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Name: "storage_upload_bytes_total",
+		Help: "Bytes of object contents sent to the blob store.",
+	})
+	DownloadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Name: "storage_download_bytes_total",
+		Help: "Bytes of object contents sent to clients.",
+	})
+	// Labelled method (multipart or single) and result (ok or error)
+	Uploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "storage_uploads_total",
+		Help: "Uploads to the blob store by method.",
+	}, []string{"method", "result"})
+
+	// Labelled by the S3 operation, e.g. PutObject
+	R2Duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Name: "r2_operation_duration_seconds",
+		Help:    "Time of R2 operations, streaming ones until the body is sent or the first byte is received.",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"operation"})
+	R2Errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "r2_operation_errors_total",
+		Help: "Failed R2 operations.",
+	}, []string{"operation"})
+
+	// Labelled database (auth, storage, audit or shared) and operation (exec
+	// or query)
+	DBDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Name: "db_query_duration_seconds",
+		Help:    "Time of database statements, queries until the first row is available.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"database", "operation"})
+)
+
+// NewRegistry returns a registry of the metrics above, those of the Go
+// runtime and the process and the values read from state when scraped
+func NewRegistry(state State) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Requests, RequestDuration,
+		UploadBytes, DownloadBytes, Uploads,
+		R2Duration, R2Errors,
+		DBDuration,
+		stateCollector{state},
+	)
+	return registry
+}
+
+// ObserveR2 records an R2 operation which started at start, err is whether
+// it failed
+func ObserveR2(operation string, start time.Time, err error) {
+	R2Duration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		R2Errors.WithLabelValues(operation).Inc()
+	}
+}
+
+// Handler serves the metrics of registry in the Prometheus text format
+func Handler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
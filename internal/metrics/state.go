@@ -0,0 +1,57 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// State reads the values the databases hold when metrics are scraped
+type State struct {
+	Sessions       func() (int, error)
+	ObjectsPerUser func() ([]int, error) // Of every user owning objects
+}
+
+var (
+	sessionsDesc = prometheus.NewDesc(namespace+"_auth_sessions",
+		"Sessions in the auth database.", nil, nil)
+	objectsPerUserDesc = prometheus.NewDesc(namespace+"_storage_objects_per_user",
+		"Users owning objects by their number of objects.", nil, nil)
+	objectsPerUserBuckets = []float64{1, 10, 100, 1000, 10000, 100000}
+)
+
+// stateCollector reports the values of a State, unset functions are
+// skipped
+type stateCollector struct {
+	state State
+}
+
+func (c stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+	ch <- objectsPerUserDesc
+}
+
+func (c stateCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.state
+	if s.Sessions != nil {
+		if n, err := s.Sessions(); err != nil {
+			ch <- prometheus.NewInvalidMetric(sessionsDesc, err)
+		} else {
+			ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(n))
+		}
+	}
+	if s.ObjectsPerUser != nil {
+		counts, err := s.ObjectsPerUser()
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(objectsPerUserDesc, err)
+			return
+		}
+		buckets := make(map[float64]uint64, len(objectsPerUserBuckets))
+		var sum float64
+		for _, n := range counts {
+			sum += float64(n)
+			for _, upper := range objectsPerUserBuckets {
+				if float64(n) <= upper {
+					buckets[upper]++
+				}
+			}
+		}
+		ch <- prometheus.MustNewConstHistogram(objectsPerUserDesc, uint64(len(counts)), sum, buckets)
+	}
+}
@@ -2,7 +2,18 @@ package internal
 
 import (
 	"codeserver/internal/auth"
+	"codeserver/internal/logging"
+	"codeserver/internal/metrics"
+	"codeserver/internal/principal"
+	"codeserver/internal/realip"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type middleware func(next http.Handler) http.Handler
@@ -14,32 +25,214 @@ func handle(mux *http.ServeMux, pattern string, handler http.Handler, middleware
 	mux.Handle(pattern, handler)
 }
 
-func authMiddleware(next http.Handler) http.Handler {
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get sessionID
-		sessionID := r.Header.Get("Authorization")
-		if sessionID == "" {
+		// Get user from the headers of a trusted authenticating proxy, the
+		// Authorization header or the session cookie (which also has to pass
+		// the CSRF check)
+		p, err := s.auth.RequestPrincipal(r)
+		switch err {
+		case nil:
+		case auth.ErrCSRF, auth.ErrEmailNotVerified, auth.ErrUserDisabled:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
-		// Remove "Bearer " (only if present, detect to prevent out-of-bounds)
-		if len(sessionID) > 7 && sessionID[:7] == "Bearer " {
-			sessionID = sessionID[7:]
-		} else {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		logging.SetUser(r.Context(), p.Username)
+		next.ServeHTTP(w, r.WithContext(principal.NewContext(r.Context(), p)))
+	})
+}
+
+// adminMiddleware only lets administrators through, it relies on the
+// principal set by authMiddleware
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := principal.FromRequest(r)
+		if p == nil || p.Role != auth.RoleAdmin || !p.Can(principal.ScopeAdmin) {
+			http.Error(w, "forbidden", http.StatusForbidden)
 			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stripIdentity removes identity headers clients may send, the identity of a
+// request only ever comes from the principal in its context
+func stripIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range principal.IdentityHeaders {
+			r.Header.Del(header)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody fails reading request bodies larger than n bytes, zero is
+// unlimited
+func limitBody(n int64) middleware {
+	return func(next http.Handler) http.Handler {
+		if n == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-		// Get username
-		username, err := auth.UsernameFromSessionID(sessionID)
-		if err != nil {
+// transferDeadline replaces the read and write timeouts of the HTTP server
+// with timeout, uploads and downloads of large objects take far longer than
+// API requests. Zero is unlimited.
+func transferDeadline(timeout time.Duration) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var deadline time.Time
+			if timeout > 0 {
+				deadline = time.Now().Add(timeout)
+			}
+			rc := http.NewResponseController(w)
+			// Not every ResponseWriter supports deadlines, e.g. in tests
+			_ = rc.SetReadDeadline(deadline)
+			_ = rc.SetWriteDeadline(deadline)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestID gives every request an ID for the log, the X-Request-ID of the
+// client or proxy if it sent a sane one. It is echoed in the response.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(logging.NewContext(r.Context(), id)))
+	})
+}
+
+// validRequestID accepts up to 128 letters, digits and -_.: so IDs can't
+// forge log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// route records the pattern the ServeMux mux matched once it served the
+// request, prefixed with where mux is mounted. The innermost mux wins, so
+// /auth/login is recorded rather than /auth/.
+func route(prefix string, mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		if r.Pattern == "" || logging.Route(r.Context()) != "" {
+			return
+		}
+		pattern := r.Pattern
+		if _, path, ok := strings.Cut(pattern, " "); ok {
+			pattern = path
+		}
+		logging.SetRoute(r.Context(), prefix+pattern)
+	})
+}
+
+// MetricsHandler serves the metrics of the server to requests with the
+// bearer token, to all if it is empty
+func (s *Server) MetricsHandler(token string) http.Handler {
+	h := metrics.Handler(s.metrics)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
-		// Set custom header
-		r.Header.Set("X-Session-ID", sessionID)
-		r.Header.Set("X-Username", username)
+		h.ServeHTTP(w, r)
+	})
+}
 
-		next.ServeHTTP(w, r)
+// accessLog logs every request once it is served and counts it in the
+// metrics, it has to run inside requestID
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		duration := time.Since(start)
+		route := logging.Route(r.Context())
+		if route == "" {
+			route = "unmatched"
+		}
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		default:
+			method = "other" // Clients choose it, keep the label values bounded
+		}
+		labels := []string{method, route, strconv.Itoa(sw.status)}
+		metrics.Requests.WithLabelValues(labels...).Inc()
+		metrics.RequestDuration.WithLabelValues(labels...).Observe(duration.Seconds())
+
+		level := slog.LevelInfo
+		if sw.status >= 500 {
+			level = slog.LevelError
+		}
+		slog.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"route", route,
+			"path", r.URL.Path,
+			"query", r.URL.RawQuery, // Scrubbed, downloads pass the object password
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"duration_ms", duration.Milliseconds(),
+			"user", logging.User(r.Context()),
+			"ip", realip.FromRequest(r),
+			"user_agent", r.UserAgent(),
+		)
 	})
 }
+
+// statusWriter records the status and size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the deadlines and Flush
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"bytes"
+	"codeserver/internal/logging"
+	"codeserver/internal/principal"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /download", func(w http.ResponseWriter, r *http.Request) {
+		logging.SetUser(r.Context(), "ann")
+		slog.InfoContext(r.Context(), "inside")
+		w.Write([]byte("ok"))
+	})
+	handler := requestID(accessLog(route("/anonymous", mux)))
+
+	tests := []struct {
+		name, header string
+		kept         bool
+	}{
+		{"client ID", "abc-123:x.y_z", true},
+		{"no ID", "", false},
+		{"forged log line", "abc\nlevel=ERROR", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf.Reset()
+			r := httptest.NewRequest("GET", "/download?key=abc&password=hunter2", nil)
+			if test.header != "" {
+				r.Header.Set("X-Request-ID", test.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			id := w.Header().Get("X-Request-ID")
+			if test.kept && id != test.header {
+				t.Errorf("X-Request-ID = %q, want %q", id, test.header)
+			}
+			if !test.kept && (id == test.header || len(id) != 16) {
+				t.Errorf("X-Request-ID = %q, want a new one", id)
+			}
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("log: %s", buf.String())
+			}
+			for _, line := range lines {
+				var record map[string]any
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatal(err)
+				}
+				if record["request_id"] != id {
+					t.Errorf("request_id = %v, want %s", record["request_id"], id)
+				}
+			}
+			var access map[string]any
+			json.Unmarshal([]byte(lines[1]), &access)
+			want := map[string]any{
+				"msg":    "request",
+				"route":  "/anonymous/download",
+				"query":  "key=abc&password=" + logging.Redacted,
+				"status": float64(200),
+				"user":   "ann",
+			}
+			for key, value := range want {
+				if access[key] != value {
+					t.Errorf("%s = %v, want %v", key, access[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestStripIdentity(t *testing.T) {
+	var got http.Header
+	handler := stripIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	r := httptest.NewRequest("GET", "/download", nil)
+	for _, header := range principal.IdentityHeaders {
+		r.Header.Set(header, "admin")
+	}
+	r.Header.Set("X-Forwarded-Email", "ann@example.com")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	for _, header := range principal.IdentityHeaders {
+		if value := got.Get(header); value != "" {
+			t.Errorf("%s: %q reached the handler", header, value)
+		}
+	}
+	// Proxy headers are left to the auth service, which only trusts them
+	// from the configured proxies
+	if got.Get("X-Forwarded-Email") == "" {
+		t.Error("X-Forwarded-Email stripped")
+	}
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"codeserver/internal/audit"
+	"codeserver/internal/auth"
+	"codeserver/internal/config"
+	"codeserver/internal/database"
+	"codeserver/internal/migrate"
+	"codeserver/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const migrateUsage = `usage: codeserver migrate status [flags]
+       codeserver migrate up [<schema> [<version>]] [flags]
+       codeserver migrate down <schema> <version> [flags]
+       codeserver migrate merge [flags]
+
+Schemas are auth, storage and audit, storage is storage_shared in a shared
+database. up without a schema migrates all of them to the latest version,
+down reverts one schema to the given version.
+
+merge copies the auth and storage databases into the empty shared database,
+objects of users that no longer exist are skipped.
+`
+
+type schemaDB struct {
+	schema migrate.Schema
+	db     *database.DB
+}
+
+// schemaDBs opens the database of every schema, auth comes first since a
+// shared storage schema references its users
+func schemaDBs(c *config.Config) ([]schemaDB, error) {
+	authDB, storageDB, err := openUserDBs(c)
+	if err != nil {
+		return nil, err
+	}
+	auditDB, err := database.Open(c.Database.Audit.URL, c.Database.Audit.Token)
+	if err != nil {
+		return nil, err
+	}
+	storageSchemas := storage.Schemas
+	if storageDB == authDB {
+		storageSchemas = storage.SharedSchemas
+	}
+	return []schemaDB{
+		{auth.Schemas[authDB.Dialect], authDB},
+		{storageSchemas[storageDB.Dialect], storageDB},
+		{audit.Schemas[auditDB.Dialect], auditDB},
+	}, nil
+}
+
+// migrateCommand runs codeserver migrate, the positional arguments come
+// before the config flags
+func migrateCommand(args []string) error {
+	var positional []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional, args = append(positional, args[0]), args[1:]
+	}
+	if len(positional) == 0 {
+		return errors.New(migrateUsage)
+	}
+	action, positional := positional[0], positional[1:]
+
+	c, err := config.Load(args)
+	if err != nil {
+		return err
+	}
+	if err := setLogger(c); err != nil {
+		return err
+	}
+	if action == "merge" && len(positional) == 0 {
+		return mergeCommand(c)
+	}
+	dbs, err := schemaDBs(c)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	// Narrow to the named schema and read the target version
+	target := 0
+	if len(positional) > 0 {
+		name := positional[0]
+		i := 0
+		for i < len(dbs) && dbs[i].schema.Name != name {
+			i++
+		}
+		if i == len(dbs) {
+			return fmt.Errorf("unknown schema %q", name)
+		}
+		dbs = dbs[i : i+1]
+		if len(positional) > 1 {
+			if target, err = strconv.Atoi(positional[1]); err != nil {
+				return fmt.Errorf("invalid version %q", positional[1])
+			}
+		}
+	}
+
+	switch {
+	case action == "status" && len(positional) == 0:
+		for _, d := range dbs {
+			version, err := migrate.Version(ctx, d.db, d.schema.Name)
+			if err != nil {
+				return err
+			}
+			state := "up to date"
+			switch {
+			case version > d.schema.Latest():
+				state = "newer than this server"
+			case version < d.schema.Latest():
+				state = fmt.Sprintf("%d pending", d.schema.Latest()-version)
+			}
+			fmt.Printf("%-8s version %d of %d, %s\n", d.schema.Name, version, d.schema.Latest(), state)
+		}
+	case action == "up" && len(positional) <= 2:
+		for _, d := range dbs {
+			applied, err := migrate.Up(ctx, d.db, d.schema, target)
+			for _, m := range applied {
+				fmt.Printf("%s: applied %d_%s\n", d.schema.Name, m.Version, m.Name)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case action == "down" && len(positional) == 2:
+		reverted, err := migrate.Down(ctx, dbs[0].db, dbs[0].schema, target)
+		for _, m := range reverted {
+			fmt.Printf("%s: reverted %d_%s\n", dbs[0].schema.Name, m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		fmt.Fprint(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+// Package migrate applies versioned SQL migrations. Every schema (auth,
+// storage, audit) embeds its own files named <version>_<name>.up.sql and
+// <version>_<name>.down.sql and keeps its version in the schema_migrations
+// table of its database, so several schemas can share one database.
+//
+// The bookkeeping queries are plain SQL with ? placeholders, which
+// database.DB rebinds, so it works on SQLite, libsql/Turso and Postgres.
+// Migrations themselves are written per dialect.
+package migrate
+
+import (
+	"codeserver/internal/database"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNewerSchema = errors.New("database schema is newer than this server")
+	ErrPending     = errors.New("database schema has pending migrations")
+)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string // Empty if the migration can't be reverted
+}
+
+// Schema is the ordered migrations of one package
+type Schema struct {
+	Name       string
+	Migrations []Migration
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Load reads the migrations in dir of fsys. Versions have to start at 1 and
+// be consecutive, every migration needs an up file.
+func Load(name string, fsys fs.FS, dir string) (Schema, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return Schema{}, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return Schema{}, fmt.Errorf("%s: unexpected file %s", name, entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return Schema{}, fmt.Errorf("%s: version %d has two names, %s and %s", name, version, m.Name, match[2])
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return Schema{}, err
+		}
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	schema := Schema{Name: name}
+	for _, m := range byVersion {
+		schema.Migrations = append(schema.Migrations, *m)
+	}
+	sort.Slice(schema.Migrations, func(i, j int) bool { return schema.Migrations[i].Version < schema.Migrations[j].Version })
+	for i, m := range schema.Migrations {
+		if m.Version != i+1 {
+			return Schema{}, fmt.Errorf("%s: missing version %d", name, i+1)
+		}
+		if m.Up == "" {
+			return Schema{}, fmt.Errorf("%s: version %d has no up migration", name, m.Version)
+		}
+	}
+	return schema, nil
+}
+
+// MustLoad is Load for embedded files, which can only fail by a programming
+// error
+func MustLoad(name string, fsys fs.FS, dir string) Schema {
+	schema, err := Load(name, fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// MustLoadDialects loads the migrations of every dialect, which are in the
+// subdirectories of dir named after the dialect, e.g. migrations/postgres
+func MustLoadDialects(name string, fsys fs.FS, dir string) map[database.Dialect]Schema {
+	schemas := map[database.Dialect]Schema{}
+	for _, d := range []database.Dialect{database.SQLite, database.Postgres} {
+		schemas[d] = MustLoad(name, fsys, path.Join(dir, d.String()))
+	}
+	return schemas
+}
+
+// Latest returns the version the schema is at after all migrations
+func (s Schema) Latest() int {
+	return len(s.Migrations)
+}
+
+func createTable(ctx context.Context, db *database.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			schema VARCHAR(64) NOT NULL,
+			version INTEGER NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			applied_at BIGINT NOT NULL,  -- Unix time in milliseconds
+
+			PRIMARY KEY (schema, version)
+		)`)
+	return err
+}
+
+// Version returns the version of the schema in db, 0 if it was never migrated
+func Version(ctx context.Context, db *database.DB, schema string) (int, error) {
+	if err := createTable(ctx, db); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations WHERE schema = ?", schema).Scan(&version)
+	return version, err
+}
+
+// Check returns ErrNewerSchema if db was migrated by a newer server and
+// ErrPending if it still needs migrations
+func Check(ctx context.Context, db *database.DB, s Schema) error {
+	version, err := Version(ctx, db, s.Name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case version > s.Latest():
+		return fmt.Errorf("%s: %w (version %d, this server knows up to %d)", s.Name, ErrNewerSchema, version, s.Latest())
+	case version < s.Latest():
+		return fmt.Errorf("%s: %w (version %d of %d), run codeserver migrate up", s.Name, ErrPending, version, s.Latest())
+	}
+	return nil
+}
+
+// Up applies the migrations up to and including target, 0 means all of them.
+// It refuses to touch a database with a newer schema.
+func Up(ctx context.Context, db *database.DB, s Schema, target int) ([]Migration, error) {
+	if target == 0 {
+		target = s.Latest()
+	}
+	if target < 0 || target > s.Latest() {
+		return nil, fmt.Errorf("%s: unknown version %d", s.Name, target)
+	}
+	version, err := Version(ctx, db, s.Name)
+	if err != nil {
+		return nil, err
+	}
+	if version > s.Latest() {
+		return nil, fmt.Errorf("%s: %w (version %d, this server knows up to %d)", s.Name, ErrNewerSchema, version, s.Latest())
+	}
+	var applied []Migration
+	for _, m := range s.Migrations[version:target] {
+		err := apply(ctx, db, m.Up, func(tx *database.Tx) error {
+			_, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (schema, version, name, applied_at) VALUES (?, ?, ?, ?)",
+				s.Name, m.Version, m.Name, time.Now().UnixMilli())
+			return err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("%s: migration %d_%s: %w", s.Name, m.Version, m.Name, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// Down reverts migrations until the schema is at target, 0 reverts all of them
+func Down(ctx context.Context, db *database.DB, s Schema, target int) ([]Migration, error) {
+	version, err := Version(ctx, db, s.Name)
+	if err != nil {
+		return nil, err
+	}
+	if version > s.Latest() {
+		return nil, fmt.Errorf("%s: %w (version %d, this server knows up to %d)", s.Name, ErrNewerSchema, version, s.Latest())
+	}
+	if target < 0 || target > version {
+		return nil, fmt.Errorf("%s: can't go down to version %d from %d", s.Name, target, version)
+	}
+	var reverted []Migration
+	for i := version - 1; i >= target; i-- {
+		m := s.Migrations[i]
+		if m.Down == "" {
+			return reverted, fmt.Errorf("%s: migration %d_%s can't be reverted", s.Name, m.Version, m.Name)
+		}
+		err := apply(ctx, db, m.Down, func(tx *database.Tx) error {
+			_, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE schema = ? AND version = ?", s.Name, m.Version)
+			return err
+		})
+		if err != nil {
+			return reverted, fmt.Errorf("%s: reverting %d_%s: %w", s.Name, m.Version, m.Name, err)
+		}
+		reverted = append(reverted, m)
+	}
+	return reverted, nil
+}
+
+// apply runs the SQL and the bookkeeping in one transaction
+func apply(ctx context.Context, db *database.DB, query string, record func(tx *database.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,68 @@
+// Package principal carries the authenticated identity of a request in its
+// context, from authMiddleware to the handlers.
+package principal
+
+import (
+	"context"
+	"net/http"
+	"slices"
+)
+
+// How a principal was authenticated
+const (
+	MethodBearer = "bearer"
+	MethodCookie = "cookie"
+	MethodProxy  = "proxy"
+)
+
+// Scopes limit what a principal may do, sessions get ScopeAll
+const (
+	ScopeAll          = "*"
+	ScopeStorageRead  = "storage:read"
+	ScopeStorageWrite = "storage:write"
+	ScopeAdmin        = "admin"
+)
+
+type Principal struct {
+	Username  string
+	Email     string
+	Role      string
+	SessionID string // Session or token ID, empty for proxy authentication
+	Method    string
+	Scopes    []string
+}
+
+// Can reports whether the principal holds scope, the role is checked separately
+func (p *Principal) Can(scope string) bool {
+	return slices.Contains(p.Scopes, ScopeAll) || slices.Contains(p.Scopes, scope)
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal, nil for anonymous requests
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(contextKey{}).(*Principal)
+	return p
+}
+
+// FromRequest returns the principal of r, nil for anonymous requests
+func FromRequest(r *http.Request) *Principal {
+	return FromContext(r.Context())
+}
+
+// Username returns the username of r's principal, empty for anonymous requests
+func Username(r *http.Request) string {
+	if p := FromRequest(r); p != nil {
+		return p.Username
+	}
+	return ""
+}
+
+// IdentityHeaders were used to pass the identity downstream before the
+// principal existed. Nothing trusts them anymore, but they are still
+// stripped from client requests so old code or logs can't be fooled.
+var IdentityHeaders = []string{"X-Username", "X-Session-ID", "X-Role"}
@@ -2,16 +2,19 @@ package r2
 
 import (
 	"bytes"
+	"codeserver/internal/metrics"
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"net/url"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
 )
 
 type Client struct {
@@ -19,25 +22,37 @@ type Client struct {
 	bucket string
 }
 
-var R2Client Client
-
-func Init(cfAccountID, cfAccessKey, cfSecretAccessKey, cfBucketName string) {
+// New returns a client for the bucket of the Cloudflare account
+func New(cfAccountID, cfAccessKey, cfSecretAccessKey, cfBucketName string) (*Client, error) {
 	cfg, err := config.LoadDefaultConfig(context.TODO(),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfAccessKey, cfSecretAccessKey, "")),
 		config.WithRegion("auto"),
 	)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
 		o.BaseEndpoint = aws.String(fmt.Sprintf("https://%s.r2.cloudflarestorage.com", cfAccountID))
+		o.APIOptions = append(o.APIOptions, addMetrics)
 	})
 
-	R2Client = Client{
+	return &Client{
 		s3:     client,
 		bucket: cfBucketName,
-	}
+	}, nil
+}
+
+// addMetrics times every operation of the client, e.g. each part of a
+// multipart upload, and counts its errors
+func addMetrics(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("Metrics",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			start := time.Now()
+			out, md, err := next.HandleInitialize(ctx, in)
+			metrics.ObserveR2(middleware.GetOperationName(ctx), start, err)
+			return out, md, err
+		}), middleware.Before)
 }
 
 // Upload uploads a byte slice as an object to R2.
@@ -66,8 +81,9 @@ func (c *Client) UploadStream(ctx context.Context, key string, r io.Reader) erro
 	return nil
 }
 
-// UploadMultipart streams a large file in parts.
-func (c *Client) UploadMultipart(ctx context.Context, key string, r io.Reader, partSize int64) error {
+// UploadMultipart streams a large file in parts. A failed upload, also one
+// whose ctx was cancelled, is aborted so R2 doesn't keep its parts.
+func (c *Client) UploadMultipart(ctx context.Context, key string, r io.Reader, partSize int64) (err error) {
 	// 1. Initiate multipart upload
 	createResp, err := c.s3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
 		Bucket: aws.String(c.bucket),
@@ -78,6 +94,21 @@ func (c *Client) UploadMultipart(ctx context.Context, key string, r io.Reader, p
 	}
 
 	uploadID := *createResp.UploadId
+	defer func() {
+		if err == nil {
+			return
+		}
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		_, abortErr := c.s3.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(c.bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+		})
+		if abortErr != nil {
+			err = fmt.Errorf("%w (abort multipart upload: %v)", err, abortErr)
+		}
+	}()
 	var completedParts []types.CompletedPart
 
 	buf := make([]byte, partSize)
@@ -156,3 +187,28 @@ func (c *Client) GetObject(ctx context.Context, key string) (*s3.GetObjectOutput
 		Key:    aws.String(key),
 	})
 }
+
+// Copy copies an object inside the bucket.
+func (c *Client) Copy(ctx context.Context, srcKey, dstKey string) error {
+	_, err := c.s3.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(c.bucket),
+		CopySource: aws.String(c.bucket + "/" + (&url.URL{Path: srcKey}).EscapedPath()),
+		Key:        aws.String(dstKey),
+	})
+	if err != nil {
+		return fmt.Errorf("copy object: %w", err)
+	}
+	return nil
+}
+
+// Delete removes an object from the bucket.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("delete object: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package realip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Resolver finds the client address of requests. Forwarding headers are
+// only believed from the trusted proxies, requests from anyone else are
+// attributed to the peer address, whatever headers they send.
+type Resolver struct {
+	trusted    []netip.Prefix
+	cloudflare bool
+}
+
+// NewResolver trusts the proxies in cidrs, entries are CIDRs or single
+// addresses. CF-Connecting-IP is only honoured with cloudflare, which
+// requires the trusted proxies to be Cloudflare's ranges alone; any other
+// proxy passes the header through from the client.
+func NewResolver(cidrs []string, cloudflare bool) (*Resolver, error) {
+	prefixes, err := ParsePrefixes(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{trusted: prefixes, cloudflare: cloudflare}, nil
+}
+
+// ParsePrefixes parses CIDRs or single addresses, empty entries are skipped
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// IsTrusted reports whether addr belongs to a trusted proxy
+func (res *Resolver) IsTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range res.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Peer returns the address of the directly connected client, works for both
+// IPv4 and IPv6 remote addresses
+func Peer(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+type contextKey struct{}
+
+// Middleware resolves the client address once and keeps it in the context
+// for FromRequest
+func (res *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), contextKey{}, res.ClientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// FromRequest returns the client address found by Resolver.Middleware, or
+// the peer address of requests that didn't pass through it
+func FromRequest(r *http.Request) string {
+	if ip, ok := r.Context().Value(contextKey{}).(string); ok {
+		return ip
+	}
+	if peer, ok := Peer(r); ok {
+		return peer.String()
+	}
+	return r.RemoteAddr
+}
+
+// ClientIP returns the IP address of the client. Forwarding headers are only
+// consulted when the request comes from a trusted proxy, in the order
+// CF-Connecting-IP (with cloudflare), Forwarded, X-Forwarded-For.
+func (res *Resolver) ClientIP(r *http.Request) string {
+	peer, ok := Peer(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !res.IsTrusted(peer) {
+		return peer.String()
+	}
+
+	if res.cloudflare {
+		if addr, ok := parseAddr(r.Header.Get("CF-Connecting-IP")); ok {
+			return addr.String()
+		}
+	}
+	if chain := forwardedFor(r.Header.Values("Forwarded")); len(chain) > 0 {
+		return res.fromChain(chain).String()
+	}
+	if chain := xForwardedFor(r.Header.Values("X-Forwarded-For")); len(chain) > 0 {
+		return res.fromChain(chain).String()
+	}
+	return peer.String()
+}
+
+// fromChain walks the hops from the closest to the farthest and returns the
+// first one that isn't a trusted proxy; anything before it could be forged
+func (res *Resolver) fromChain(chain []netip.Addr) netip.Addr {
+	for i := len(chain) - 1; i > 0; i-- {
+		if !res.IsTrusted(chain[i]) {
+			return chain[i]
+		}
+	}
+	return chain[0]
+}
+
+// parseAddr accepts an address with optional port and IPv6 brackets
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return netip.Addr{}, false
+	}
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func xForwardedFor(values []string) []netip.Addr {
+	var chain []netip.Addr
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			addr, ok := parseAddr(hop)
+			if !ok {
+				return nil // A malformed chain can't be trusted at all
+			}
+			chain = append(chain, addr)
+		}
+	}
+	return chain
+}
+
+// forwardedFor extracts the for= parameters of RFC 7239 Forwarded headers
+func forwardedFor(values []string) []netip.Addr {
+	var chain []netip.Addr
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				addr, ok := parseAddr(strings.Trim(val, `"`))
+				if !ok {
+					return nil // "unknown" or obfuscated identifiers
+				}
+				chain = append(chain, addr)
+			}
+		}
+	}
+	return chain
+}
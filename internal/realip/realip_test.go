@@ -0,0 +1,81 @@
+package realip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	res, err := NewResolver([]string{"10.0.0.0/8", "2001:db8:ffff::/48", "192.0.2.1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloudflare, err := NewResolver([]string{"10.0.0.0/8"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		res      *Resolver
+		peer     string
+		headers  map[string]string
+		clientIP string
+	}{
+		{"no headers", res, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"untrusted peer", res, "198.51.100.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "198.51.100.1"},
+		{"single address proxy", res, "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"xff", res, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"xff past trusted hops", res, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.7, 10.1.1.1"}, "198.51.100.7"},
+		{"xff forged first hop", res, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "127.0.0.1, 203.0.113.9"}, "203.0.113.9"},
+		{"xff all trusted", res, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.2.2.2, 10.1.1.1"}, "10.2.2.2"},
+		{"xff with ports", res, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9:5555"}, "203.0.113.9"},
+		{"xff malformed", res, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9, nonsense"}, "10.0.0.1"},
+		{"xff ipv6", res, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "2001:db8::1"}, "2001:db8::1"},
+		{"xff bracketed ipv6", res, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "[2001:db8::1]:443"}, "2001:db8::1"},
+		{"xff mapped ipv4", res, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "::ffff:203.0.113.9"}, "203.0.113.9"},
+		{"ipv6 peer", res, "[2001:db8:ffff::1]:1234", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"untrusted ipv6 peer", res, "[2001:db8::2]:1234", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "2001:db8::2"},
+		{"mapped peer", res, "[::ffff:10.0.0.1]:1234", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"forwarded", res, "10.0.0.1:1234", map[string]string{"Forwarded": "for=203.0.113.9;proto=https"}, "203.0.113.9"},
+		{"forwarded ipv6", res, "10.0.0.1:1234", map[string]string{"Forwarded": `for="[2001:db8::1]:4711"`}, "2001:db8::1"},
+		{"forwarded chain", res, "10.0.0.1:1234", map[string]string{"Forwarded": "for=203.0.113.9, For=198.51.100.7;by=10.0.0.1, for=10.1.1.1"}, "198.51.100.7"},
+		{"forwarded before xff", res, "10.0.0.1:1234", map[string]string{"Forwarded": "for=203.0.113.9", "X-Forwarded-For": "198.51.100.7"}, "203.0.113.9"},
+		{"forwarded unknown", res, "10.0.0.1:1234", map[string]string{"Forwarded": "for=unknown", "X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"cloudflare header ignored", res, "10.0.0.1:1234", map[string]string{"CF-Connecting-IP": "203.0.113.9", "X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"cloudflare", cloudflare, "10.0.0.1:1234", map[string]string{"CF-Connecting-IP": "203.0.113.9", "X-Forwarded-For": "198.51.100.7"}, "203.0.113.9"},
+		{"cloudflare untrusted peer", cloudflare, "198.51.100.1:1234", map[string]string{"CF-Connecting-IP": "203.0.113.9"}, "198.51.100.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = test.peer
+			for name, value := range test.headers {
+				r.Header.Set(name, value)
+			}
+			if ip := test.res.ClientIP(r); ip != test.clientIP {
+				t.Errorf("ClientIP = %s, want %s", ip, test.clientIP)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	res, err := NewResolver([]string{"10.0.0.0/8"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if ip := FromRequest(r); ip != "10.0.0.1" {
+		t.Errorf("FromRequest without the middleware = %s, want the peer", ip)
+	}
+	var ip string
+	res.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip = FromRequest(r)
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if ip != "203.0.113.9" {
+		t.Errorf("FromRequest = %s, want 203.0.113.9", ip)
+	}
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"codeserver/internal/admin"
+	"codeserver/internal/audit"
+	"codeserver/internal/auth"
+	"codeserver/internal/database"
+	"codeserver/internal/metrics"
+	"codeserver/internal/migrate"
+	"codeserver/internal/realip"
+	"codeserver/internal/storage"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Config holds everything a Server is built from. The databases and the blob
+// store are passed in, so tests can use in-memory SQLite and a fake store.
+type Config struct {
+	AuditDB *database.DB     // nil only logs audit events
+	Clock   func() time.Time // Default time.Now
+	// Auth and Storage configure the services, their Audit, Clock and the
+	// account hooks are filled in by NewServer
+	Auth           auth.Config
+	Storage        storage.Config
+	AuditRetention time.Duration // Zero keeps events forever
+	// AutoMigrate applies pending migrations on start, without it the
+	// server refuses to start until they were applied with codeserver migrate
+	AutoMigrate bool
+	// MaxBodySize limits the bodies of API requests, uploads are limited by
+	// Storage.MaxUploadSize. Zero is unlimited.
+	MaxBodySize int64
+	// TransferTimeout replaces the read and write timeouts of the HTTP
+	// server for uploads and downloads, zero is unlimited
+	TransferTimeout time.Duration
+	// TrustedProxies may set the forwarding headers that name the client
+	// address, Cloudflare adds CF-Connecting-IP (see realip.NewResolver)
+	TrustedProxies []string
+	Cloudflare     bool
+	// MetricsToken serves the metrics at /metrics to requests bearing it,
+	// empty doesn't serve them
+	MetricsToken string
+}
+
+// Server is the HTTP API with all of its services
+type Server struct {
+	auth    *auth.Service
+	storage *storage.Service
+	admin   *admin.API
+	dbs     []*database.DB // Closed by Close
+	realIP  *realip.Resolver
+	metrics *prometheus.Registry
+
+	maxBodySize     int64
+	transferTimeout time.Duration
+	metricsToken    string
+}
+
+func NewServer(config Config) (*Server, error) {
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+	realIP, err := realip.NewResolver(config.TrustedProxies, config.Cloudflare)
+	if err != nil {
+		return nil, err
+	}
+
+	storageSchemas := storage.Schemas
+	if config.Storage.Shared {
+		storageSchemas = storage.SharedSchemas
+	}
+	// Auth comes first, a shared storage schema references its users
+	for _, db := range []struct {
+		conn    *database.DB
+		schemas map[database.Dialect]migrate.Schema
+	}{
+		{config.Auth.DB, auth.Schemas},
+		{config.Storage.DB, storageSchemas},
+		{config.AuditDB, audit.Schemas},
+	} {
+		if db.conn == nil {
+			continue
+		}
+		if err := prepareSchema(db.conn, db.schemas[db.conn.Dialect], config.AutoMigrate); err != nil {
+			return nil, err
+		}
+	}
+
+	var auditLog *audit.Log
+	if config.AuditDB != nil {
+		auditLog = audit.New(config.AuditDB, config.Clock)
+		auditLog.SetRetention(config.AuditRetention)
+	}
+
+	storageConfig := config.Storage
+	storageConfig.Audit = auditLog
+	storageConfig.Clock = config.Clock
+	storageService, err := storage.New(storageConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	authConfig := config.Auth
+	authConfig.Audit = auditLog
+	authConfig.Clock = config.Clock
+	// Objects in a separate database are owned by username, keep them in sync
+	// with the accounts. In a shared one only deletions reach the blobs.
+	authConfig.Hooks = auth.AccountHooks{
+		RenameUser: storageService.RenameOwner,
+		DeleteUser: storageService.DeleteOwner,
+	}
+	authService, err := auth.New(authConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		auth:    authService,
+		storage: storageService,
+		admin:   admin.New(authService, storageService, auditLog),
+		realIP:  realIP,
+
+		maxBodySize:     config.MaxBodySize,
+		transferTimeout: config.TransferTimeout,
+		metricsToken:    config.MetricsToken,
+	}
+	for _, db := range []*database.DB{config.Auth.DB, config.Storage.DB, config.AuditDB} {
+		if db != nil && !slices.Contains(server.dbs, db) {
+			server.dbs = append(server.dbs, db)
+		}
+	}
+	server.metrics = metrics.NewRegistry(metrics.State{
+		Sessions: authService.SessionCount,
+		ObjectsPerUser: func() ([]int, error) {
+			usage, err := storageService.Usage()
+			counts := make([]int, len(usage))
+			for i, u := range usage {
+				counts[i] = u.Objects
+			}
+			return counts, err
+		},
+	})
+	return server, nil
+}
+
+// Drain refuses new uploads, requests in flight and all others are still
+// served. It is called when the HTTP server starts shutting down.
+func (s *Server) Drain() {
+	s.storage.Drain()
+}
+
+// Close aborts the uploads still in flight, waiting for them until ctx is
+// done, and closes the databases. The HTTP server has to be shut down
+// first.
+func (s *Server) Close(ctx context.Context) error {
+	err := s.storage.AbortUploads(ctx)
+	for _, db := range s.dbs {
+		err = errors.Join(err, db.Close())
+	}
+	return err
+}
+
+// prepareSchema applies pending migrations if auto is set and makes sure the
+// schema is current. A schema newer than the server is always refused.
+func prepareSchema(db *database.DB, schema migrate.Schema, auto bool) error {
+	ctx := context.Background()
+	if auto {
+		applied, err := migrate.Up(ctx, db, schema, 0)
+		for _, m := range applied {
+			slog.Info("migration applied", "schema", schema.Name, "version", m.Version, "name", m.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return migrate.Check(ctx, db, schema)
+}
+
+// Handler returns the routes of the server
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("pong"))
+	})
+	if s.metricsToken != "" {
+		mux.Handle("GET /metrics", s.MetricsHandler(s.metricsToken))
+	}
+	limit := limitBody(s.maxBodySize)
+	transfer := transferDeadline(s.transferTimeout)
+	handle(mux, "/auth/", http.StripPrefix("/auth", route("/auth", s.auth.Handler())), limit)
+	handle(mux, "/storage/", http.StripPrefix("/storage", route("/storage", s.storage.StorageHandler())), transfer, s.authMiddleware)
+	// Anonymous uploads keep the read timeout of the server, unauthenticated
+	// clients mustn't hold connections for the transfer timeout
+	anonymous := http.StripPrefix("/anonymous", route("/anonymous", s.storage.AnonymousHandler()))
+	handle(mux, "POST /anonymous/upload", anonymous)
+	handle(mux, "/anonymous/", anonymous, transfer)
+	handle(mux, "/admin/", http.StripPrefix("/admin", route("/admin", s.admin.Handler())), limit, s.authMiddleware, adminMiddleware)
+	return requestID(s.realIP.Middleware(accessLog(stripIdentity(route("", mux)))))
+}
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"bytes"
+	"codeserver/internal/auth"
+	"codeserver/internal/database"
+	"codeserver/internal/storage"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// memBlob keeps the object contents in memory
+type memBlob struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (b *memBlob) GetObject(ctx context.Context, key string) (*s3.GetObjectOutput, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(b.objects[key]))}, nil
+}
+
+func (b *memBlob) UploadStream(ctx context.Context, key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = data
+	return nil
+}
+
+func (b *memBlob) UploadMultipart(ctx context.Context, key string, r io.Reader, partSize int64) error {
+	return b.UploadStream(ctx, key, r)
+}
+
+func (b *memBlob) Copy(ctx context.Context, srcKey, dstKey string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[dstKey] = b.objects[srcKey]
+	return nil
+}
+
+func (b *memBlob) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, key)
+	return nil
+}
+
+// newTestServer serves a Server on SQLite databases in a temporary directory,
+// requests from the test client come from the trusted proxy 127.0.0.1
+func newTestServer(t *testing.T) (*httptest.Server, *database.DB) {
+	t.Helper()
+	server, auditDB := newServer(t)
+	ts := httptest.NewServer(server.Handler())
+	t.Cleanup(ts.Close)
+	return ts, auditDB
+}
+
+// newServer returns a Server like the one of newTestServer for tests which
+// serve it themselves
+func newServer(t *testing.T) (*Server, *database.DB) {
+	t.Helper()
+	dir := t.TempDir()
+	open := func(name string) *database.DB {
+		db, err := database.Open(filepath.Join(dir, name+".db"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Name = name
+		return db
+	}
+	auditDB := open("audit")
+	server, err := NewServer(Config{
+		AuditDB:         auditDB,
+		Auth:            auth.Config{DB: open("auth"), TokenSecret: "test secret"},
+		Storage:         storage.Config{DB: open("storage"), Blob: &memBlob{objects: map[string][]byte{}}},
+		AutoMigrate:     true,
+		TrustedProxies:  []string{"127.0.0.1"},
+		MetricsToken:    "metrics token",
+		TransferTimeout: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close(context.Background()) })
+	return server, auditDB
+}
+
+func TestHandler(t *testing.T) {
+	ts, auditDB := newTestServer(t)
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	file, _ := form.CreateFormFile("file", "hello.txt")
+	file.Write([]byte("hello"))
+	form.Close()
+	req, _ := http.NewRequest("POST", ts.URL+"/anonymous/upload", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	req.Header.Set("X-Request-ID", "test-request")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uploaded struct{ UID string }
+	json.NewDecoder(resp.Body).Decode(&uploaded)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || uploaded.UID == "" {
+		t.Fatalf("upload: %d %+v", resp.StatusCode, uploaded)
+	}
+	if id := resp.Header.Get("X-Request-ID"); id != "test-request" {
+		t.Errorf("X-Request-ID = %q, want the one of the request", id)
+	}
+	// The audit event has the client address the trusted proxy forwarded
+	var ip string
+	if err := auditDB.QueryRow("SELECT ip FROM events WHERE subject = ?", uploaded.UID).Scan(&ip); err != nil {
+		t.Fatal(err)
+	}
+	if ip != "203.0.113.9" {
+		t.Errorf("audited IP = %s, want the forwarded one", ip)
+	}
+
+	resp, err = http.Get(ts.URL + "/anonymous/download?key=" + uploaded.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(content) != "hello" {
+		t.Errorf("download: %d %q", resp.StatusCode, content)
+	}
+
+	resp, err = http.Get(ts.URL + "/storage/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("list without a session: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("metrics without the token: %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest("GET", ts.URL+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer metrics token")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, metric := range []string{
+		"codeserver_auth_sessions 0",
+		`codeserver_http_requests_total{method="POST",route="/anonymous/upload",status="200"}`,
+		"codeserver_storage_objects_per_user_count 1",
+	} {
+		if !strings.Contains(string(content), metric) {
+			t.Errorf("metrics lack %s", metric)
+		}
+	}
+}
+
+// slowReader sends its content after a delay
+type slowReader struct {
+	delay   time.Duration
+	content io.Reader
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	r.delay = 0
+	return r.content.Read(p)
+}
+
+func TestAnonymousUploadTimeout(t *testing.T) {
+	server, _ := newServer(t)
+	ts := httptest.NewUnstartedServer(server.Handler())
+	ts.Config.ReadTimeout = 100 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	file, _ := form.CreateFormFile("file", "slow.txt")
+	file.Write([]byte("slow"))
+	form.Close()
+	req, _ := http.NewRequest("POST", ts.URL+"/anonymous/upload", &slowReader{delay: 500 * time.Millisecond, content: body})
+	req.ContentLength = int64(body.Len())
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Error("anonymous upload outlasted the read timeout")
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"codeserver/internal/audit"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+)
+
+// RenameOwner moves every object of a user to the new username, both the rows
+// and the R2 keys which are prefixed with the username (see r2path). Objects
+// are copied first so a failure leaves the old state intact; the old keys are
+// only deleted once the rows point to the copies. In a shared database the
+// objects reference the user by ID and nothing has to move.
+func (s *Service) RenameOwner(ctx context.Context, oldUsername, newUsername string) error {
+	if s.shared {
+		return nil
+	}
+	objs, err := s.store.List(oldUsername)
+	if err != nil {
+		return err
+	}
+
+	paths := make(map[string]string, len(objs))
+	for _, obj := range objs {
+		newPath := newUsername + strings.TrimPrefix(obj.Path, oldUsername)
+		if err := s.blob.Copy(ctx, obj.Path, newPath); err != nil {
+			s.discardCopies(paths)
+			return err
+		}
+		paths[obj.ID] = newPath
+	}
+
+	if err := s.store.RenameOwner(oldUsername, newUsername, paths); err != nil {
+		s.discardCopies(paths)
+		return err
+	}
+
+	for _, obj := range objs {
+		if err := s.blob.Delete(context.Background(), obj.Path); err != nil {
+			slog.ErrorContext(ctx, "deleting renamed object failed", "path", obj.Path, "error", err)
+		}
+	}
+	slog.InfoContext(ctx, "objects moved to new owner", "count", len(objs), "old_username", oldUsername, "username", newUsername)
+	return nil
+}
+
+// discardCopies removes objects copied by an aborted rename
+func (s *Service) discardCopies(paths map[string]string) {
+	for _, path := range paths {
+		if err := s.blob.Delete(context.Background(), path); err != nil {
+			slog.Error("deleting object copy failed", "path", path, "error", err)
+		}
+	}
+}
+
+// DeleteOwner removes every object of a user from R2 and the database. It
+// keeps going past failures; rows are only removed once their blob is gone,
+// so calling it again retries the rest.
+func (s *Service) DeleteOwner(ctx context.Context, username string) error {
+	objs, err := s.store.List(username)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	deleted := 0
+	for _, obj := range objs {
+		if err := s.blob.Delete(ctx, obj.Path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := s.store.Remove(obj.ID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		deleted++
+		s.audit.Record(audit.Event{
+			Type:     audit.Delete,
+			Actor:    username,
+			Username: username,
+			Subject:  obj.ID,
+			Success:  true,
+			Detail:   "path=" + obj.Filename + " reason=account deleted",
+		})
+	}
+	slog.InfoContext(ctx, "objects of owner deleted", "count", deleted, "failed", len(errs), "username", username)
+	return errors.Join(errs...)
+}
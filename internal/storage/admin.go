@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+var ErrObjectNotFound = errors.New("object not found")
+
+// ListObjects returns objects of any owner, username narrows the result to
+// one owner and query matches filenames or the exact ID
+func (s *Service) ListObjects(username, query string, limit, offset int) ([]Object, error) {
+	return s.store.Search(username, query, limit, offset)
+}
+
+// DeleteObject removes an object from R2 and the database regardless of owner
+// and returns what was deleted
+func (s *Service) DeleteObject(ctx context.Context, id string) (*Object, error) {
+	obj, err := s.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, ErrObjectNotFound
+	}
+	if err := s.blob.Delete(ctx, obj.Path); err != nil {
+		return nil, err
+	}
+	if err := s.store.Remove(obj.ID); err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "object deleted", "id", obj.ID, "username", obj.Username)
+	return obj, nil
+}
+
+// Usage returns the number of objects and bytes stored per owner
+func (s *Service) Usage() ([]OwnerUsage, error) {
+	return s.store.Usage()
+}
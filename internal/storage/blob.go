@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Blob is the object store holding the file contents, *r2.Client in
+// production
+type Blob interface {
+	GetObject(ctx context.Context, key string) (*s3.GetObjectOutput, error)
+	UploadStream(ctx context.Context, key string, r io.Reader) error
+	UploadMultipart(ctx context.Context, key string, r io.Reader, partSize int64) error
+	Copy(ctx context.Context, srcKey, dstKey string) error
+	Delete(ctx context.Context, key string) error
+}
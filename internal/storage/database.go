@@ -1,8 +1,10 @@
 package storage
 
 import (
-	"database/sql"
-	"log"
+	"codeserver/internal/database"
+	"codeserver/internal/migrate"
+	"embed"
+	"strings"
 	"time"
 )
 
@@ -13,79 +15,51 @@ type Object struct {
 	Password  string `json:"password"`
 	Path      string `json:"path"`
 	CreatedAt string `json:"created_at"`
+	Size      int64  `json:"size"`
 }
 
-type dbStruct struct {
-	db *sql.DB
-}
-
-var db dbStruct
-
-func dbInit(tursoURL, tursoToken string, dev bool) {
-	if dev {
-		_db, err := sql.Open("sqlite", "file:storage.db?cache=shared")
-		if err != nil {
-			panic(err)
-		}
-		db = dbStruct{db: _db}
-		err = createTable()
-		if err != nil {
-			panic(err)
-		}
-		return
-	}
+// AnonymousOwner is the username of anonymous uploads. It is reserved by
+// auth, in a shared database such objects have no owner row.
+const AnonymousOwner = "anon"
 
-	conn := tursoURL + "?authToken=" + tursoToken
+//go:embed migrations
+var migrations embed.FS
 
-	_db, err := sql.Open("libsql", conn)
-	if err != nil {
-		panic(err)
-	}
+// Schemas are the migrations of the objects table for every dialect
+var Schemas = migrate.MustLoadDialects("storage", migrations, "migrations")
 
-	db = dbStruct{db: _db}
-	err = createTable()
-	if err != nil {
-		panic(err)
-	}
+// Store keeps the metadata of the objects. NewStore returns the one for SQL
+// databases, every implementation has to pass storetest.Storage.
+type Store interface {
+	// List returns the objects of the user
+	List(username string) ([]Object, error)
+	Insert(id, username, filename, password, path string, size int64, createdAt time.Time) error
+	// Get and GetByUsernamePath return nil if there is no such object
+	Get(id string) (*Object, error)
+	GetByUsernamePath(username, filename string) (*Object, error)
+	// RenameOwner moves the objects in paths, a map of object ID to new
+	// path, from one owner to the other
+	RenameOwner(oldUsername, newUsername string, paths map[string]string) error
+	Remove(id string) error
+	// Search returns objects whose filename contains query ignoring case or
+	// whose ID is query, of one owner unless username is empty, newest first
+	Search(username, query string, limit, offset int) ([]Object, error)
+	// Usage returns the storage used per owner, largest first
+	Usage() ([]OwnerUsage, error)
 }
 
-func createTable() error {
-	query := `
-        CREATE TABLE IF NOT EXISTS objects (
-            id VARCHAR(255) NOT NULL PRIMARY KEY,
-			username VARCHAR(255) NOT NULL,
-			filename VARCHAR(255),           -- Object's filename, directory is separated by slashes
-			password VARCHAR(255),
-            path VARCHAR(255) UNIQUE,        -- Path in R2 object storage
-            created_at VARCHAR(255),
-            UNIQUE (username, filename)
-	)`
-
-	_, err := db.db.Exec(query)
-	return err
+// sqlStore is the Store of every SQL database
+type sqlStore struct {
+	db *database.DB
 }
 
-func showAll() ([]Object, error) {
-	query := "SELECT id, username, filename, password, path, created_at FROM objects"
-	rows, err := db.db.Query(query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var objs []Object
-	for rows.Next() {
-		obj := Object{}
-		err := rows.Scan(&obj.ID, &obj.Username, &obj.Filename, &obj.Password, &obj.Path, &obj.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		objs = append(objs, obj)
-	}
-	log.Print(objs)
-	return objs, nil
+// NewStore returns the Store kept in db, which has to be migrated to
+// Schemas[db.Dialect]
+func NewStore(db *database.DB) Store {
+	return &sqlStore{db: db}
 }
 
-func show(username string) ([]Object, error) {
+func (db *sqlStore) List(username string) ([]Object, error) {
 	query := "SELECT id, username, filename, password, path, created_at FROM objects WHERE username = ?"
 	rows, err := db.db.Query(query, username)
 	if err != nil {
@@ -95,7 +69,7 @@ func show(username string) ([]Object, error) {
 	var objs []Object
 	for rows.Next() {
 		obj := Object{}
-		err := rows.Scan(&obj.ID, &obj.Username, &obj.Filename, &obj.Password, &obj.Path, &obj.CreatedAt)
+		err := rows.Scan(&obj.ID, &obj.Username, &obj.Filename, &obj.Password, &obj.Path, database.Timestamp(&obj.CreatedAt))
 		if err != nil {
 			return nil, err
 		}
@@ -104,13 +78,13 @@ func show(username string) ([]Object, error) {
 	return objs, nil
 }
 
-func insert(id, user, filename, password, path string) error {
-	query := "INSERT INTO objects (id, username, filename, password, path, created_at) VALUES (?, ?, ?, ?, ?, ?)"
-	_, err := db.db.Exec(query, id, user, filename, password, path, time.Now().Format(time.RFC3339))
+func (db *sqlStore) Insert(id, user, filename, password, path string, size int64, createdAt time.Time) error {
+	query := "INSERT INTO objects (id, username, filename, password, path, created_at, size) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err := db.db.Exec(query, id, user, filename, password, path, createdAt.UnixMilli(), size)
 	return err
 }
 
-func get(id string) (*Object, error) {
+func (db *sqlStore) Get(id string) (*Object, error) {
 	query := "SELECT id, username, filename, password, path FROM objects WHERE id = ?"
 	row := db.db.QueryRow(query, id)
 	obj := &Object{}
@@ -124,9 +98,9 @@ func get(id string) (*Object, error) {
 	return obj, nil
 }
 
-// getByUsernamePath returns the object with given username and path.
+// GetByUsernamePath returns the object with given username and path.
 // The path here refers to the `filename` field that is stored in the db
-func getByUsernamePath(username, path string) (*Object, error) {
+func (db *sqlStore) GetByUsernamePath(username, path string) (*Object, error) {
 	query := "SELECT id, username, filename, password, path FROM objects WHERE username = ? AND filename = ?"
 	row := db.db.QueryRow(query, username, path)
 	obj := &Object{}
@@ -139,3 +113,73 @@ func getByUsernamePath(username, path string) (*Object, error) {
 	}
 	return obj, nil
 }
+
+// RenameOwner moves all rows of a user to the new username; paths maps each
+// object ID to its new R2 path
+func (db *sqlStore) RenameOwner(oldUsername, newUsername string, paths map[string]string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, path := range paths {
+		query := "UPDATE objects SET username = ?, path = ? WHERE id = ? AND username = ?"
+		if _, err := tx.Exec(query, newUsername, path, id, oldUsername); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *sqlStore) Remove(id string) error {
+	_, err := db.db.Exec("DELETE FROM objects WHERE id = ?", id)
+	return err
+}
+
+// Search returns objects whose filename contains query, newest first
+func (db *sqlStore) Search(username, query string, limit, offset int) ([]Object, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+	rows, err := db.db.Query(`
+		SELECT id, username, filename, password, path, created_at, size FROM objects
+		WHERE (CAST(? AS TEXT) = '' OR username = ?) AND (filename `+db.db.Dialect.ILike()+` ? ESCAPE '\' OR id = ?)
+		ORDER BY created_at DESC LIMIT ? OFFSET ?`,
+		username, username, pattern, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	objs := []Object{}
+	for rows.Next() {
+		obj := Object{}
+		err := rows.Scan(&obj.ID, &obj.Username, &obj.Filename, &obj.Password, &obj.Path, database.Timestamp(&obj.CreatedAt), &obj.Size)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// OwnerUsage is the storage used by one owner
+type OwnerUsage struct {
+	Username string `json:"username"`
+	Objects  int    `json:"objects"`
+	Bytes    int64  `json:"bytes"`
+}
+
+func (db *sqlStore) Usage() ([]OwnerUsage, error) {
+	rows, err := db.db.Query("SELECT username, COUNT(*), CAST(COALESCE(SUM(size), 0) AS BIGINT) FROM objects GROUP BY username ORDER BY 3 DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usages := []OwnerUsage{}
+	for rows.Next() {
+		u := OwnerUsage{}
+		if err := rows.Scan(&u.Username, &u.Objects, &u.Bytes); err != nil {
+			return nil, err
+		}
+		usages = append(usages, u)
+	}
+	return usages, nil
+}
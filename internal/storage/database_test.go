@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"codeserver/internal/database"
+	"codeserver/internal/migrate"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// baselineSchema is what the last release without migrations created
+const baselineSchema = `
+	CREATE TABLE IF NOT EXISTS objects (
+		id VARCHAR(255) NOT NULL PRIMARY KEY,
+		username VARCHAR(255) NOT NULL,
+		filename VARCHAR(255),           -- Object's filename, directory is separated by slashes
+		password VARCHAR(255),
+		path VARCHAR(255) UNIQUE,        -- Path in R2 object storage
+		created_at VARCHAR(255),
+		UNIQUE (username, filename)
+	)`
+
+func TestMigrateBaseline(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Open(filepath.Join(t.TempDir(), "storage.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, query := range []string{
+		baselineSchema,
+		"INSERT INTO objects VALUES ('abc', 'ann', 'notes.txt', '', 'abc/notes.txt', '2024-05-01T10:00:00Z')",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	schema := Schemas[database.SQLite]
+	if _, err := migrate.Up(ctx, db, schema, 0); err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(db)
+	objs, err := store.List("ann")
+	if err != nil || len(objs) != 1 {
+		t.Fatalf("objects: %v, %v", objs, err)
+	}
+	if obj := objs[0]; obj.ID != "abc" || obj.Path != "abc/notes.txt" || obj.CreatedAt != "2024-05-01T10:00:00Z" {
+		t.Errorf("object %+v", obj)
+	}
+	var size int64
+	if err := db.QueryRow("SELECT size FROM objects WHERE id = 'abc'").Scan(&size); err != nil || size != 0 {
+		t.Errorf("size of an old object: %d, %v", size, err)
+	}
+	if err := store.Insert("def", "ann", "new.txt", "", "def/new.txt", 42, time.Now()); err != nil {
+		t.Errorf("insert after migrating: %v", err)
+	}
+
+	// Every later migration can be reverted to the baseline and applied again
+	if _, err := migrate.Down(ctx, db, schema, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrate.Up(ctx, db, schema, 0); err != nil {
+		t.Fatal(err)
+	}
+	objs, err = store.List("ann")
+	if err != nil || len(objs) != 2 {
+		t.Fatalf("after down and up: %v, %v", objs, err)
+	}
+	for _, obj := range objs {
+		if obj.ID == "abc" && obj.CreatedAt != "2024-05-01T10:00:00Z" {
+			t.Errorf("after down and up: %+v", obj)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+-- Postgres starts at the current schema, created_at is Unix time in
+-- milliseconds like in SQLite after 0002_integer_timestamps
+CREATE TABLE objects (
+    id VARCHAR(255) NOT NULL PRIMARY KEY,
+    username VARCHAR(255) NOT NULL,
+    filename VARCHAR(255) NOT NULL,  -- Object's filename, directory is separated by slashes
+    password VARCHAR(255) NOT NULL DEFAULT '',
+    path VARCHAR(255) NOT NULL UNIQUE, -- Path in R2 object storage
+    created_at BIGINT NOT NULL DEFAULT 0,
+    size BIGINT NOT NULL DEFAULT 0,
+    UNIQUE (username, filename)
+);
+CREATE INDEX objects_created_at ON objects (created_at);
@@ -0,0 +1,13 @@
+-- Objects in a database shared with auth belong to a row of its users table,
+-- so renaming a user doesn't touch them and deleting one deletes them.
+CREATE TABLE objects (
+    id VARCHAR(255) NOT NULL PRIMARY KEY,
+    owner_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    filename VARCHAR(255) NOT NULL,  -- Object's filename, directory is separated by slashes
+    password VARCHAR(255) NOT NULL DEFAULT '',
+    path VARCHAR(255) NOT NULL UNIQUE, -- Path in R2 object storage
+    created_at BIGINT NOT NULL DEFAULT 0,
+    size BIGINT NOT NULL DEFAULT 0,
+    UNIQUE (owner_id, filename)
+);
+CREATE INDEX objects_created_at ON objects (created_at);
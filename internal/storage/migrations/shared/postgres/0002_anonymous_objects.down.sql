@@ -0,0 +1,3 @@
+DROP INDEX objects_anonymous_filename;
+DELETE FROM objects WHERE owner_id IS NULL;
+ALTER TABLE objects ALTER COLUMN owner_id SET NOT NULL;
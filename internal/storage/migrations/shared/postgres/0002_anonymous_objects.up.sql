@@ -0,0 +1,4 @@
+-- Anonymous uploads have no row in users, their owner_id is NULL
+ALTER TABLE objects ALTER COLUMN owner_id DROP NOT NULL;
+-- UNIQUE (owner_id, filename) doesn't cover NULL owners
+CREATE UNIQUE INDEX objects_anonymous_filename ON objects (filename) WHERE owner_id IS NULL;
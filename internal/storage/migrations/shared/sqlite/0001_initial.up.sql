@@ -0,0 +1,14 @@
+-- Objects in a database shared with auth belong to a row of its users table,
+-- so renaming a user doesn't touch them. The foreign key is enforced by the
+-- triggers of 0002_owner_triggers.
+CREATE TABLE objects (
+    id VARCHAR(255) NOT NULL PRIMARY KEY,
+    owner_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    filename VARCHAR(255) NOT NULL,  -- Object's filename, directory is separated by slashes
+    password VARCHAR(255) NOT NULL DEFAULT '',
+    path VARCHAR(255) NOT NULL UNIQUE, -- Path in R2 object storage
+    created_at INTEGER NOT NULL DEFAULT 0,
+    size INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (owner_id, filename)
+);
+CREATE INDEX objects_created_at ON objects (created_at);
@@ -0,0 +1,3 @@
+DROP TRIGGER users_delete_objects;
+DROP TRIGGER objects_owner_update;
+DROP TRIGGER objects_owner_insert;
@@ -0,0 +1,20 @@
+-- SQLite only enforces the foreign key of owner_id on connections that
+-- enabled it, which the server doesn't since the auth tables rely on it
+-- being off. These triggers enforce it on every connection. Rebuilding users
+-- drops them, such a migration has to create them again.
+CREATE TRIGGER objects_owner_insert BEFORE INSERT ON objects
+WHEN NOT EXISTS (SELECT 1 FROM users WHERE id = NEW.owner_id)
+BEGIN
+    SELECT RAISE(ABORT, 'FOREIGN KEY constraint failed');
+END;
+
+CREATE TRIGGER objects_owner_update BEFORE UPDATE OF owner_id ON objects
+WHEN NOT EXISTS (SELECT 1 FROM users WHERE id = NEW.owner_id)
+BEGIN
+    SELECT RAISE(ABORT, 'FOREIGN KEY constraint failed');
+END;
+
+CREATE TRIGGER users_delete_objects AFTER DELETE ON users
+BEGIN
+    DELETE FROM objects WHERE owner_id = OLD.id;
+END;
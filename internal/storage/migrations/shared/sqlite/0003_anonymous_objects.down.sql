@@ -0,0 +1,34 @@
+-- Anonymous objects can't be kept with a NOT NULL owner
+DROP TRIGGER users_delete_objects;
+CREATE TABLE objects_old (
+    id VARCHAR(255) NOT NULL PRIMARY KEY,
+    owner_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    filename VARCHAR(255) NOT NULL,
+    password VARCHAR(255) NOT NULL DEFAULT '',
+    path VARCHAR(255) NOT NULL UNIQUE,
+    created_at INTEGER NOT NULL DEFAULT 0,
+    size INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (owner_id, filename)
+);
+INSERT INTO objects_old (id, owner_id, filename, password, path, created_at, size)
+    SELECT id, owner_id, filename, password, path, created_at, size FROM objects WHERE owner_id IS NOT NULL;
+DROP TABLE objects;
+ALTER TABLE objects_old RENAME TO objects;
+CREATE INDEX objects_created_at ON objects (created_at);
+
+CREATE TRIGGER objects_owner_insert BEFORE INSERT ON objects
+WHEN NOT EXISTS (SELECT 1 FROM users WHERE id = NEW.owner_id)
+BEGIN
+    SELECT RAISE(ABORT, 'FOREIGN KEY constraint failed');
+END;
+
+CREATE TRIGGER objects_owner_update BEFORE UPDATE OF owner_id ON objects
+WHEN NOT EXISTS (SELECT 1 FROM users WHERE id = NEW.owner_id)
+BEGIN
+    SELECT RAISE(ABORT, 'FOREIGN KEY constraint failed');
+END;
+
+CREATE TRIGGER users_delete_objects AFTER DELETE ON users
+BEGIN
+    DELETE FROM objects WHERE owner_id = OLD.id;
+END;
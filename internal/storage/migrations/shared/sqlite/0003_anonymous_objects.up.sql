@@ -0,0 +1,37 @@
+-- Anonymous uploads have no row in users, their owner_id is NULL. SQLite
+-- can't drop NOT NULL, so objects is rebuilt, which drops its triggers.
+DROP TRIGGER users_delete_objects;
+CREATE TABLE objects_new (
+    id VARCHAR(255) NOT NULL PRIMARY KEY,
+    owner_id INTEGER REFERENCES users(id) ON DELETE CASCADE, -- NULL for anonymous uploads
+    filename VARCHAR(255) NOT NULL,  -- Object's filename, directory is separated by slashes
+    password VARCHAR(255) NOT NULL DEFAULT '',
+    path VARCHAR(255) NOT NULL UNIQUE, -- Path in R2 object storage
+    created_at INTEGER NOT NULL DEFAULT 0,
+    size INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (owner_id, filename)
+);
+INSERT INTO objects_new (id, owner_id, filename, password, path, created_at, size)
+    SELECT id, owner_id, filename, password, path, created_at, size FROM objects;
+DROP TABLE objects;
+ALTER TABLE objects_new RENAME TO objects;
+CREATE INDEX objects_created_at ON objects (created_at);
+-- UNIQUE (owner_id, filename) doesn't cover NULL owners
+CREATE UNIQUE INDEX objects_anonymous_filename ON objects (filename) WHERE owner_id IS NULL;
+
+CREATE TRIGGER objects_owner_insert BEFORE INSERT ON objects
+WHEN NEW.owner_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM users WHERE id = NEW.owner_id)
+BEGIN
+    SELECT RAISE(ABORT, 'FOREIGN KEY constraint failed');
+END;
+
+CREATE TRIGGER objects_owner_update BEFORE UPDATE OF owner_id ON objects
+WHEN NEW.owner_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM users WHERE id = NEW.owner_id)
+BEGIN
+    SELECT RAISE(ABORT, 'FOREIGN KEY constraint failed');
+END;
+
+CREATE TRIGGER users_delete_objects AFTER DELETE ON users
+BEGIN
+    DELETE FROM objects WHERE owner_id = OLD.id;
+END;
@@ -0,0 +1,11 @@
+-- The schema of the last release without versioned migrations. IF NOT EXISTS
+-- adopts databases created by it, later columns are added by migrations.
+CREATE TABLE IF NOT EXISTS objects (
+    id VARCHAR(255) NOT NULL PRIMARY KEY,
+    username VARCHAR(255) NOT NULL,
+    filename VARCHAR(255),           -- Object's filename, directory is separated by slashes
+    password VARCHAR(255),
+    path VARCHAR(255) UNIQUE,        -- Path in R2 object storage
+    created_at VARCHAR(255),
+    UNIQUE (username, filename)
+);
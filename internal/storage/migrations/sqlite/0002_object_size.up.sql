@@ -0,0 +1,2 @@
+-- Older rows report a size of 0
+ALTER TABLE objects ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
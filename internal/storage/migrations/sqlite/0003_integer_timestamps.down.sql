@@ -0,0 +1,16 @@
+CREATE TABLE objects_old (
+    id VARCHAR(255) NOT NULL PRIMARY KEY,
+    username VARCHAR(255) NOT NULL,
+    filename VARCHAR(255),
+    password VARCHAR(255),
+    path VARCHAR(255) UNIQUE,
+    created_at VARCHAR(255),
+    size INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (username, filename)
+);
+INSERT INTO objects_old
+    SELECT id, username, filename, password, path,
+        strftime('%Y-%m-%dT%H:%M:%SZ', created_at / 1000, 'unixepoch'), size
+    FROM objects;
+DROP TABLE objects;
+ALTER TABLE objects_old RENAME TO objects;
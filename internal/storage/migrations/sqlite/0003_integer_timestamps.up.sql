@@ -0,0 +1,18 @@
+-- RFC 3339 strings become Unix time in milliseconds, 0 where unknown
+CREATE TABLE objects_new (
+    id VARCHAR(255) NOT NULL PRIMARY KEY,
+    username VARCHAR(255) NOT NULL,
+    filename VARCHAR(255),
+    password VARCHAR(255),
+    path VARCHAR(255) UNIQUE,
+    created_at INTEGER NOT NULL DEFAULT 0,
+    size INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (username, filename)
+);
+INSERT INTO objects_new
+    SELECT id, username, filename, password, path,
+        COALESCE(CAST(strftime('%s', created_at) AS INTEGER) * 1000, 0), size
+    FROM objects;
+DROP TABLE objects;
+ALTER TABLE objects_new RENAME TO objects;
+CREATE INDEX objects_created_at ON objects (created_at);
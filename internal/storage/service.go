@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"codeserver/internal/audit"
+	"codeserver/internal/database"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Config holds the dependencies of a Service
+type Config struct {
+	DB *database.DB
+	// Shared is set if DB is shared with auth, objects then reference its
+	// users table instead of holding the username
+	Shared bool
+	Blob   Blob
+	Audit  *audit.Log       // nil only logs events
+	Clock  func() time.Time // Default time.Now
+	// MaxUploadSize limits single uploads in bytes, zero is unlimited
+	MaxUploadSize int64
+	// Uploads larger than MultipartThreshold are sent in parts of PartSize,
+	// defaults 100 MB and 8 MB
+	MultipartThreshold int64
+	PartSize           int64
+}
+
+// Service stores objects: metadata in the database, contents in the blob
+// store
+type Service struct {
+	store  Store
+	shared bool // Objects reference users in the auth database
+	blob   Blob
+	audit  *audit.Log
+	now    func() time.Time
+
+	maxUploadSize      int64
+	multipartThreshold int64
+	partSize           int64
+
+	// Uploads in flight, new ones are refused once draining. Cancelling
+	// abort cancels them all.
+	mu       sync.Mutex
+	draining bool
+	uploads  sync.WaitGroup
+	abort    context.Context
+	cancel   context.CancelFunc
+}
+
+// New returns the service, config.DB has to be migrated to Schemas or
+// SharedSchemas if it is shared
+func New(config Config) (*Service, error) {
+	if config.DB == nil || config.Blob == nil {
+		return nil, errors.New("storage requires a database and a blob store")
+	}
+	s := &Service{
+		store:  NewStore(config.DB),
+		shared: config.Shared,
+		blob:   config.Blob,
+		audit:  config.Audit,
+		now:    config.Clock,
+
+		maxUploadSize:      config.MaxUploadSize,
+		multipartThreshold: config.MultipartThreshold,
+		partSize:           config.PartSize,
+	}
+	s.abort, s.cancel = context.WithCancel(context.Background())
+	if config.Shared {
+		s.store = NewSharedStore(config.DB)
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	if s.multipartThreshold == 0 {
+		s.multipartThreshold = 100 << 20
+	}
+	if s.partSize == 0 {
+		s.partSize = 8 << 20
+	}
+	return s, nil
+}
+
+// Drain refuses new uploads with 503 Service Unavailable, the uploads in
+// flight and everything else are still served
+func (s *Service) Drain() {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+}
+
+// AbortUploads drains the service and cancels the uploads in flight, which
+// aborts their multipart uploads. It waits for them to return or ctx to be
+// done.
+func (s *Service) AbortUploads(ctx context.Context) error {
+	s.Drain()
+	s.cancel()
+	done := make(chan struct{})
+	go func() {
+		s.uploads.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startUpload registers an upload, its context is also cancelled by
+// AbortUploads. ok is false once the service is draining, otherwise finish
+// has to be called when the upload returns.
+func (s *Service) startUpload(ctx context.Context) (_ context.Context, finish func(), ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return nil, nil, false
+	}
+	s.uploads.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.abort, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		s.uploads.Done()
+	}, true
+}
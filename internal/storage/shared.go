@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"codeserver/internal/database"
+	"codeserver/internal/migrate"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrOwnerNotFound is returned when inserting an object for a username that
+// isn't in the users table of a shared database
+var ErrOwnerNotFound = errors.New("owner not found")
+
+// SharedSchemas are the migrations of the objects table in a database shared
+// with auth, which has to be migrated first
+var SharedSchemas = migrate.MustLoadDialects("storage_shared", migrations, "migrations/shared")
+
+// sharedStore is the Store of a database shared with auth. Objects reference
+// their owner by user ID, the username is joined from the users table.
+// Anonymous objects have a NULL owner_id.
+type sharedStore struct {
+	db *database.DB
+}
+
+// NewSharedStore returns the Store kept in db next to the auth tables, which
+// has to be migrated to SharedSchemas[db.Dialect]
+func NewSharedStore(db *database.DB) Store {
+	return &sharedStore{db: db}
+}
+
+const selectShared = `
+	SELECT o.id, COALESCE(u.username, '` + AnonymousOwner + `'), o.filename, o.password, o.path, o.created_at, o.size
+	FROM objects o LEFT JOIN users u ON u.id = o.owner_id`
+
+// ownerIs is the condition on the owner of o for a username argument
+const ownerIs = "COALESCE(u.username, '" + AnonymousOwner + "') = ?"
+
+func (db *sharedStore) query(where string, args ...any) ([]Object, error) {
+	rows, err := db.db.Query(selectShared+" "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	objs := []Object{}
+	for rows.Next() {
+		obj := Object{}
+		err := rows.Scan(&obj.ID, &obj.Username, &obj.Filename, &obj.Password, &obj.Path, database.Timestamp(&obj.CreatedAt), &obj.Size)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+	return objs, rows.Err()
+}
+
+// queryOne returns nil if no object matches
+func (db *sharedStore) queryOne(where string, args ...any) (*Object, error) {
+	objs, err := db.query(where, args...)
+	if err != nil || len(objs) == 0 {
+		return nil, err
+	}
+	return &objs[0], nil
+}
+
+func (db *sharedStore) List(username string) ([]Object, error) {
+	return db.query("WHERE "+ownerIs, username)
+}
+
+func (db *sharedStore) Insert(id, username, filename, password, path string, size int64, createdAt time.Time) error {
+	var ownerID sql.NullInt64
+	if username != AnonymousOwner {
+		err := db.db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&ownerID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOwnerNotFound
+		}
+		if err != nil {
+			return err
+		}
+	}
+	query := "INSERT INTO objects (id, owner_id, filename, password, path, created_at, size) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err := db.db.Exec(query, id, ownerID, filename, password, path, createdAt.UnixMilli(), size)
+	return err
+}
+
+func (db *sharedStore) Get(id string) (*Object, error) {
+	return db.queryOne("WHERE o.id = ?", id)
+}
+
+func (db *sharedStore) GetByUsernamePath(username, filename string) (*Object, error) {
+	return db.queryOne("WHERE "+ownerIs+" AND o.filename = ?", username, filename)
+}
+
+// RenameOwner only moves the paths, the rows follow the users table. The
+// objects are found by the old username, so it has to run before the user
+// is renamed. The service doesn't need it, see r2path.
+func (db *sharedStore) RenameOwner(oldUsername, newUsername string, paths map[string]string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, path := range paths {
+		query := "UPDATE objects SET path = ? WHERE id = ? AND owner_id = (SELECT id FROM users WHERE username = ?)"
+		if _, err := tx.Exec(query, path, id, oldUsername); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *sharedStore) Remove(id string) error {
+	_, err := db.db.Exec("DELETE FROM objects WHERE id = ?", id)
+	return err
+}
+
+func (db *sharedStore) Search(username, query string, limit, offset int) ([]Object, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+	return db.query(`
+		WHERE (CAST(? AS TEXT) = '' OR `+ownerIs+`) AND (o.filename `+db.db.Dialect.ILike()+` ? ESCAPE '\' OR o.id = ?)
+		ORDER BY o.created_at DESC LIMIT ? OFFSET ?`,
+		username, username, pattern, query, limit, offset)
+}
+
+func (db *sharedStore) Usage() ([]OwnerUsage, error) {
+	rows, err := db.db.Query(`
+		SELECT COALESCE(u.username, '` + AnonymousOwner + `') AS owner, COUNT(*), CAST(COALESCE(SUM(o.size), 0) AS BIGINT)
+		FROM objects o LEFT JOIN users u ON u.id = o.owner_id
+		GROUP BY owner ORDER BY 3 DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usages := []OwnerUsage{}
+	for rows.Next() {
+		u := OwnerUsage{}
+		if err := rows.Scan(&u.Username, &u.Objects, &u.Bytes); err != nil {
+			return nil, err
+		}
+		usages = append(usages, u)
+	}
+	return usages, nil
+}
@@ -1,69 +1,49 @@
 package storage
 
 import (
-	"codeserver/internal/r2"
+	"codeserver/internal/audit"
+	"codeserver/internal/metrics"
+	"codeserver/internal/principal"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 )
 
-var dev bool
-
-func Init(tursoURL, tursoToken string, _dev bool) {
-	dev = _dev
-	dbInit(tursoURL, tursoToken, _dev)
-}
-
-func StorageHandler() http.Handler {
+func (s *Service) StorageHandler() http.Handler {
 	storageHandler := http.NewServeMux()
 	storageHandler.HandleFunc("POST /upload", func(w http.ResponseWriter, r *http.Request) {
-		if username := r.Header.Get("X-Username"); username != "" {
-			upload(w, r, username)
+		if p := principal.FromRequest(r); p != nil && p.Can(principal.ScopeStorageWrite) {
+			s.upload(w, r, p.Username)
 			return
 		}
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 	})
-	storageHandler.HandleFunc("GET /download", download)
-	storageHandler.HandleFunc("GET /list", list)
+	storageHandler.HandleFunc("GET /download", s.download)
+	storageHandler.HandleFunc("GET /list", s.list)
 	return storageHandler
 }
 
-func AnonymousHandler() http.Handler {
+func (s *Service) AnonymousHandler() http.Handler {
 	storageHandler := http.NewServeMux()
 	storageHandler.HandleFunc("POST /upload", func(w http.ResponseWriter, r *http.Request) {
-		upload(w, r, "anon")
+		s.upload(w, r, AnonymousOwner)
 	})
-	storageHandler.HandleFunc("GET /download", download)
-	if dev {
-		storageHandler.HandleFunc("GET /list", devlist)
-	}
+	storageHandler.HandleFunc("GET /download", s.download)
 	return storageHandler
 }
 
-func devlist(w http.ResponseWriter, r *http.Request) {
-	objs, err := showAll()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	for _, obj := range objs {
-		fmt.Println(obj)
-	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(objs)
-}
-
-func list(w http.ResponseWriter, r *http.Request) {
-	username := r.Header.Get("X-Username")
-	if username == "" {
+func (s *Service) list(w http.ResponseWriter, r *http.Request) {
+	p := principal.FromRequest(r)
+	if p == nil || !p.Can(principal.ScopeStorageRead) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
-	log.Printf("[/storage/list] user %s is trying to list objects", username)
-	objs, err := show(username)
+	username := p.Username
+	objs, err := s.store.List(username)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -77,8 +57,25 @@ func list(w http.ResponseWriter, r *http.Request) {
 // key: optional
 // path: optional
 // password: optional
-func upload(w http.ResponseWriter, r *http.Request, username string) {
+func (s *Service) upload(w http.ResponseWriter, r *http.Request, username string) {
+	ctx, finish, ok := s.startUpload(r.Context())
+	if !ok {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "server is shutting down, retry later", http.StatusServiceUnavailable)
+		return
+	}
+	defer finish()
+
+	if s.maxUploadSize > 0 {
+		// Leave room for the other form fields
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize+1<<20)
+	}
 	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "failed to parse form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -89,23 +86,33 @@ func upload(w http.ResponseWriter, r *http.Request, username string) {
 		return
 	}
 	defer file.Close()
+	if s.maxUploadSize > 0 && header.Size > s.maxUploadSize {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
 
 	key := r.FormValue("key")
 	path := r.FormValue("path")
 	password := r.FormValue("password")
-	log.Printf("[/storage/upload] user %s is trying to upload file with key %s; path: %s; password: %s", username, key, path, password)
 
 	filename := header.Filename
 	if path != "" {
 		filename = path
-		log.Printf("[/storage/upload] user %s is trying to upload file with path %s", username, filename)
 	}
+	slog.DebugContext(r.Context(), "uploading object", "username", username, "key", key, "path", filename, "size", header.Size, "protected", password != "")
 
-	uid, err := opupload(r.Context(), file, header.Size, key, username, password, filename)
+	uid, err := s.opupload(ctx, file, header.Size, key, username, password, filename)
+	e := audit.FromRequest(r, audit.Upload)
+	e.Actor, e.Username, e.Subject = principal.Username(r), username, uid
+	e.Detail = fmt.Sprintf("path=%s size=%d password=%t", filename, header.Size, password != "")
 	if err != nil {
+		e.Subject, e.Detail = key, e.Detail+" error="+err.Error()
+		s.audit.Record(e)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	e.Success = true
+	s.audit.Record(e)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"uid": uid})
@@ -113,7 +120,7 @@ func upload(w http.ResponseWriter, r *http.Request, username string) {
 
 // download will return the archived file to user according to the key
 // key: <uid> || <username>/<uid> || <username>/<path>
-func download(w http.ResponseWriter, r *http.Request) {
+func (s *Service) download(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 	pwd := r.URL.Query().Get("password")
 	// If contains multiple slashes, it must be username/path/path
@@ -132,52 +139,50 @@ func download(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	log.Printf("[/storage/download] user %s is trying to download object %s", r.Header.Get("X-Username"), key)
-	log.Printf("uid: %s, username: %s, path: %s", uid, username, path)
-
 	var obj *Object
 	var err error
-	if obj, err = get(uid); obj != nil || err != nil {
+	if obj, err = s.store.Get(uid); obj != nil || err != nil {
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		log.Printf("  Object found by uid: %s", obj.ID)
 	} else {
-		obj, err = getByUsernamePath(username, path)
+		obj, err = s.store.GetByUsernamePath(username, path)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if obj != nil {
-			log.Printf("  Object found by username/path: %s/%s; uid: %s", obj.Username, obj.Path, obj.ID)
-		}
 		if obj == nil {
 			http.Error(w, "object not found", http.StatusNotFound)
 			return
 		}
 	}
 
+	e := audit.FromRequest(r, audit.Download)
+	e.Actor, e.Username, e.Subject = principal.Username(r), obj.Username, obj.ID
+	e.Detail = fmt.Sprintf("path=%s password=%t", obj.Filename, obj.Password != "")
 	if obj.Password != "" && pwd != obj.Password {
-		log.Printf("Invalid password, returning StatusUnauthorized %d", http.StatusUnauthorized)
+		e.Detail += " error=invalid password"
+		s.audit.Record(e)
+		slog.InfoContext(r.Context(), "download refused, invalid password", "id", obj.ID)
 		http.Error(w, "invalid password", http.StatusUnauthorized)
 		return
 	}
 
-	log.Printf("[/storage/download] user %s is downloading object", r.Header.Get("X-Username"))
-	log.Printf("username: %s, filename: %s, path: %s, uid: %s", obj.Username, obj.Filename, obj.Path, obj.ID)
-	// return
+	slog.DebugContext(r.Context(), "downloading object", "id", obj.ID, "owner", obj.Username, "path", obj.Path)
 
 	// =================
 	// Download from R2
 	// =================
 
-	resp, err := r2.R2Client.GetObject(r.Context(), obj.Path)
+	resp, err := s.blob.GetObject(r.Context(), obj.Path)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
+	e.Success = true
+	s.audit.Record(e)
 
 	// Set headers
 	w.Header().Set("Content-Disposition", "attachment; filename="+sanitizeFilename(obj.Path))
@@ -188,9 +193,11 @@ func download(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Copy stream directly to response
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	n, err := io.Copy(w, resp.Body)
+	metrics.DownloadBytes.Add(float64(n))
+	if err != nil {
 		// Can’t write http.Error here since response may already be partially sent
-		fmt.Printf("download stream error: %v\n", err)
+		slog.WarnContext(r.Context(), "download stream failed", "id", obj.ID, "error", err)
 	}
 }
 
@@ -1,13 +1,13 @@
 package storage
 
 import (
-	"codeserver/internal/r2"
+	"codeserver/internal/metrics"
 	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"strings"
 )
 
@@ -25,15 +25,17 @@ func generateID(n int) (string, error) {
 
 // r2path returns the path to object inside R2 bucket
 // e.g. username: u, uid: 1234, path: dir/file.zip
-// will return u/uid/dir/file.zip
-func r2path(username, uid, path string) string {
+// will return u/uid/dir/file.zip. In a shared database objects don't follow
+// renames of their owner, the username is left out: 1234/dir/file.zip.
+func (s *Service) r2path(username, uid, path string) string {
+	if s.shared {
+		return fmt.Sprintf("%s/%s", uid, strings.Trim(path, "/"))
+	}
 	return fmt.Sprintf("%s/%s/%s", username, uid, strings.Trim(path, "/"))
 }
 
 // opupload will upload a file to R2 and insert a record to database
-func opupload(ctx context.Context, file io.Reader, size int64, key, username, password, path string) (string, error) {
-	const multipartThreshold = 100 << 20 // 100 MB
-
+func (s *Service) opupload(ctx context.Context, file io.Reader, size int64, key, username, password, path string) (string, error) {
 	if key == "" {
 		uid, err := generateID(10)
 		if err != nil {
@@ -42,9 +44,9 @@ func opupload(ctx context.Context, file io.Reader, size int64, key, username, pa
 		key = uid
 	}
 
-	objectPath := r2path(username, key, path)
+	objectPath := s.r2path(username, key, path)
 
-	err := insert(key, username, path, password, objectPath)
+	err := s.store.Insert(key, username, path, password, objectPath, size, s.now())
 	if err != nil {
 		return "", errors.New("[op upload] [insert] insert failed: " + err.Error())
 	}
@@ -52,17 +54,44 @@ func opupload(ctx context.Context, file io.Reader, size int64, key, username, pa
 	// return key, nil // For testing
 
 	// Only upload after insert is successfull
-	if size > multipartThreshold {
-		log.Print("Stream via multipart")
-		if err := r2.R2Client.UploadMultipart(ctx, objectPath, file, 8<<20); err != nil {
+	counted := &countingReader{r: file}
+	defer func() { metrics.UploadBytes.Add(float64(counted.n)) }()
+	if size > s.multipartThreshold {
+		slog.DebugContext(ctx, "uploading in parts", "path", objectPath, "size", size)
+		if err := s.blob.UploadMultipart(ctx, objectPath, counted, s.partSize); err != nil {
+			metrics.Uploads.WithLabelValues("multipart", "error").Inc()
+			s.removeFailed(key)
 			return "", errors.New("[op upload] [multipart] multipart upload failed: " + err.Error())
 		}
+		metrics.Uploads.WithLabelValues("multipart", "ok").Inc()
 	} else {
-		log.Print("Single PutObject")
-		if err := r2.R2Client.UploadStream(ctx, objectPath, file); err != nil {
+		slog.DebugContext(ctx, "uploading in one request", "path", objectPath, "size", size)
+		if err := s.blob.UploadStream(ctx, objectPath, counted); err != nil {
+			metrics.Uploads.WithLabelValues("single", "error").Inc()
+			s.removeFailed(key)
 			return "", errors.New("[op upload] [single putobject] upload failed: " + err.Error())
 		}
+		metrics.Uploads.WithLabelValues("single", "ok").Inc()
 	}
 
 	return key, nil
 }
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// removeFailed removes the record of an upload that didn't make it to R2
+func (s *Service) removeFailed(key string) {
+	if err := s.store.Remove(key); err != nil {
+		slog.Error("removing failed upload failed", "id", key, "error", err)
+	}
+}
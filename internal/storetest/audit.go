@@ -0,0 +1,63 @@
+package storetest
+
+import (
+	"codeserver/internal/audit"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Audit tests an audit.Log backed by an empty, migrated database
+func Audit(t *testing.T, log *audit.Log) {
+	start := time.Now().Truncate(time.Millisecond)
+
+	t.Run("events", func(t *testing.T) {
+		// User agents have no length limit
+		long := strings.Repeat("Mozilla/5.0 ", 100)
+		log.Record(audit.Event{Time: start, Type: audit.LoginSuccess, Actor: "alice", Username: "alice", IP: "192.0.2.1", Agent: long, Success: true})
+		log.Record(audit.Event{Time: start.Add(time.Second), Type: audit.Upload, Actor: "alice", Username: "alice", Subject: "id0", IP: "192.0.2.1"})
+		events, err := log.Query(audit.Filter{Username: "alice"})
+		check(t, err)
+		want(t, "events", len(events), 2)
+		if len(events) == 2 {
+			want(t, "newest first", events[0].Type, audit.Upload)
+			want(t, "long agent", events[1].Agent, long)
+			want(t, "time", events[1].Time.Equal(start), true)
+		}
+	})
+
+	t.Run("user IDs", func(t *testing.T) {
+		// IDs are looked up when the event is recorded, later holders of
+		// the username don't get to see them
+		ids := map[string]int64{"carol": 3}
+		log.SetUserLookup(func(username string) int64 { return ids[username] })
+		log.Record(audit.Event{Time: start, Type: audit.LoginSuccess, Actor: "carol", Username: "carol"})
+		ids["carol"] = 4
+		log.Record(audit.Event{Time: start, Type: audit.Register, Actor: "carol", Username: "carol"})
+		log.Record(audit.Event{Time: start, Type: audit.RoleChange, Actor: "admin", Username: "dave", UserID: 3})
+		events, err := log.Query(audit.Filter{UserID: 3})
+		check(t, err)
+		want(t, "events of user 3", len(events), 2)
+		for _, e := range events {
+			if e.Type == audit.LoginSuccess {
+				want(t, "actor ID", e.ActorID, 3)
+			}
+		}
+		events, err = log.Query(audit.Filter{UserID: 4})
+		check(t, err)
+		want(t, "events of user 4", len(events), 1)
+		log.SetUserLookup(nil)
+	})
+
+	t.Run("type prefix", func(t *testing.T) {
+		log.Record(audit.Event{Time: start, Type: "test_x.a"})
+		log.Record(audit.Event{Time: start, Type: "testyx.a"})
+		events, err := log.Query(audit.Filter{Type: "test_x"})
+		check(t, err)
+		want(t, "events of test_x", len(events), 1)
+		// Wildcards are matched literally
+		events, err = log.Query(audit.Filter{Type: "%"})
+		check(t, err)
+		want(t, "events of %", len(events), 0)
+	})
+}
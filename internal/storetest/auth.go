@@ -0,0 +1,342 @@
+package storetest
+
+import (
+	"codeserver/internal/auth"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Auth tests an auth.Store backed by an empty, migrated database
+func Auth(t *testing.T, store auth.Store) {
+	renames, err := store.UsernameRenames()
+	check(t, err)
+	want(t, "username renames of a new database", len(renames), 0)
+
+	t.Run("users", func(t *testing.T) {
+		check(t, store.CreateUser("alice@example.com", "secret password", "Alice", false, 2))
+		want(t, "duplicate email", store.CreateUser("alice@example.com", "", "alice2", true, 0), error(auth.ErrUserAlreadyExists))
+
+		user, err := store.GetUser("alice@example.com")
+		check(t, err)
+		want(t, "username", user.Username, "Alice")
+		want(t, "verified", user.EmailVerified, false)
+		want(t, "invite quota", user.InviteQuota, 2)
+		want(t, "role", user.Role, "user")
+		want(t, "created at set", user.CreatedAt != "", true)
+		want(t, "password hashed", user.Password != "" && user.Password != "secret password", true)
+
+		_, err = store.GetUser("nobody@example.com")
+		want(t, "unknown email", err, error(auth.ErrUserNotFound))
+
+		byName, err := store.GetUserByUsername("aLiCe")
+		check(t, err)
+		want(t, "by username ignoring case", byName.Email, "alice@example.com")
+		want(t, "ID", byName.ID, user.ID)
+		want(t, "exists ignoring case", store.UsernameExists("ALICE"), true)
+		want(t, "unknown username", store.UsernameExists("bob"), false)
+
+		admins, err := store.CountAdmins()
+		check(t, err)
+		want(t, "admins", admins, 0)
+		check(t, store.SetEmailVerified("alice@example.com"))
+		check(t, store.SetRole("alice@example.com", "admin"))
+		admins, err = store.CountAdmins()
+		check(t, err)
+		want(t, "admins after promoting", admins, 1)
+		check(t, store.SetDisabled("alice@example.com", true))
+		check(t, store.SetPassword("alice@example.com", "new password"))
+		updated, err := store.GetUser("alice@example.com")
+		check(t, err)
+		want(t, "verified", updated.EmailVerified, true)
+		want(t, "role", updated.Role, "admin")
+		want(t, "disabled", updated.Disabled, true)
+		want(t, "password changed", updated.Password != user.Password, true)
+
+		check(t, store.CreateUser("bob@example.com", "", "bob", true, 0))
+		bob, err := store.GetUser("bob@example.com")
+		check(t, err)
+		want(t, "distinct IDs", bob.ID != user.ID && bob.ID != 0 && user.ID != 0, true)
+		want(t, "taken username", store.SetUsername("bob@example.com", "ALICE"), error(auth.ErrUsernameTaken))
+		check(t, store.SetUsername("bob@example.com", "robert"))
+	})
+
+	t.Run("search", func(t *testing.T) {
+		check(t, store.CreateUser("percent@example.com", "", "100%_sure", true, 0))
+		users, err := store.SearchUsers("EXAMPLE.COM", 10, 0)
+		check(t, err)
+		want(t, "matches ignoring case", len(users), 3)
+		if len(users) == 3 {
+			want(t, "ordered by username", users[0].Username, "100%_sure")
+		}
+		users, err = store.SearchUsers("%_", 10, 0)
+		check(t, err)
+		want(t, "wildcards are literal", len(users), 1)
+		users, err = store.SearchUsers("example", 1, 1)
+		check(t, err)
+		want(t, "limit and offset", len(users), 1)
+		if len(users) == 1 {
+			want(t, "second user", users[0].Username, "Alice")
+		}
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		check(t, store.CreateUser("carol@example.com", "", "carol", true, 0))
+		before, err := store.CountSessions()
+		check(t, err)
+		first, err := store.CreateSession("carol@example.com", "firefox")
+		check(t, err)
+		second, err := store.CreateSession("carol@example.com", "curl")
+		check(t, err)
+		third, err := store.CreateSession("carol@example.com", "chrome")
+		check(t, err)
+		check(t, store.SetSessionLocation(first, "Berlin, DE"))
+		count, err := store.CountSessions()
+		check(t, err)
+		want(t, "session count", count, before+3)
+
+		session, err := store.GetSession(first)
+		check(t, err)
+		want(t, "email", session.Email, "carol@example.com")
+		want(t, "agent", session.Agent, "firefox")
+		want(t, "location", session.Location, "Berlin, DE")
+		want(t, "last seen set", session.LastSeen != "", true)
+
+		user, err := store.GetUserFromSessionID(second)
+		check(t, err)
+		want(t, "session user", user.Username, "carol")
+
+		check(t, store.DeleteSession(second))
+		if _, err := store.GetSession(second); err == nil {
+			t.Error("deleted session still exists")
+		}
+		check(t, store.DeleteOtherSessions("carol@example.com", first))
+		sessions, err := store.GetSessions("carol@example.com")
+		check(t, err)
+		want(t, "sessions left", len(sessions), 1)
+		if _, err := store.GetSession(third); err == nil {
+			t.Error("other session still exists")
+		}
+		check(t, store.DeleteSessions("carol@example.com"))
+		sessions, err = store.GetSessions("carol@example.com")
+		check(t, err)
+		want(t, "sessions left", len(sessions), 0)
+
+		// User agents have no length limit
+		long := strings.Repeat("Mozilla/5.0 ", 100)
+		id, err := store.CreateSession("carol@example.com", long)
+		check(t, err)
+		session, err = store.GetSession(id)
+		check(t, err)
+		want(t, "long agent", session.Agent, long)
+	})
+
+	t.Run("identities", func(t *testing.T) {
+		check(t, store.CreateUser("dave@example.com", "", "dave", true, 0))
+		_, err := store.GetIdentity("github", "42")
+		want(t, "unknown identity", err, error(auth.ErrIdentityNotFound))
+		check(t, store.LinkIdentity("github", "42", "dave@example.com"))
+		want(t, "linked twice", store.LinkIdentity("github", "42", "dave@example.com"), error(auth.ErrIdentityLinked))
+		identity, err := store.GetIdentity("github", "42")
+		check(t, err)
+		want(t, "identity email", identity.Email, "dave@example.com")
+	})
+
+	t.Run("totp", func(t *testing.T) {
+		check(t, store.CreateUser("erin@example.com", "", "erin", true, 0))
+		check(t, store.SetTOTPSecret("erin@example.com", "SECRET"))
+		check(t, store.EnableTOTP("erin@example.com", []string{"code-one", "code-two"}))
+		user, err := store.GetUser("erin@example.com")
+		check(t, err)
+		want(t, "secret", user.TOTPSecret, "SECRET")
+		want(t, "enabled", user.TOTPEnabled, true)
+
+		ok, err := store.UseTOTPCounter("erin@example.com", 100)
+		check(t, err)
+		want(t, "new counter", ok, true)
+		ok, err = store.UseTOTPCounter("erin@example.com", 100)
+		check(t, err)
+		want(t, "replayed counter", ok, false)
+		ok, err = store.UseTOTPCounter("erin@example.com", 99)
+		check(t, err)
+		want(t, "earlier counter", ok, false)
+
+		ok, err = store.UseRecoveryCode("erin@example.com", " CODE-ONE ")
+		check(t, err)
+		want(t, "recovery code", ok, true)
+		ok, err = store.UseRecoveryCode("erin@example.com", "code-one")
+		check(t, err)
+		want(t, "used recovery code", ok, false)
+
+		check(t, store.DisableTOTP("erin@example.com"))
+		user, err = store.GetUser("erin@example.com")
+		check(t, err)
+		want(t, "disabled", user.TOTPEnabled, false)
+		want(t, "secret cleared", user.TOTPSecret, "")
+		ok, err = store.UseRecoveryCode("erin@example.com", "code-two")
+		check(t, err)
+		want(t, "recovery code after disabling", ok, false)
+	})
+
+	t.Run("email and deletion", func(t *testing.T) {
+		check(t, store.CreateUser("frank@example.com", "", "frank", false, 0))
+		session, err := store.CreateSession("frank@example.com", "firefox")
+		check(t, err)
+		check(t, store.LinkIdentity("gitlab", "7", "frank@example.com"))
+
+		want(t, "change to taken address", store.ChangeEmail("frank@example.com", "alice@example.com"), error(auth.ErrUserAlreadyExists))
+		want(t, "change unknown user", store.ChangeEmail("nobody@example.com", "new@example.com"), error(auth.ErrUserNotFound))
+		check(t, store.ChangeEmail("frank@example.com", "franklin@example.com"))
+		user, err := store.GetUserFromSessionID(session)
+		check(t, err)
+		want(t, "session moved", user.Email, "franklin@example.com")
+		want(t, "verified by the change", user.EmailVerified, true)
+		identity, err := store.GetIdentity("gitlab", "7")
+		check(t, err)
+		want(t, "identity moved", identity.Email, "franklin@example.com")
+
+		check(t, store.DeleteUser("franklin@example.com"))
+		_, err = store.GetUser("franklin@example.com")
+		want(t, "deleted user", err, error(auth.ErrUserNotFound))
+		if _, err := store.GetSession(session); err == nil {
+			t.Error("session of deleted user still exists")
+		}
+		_, err = store.GetIdentity("gitlab", "7")
+		want(t, "identity of deleted user", err, error(auth.ErrIdentityNotFound))
+	})
+
+	t.Run("login challenges", func(t *testing.T) {
+		check(t, store.CreateUser("heidi@example.com", "", "heidi", true, 0))
+		now := time.Unix(1700000000, 0)
+		id, err := store.CreateLoginChallenge("heidi@example.com", "password", now.Add(time.Minute))
+		check(t, err)
+		challenge, err := store.TakeLoginChallenge(id, now)
+		check(t, err)
+		if challenge == nil || challenge.Email != "heidi@example.com" || challenge.Method != "password" {
+			t.Fatalf("challenge %+v", challenge)
+		}
+		challenge, err = store.TakeLoginChallenge(id, now)
+		check(t, err)
+		want(t, "challenge taken twice", challenge, nil)
+
+		id, err = store.CreateLoginChallenge("heidi@example.com", "password", now.Add(time.Minute))
+		check(t, err)
+		challenge, err = store.TakeLoginChallenge(id, now.Add(2*time.Minute))
+		check(t, err)
+		want(t, "expired challenge", challenge, nil)
+
+		id, err = store.CreateLoginChallenge("heidi@example.com", "password", now.Add(time.Minute))
+		check(t, err)
+		check(t, store.DeleteUser("heidi@example.com"))
+		challenge, err = store.TakeLoginChallenge(id, now)
+		check(t, err)
+		want(t, "challenge of deleted user", challenge, nil)
+	})
+
+	t.Run("pending OIDC steps", func(t *testing.T) {
+		now := time.Unix(1700000000, 0)
+		id, err := store.CreatePending("state", []byte(`{"nonce":"abc"}`), now.Add(time.Minute))
+		check(t, err)
+		data, err := store.GetPending("registration", id, now)
+		check(t, err)
+		want(t, "other kind", data == nil, true)
+		data, err = store.GetPending("state", id, now)
+		check(t, err)
+		want(t, "peek", string(data), `{"nonce":"abc"}`)
+		data, err = store.TakePending("state", id, now)
+		check(t, err)
+		want(t, "take after peeking", string(data), `{"nonce":"abc"}`)
+		data, err = store.TakePending("state", id, now)
+		check(t, err)
+		want(t, "taken twice", data == nil, true)
+
+		id, err = store.CreatePending("state", []byte(`{}`), now.Add(time.Minute))
+		check(t, err)
+		data, err = store.GetPending("state", id, now.Add(2*time.Minute))
+		check(t, err)
+		want(t, "expired peek", data == nil, true)
+		data, err = store.TakePending("state", id, now.Add(2*time.Minute))
+		check(t, err)
+		want(t, "expired", data == nil, true)
+	})
+
+	t.Run("login failures", func(t *testing.T) {
+		now := time.Unix(1700000000, 0)
+		failures, last, locked, err := store.GetLoginFailures("ip:192.0.2.1")
+		check(t, err)
+		want(t, "unknown key", failures, 0)
+		want(t, "unknown key last failure", last.IsZero(), true)
+		want(t, "unknown key locked", locked.IsZero(), true)
+
+		for i := 1; i <= 3; i++ {
+			failures, err = store.AddLoginFailure("ip:192.0.2.1", now, now.Add(-time.Hour))
+			check(t, err)
+			want(t, "failures", failures, i)
+		}
+		check(t, store.RemoveLoginFailure("ip:192.0.2.1"))
+		failures, last, _, err = store.GetLoginFailures("ip:192.0.2.1")
+		check(t, err)
+		want(t, "failures after taking one back", failures, 2)
+		want(t, "last failure after taking one back", last.Unix(), now.Unix())
+		later := now.Add(2 * time.Hour)
+		failures, err = store.AddLoginFailure("ip:192.0.2.1", later, later.Add(-time.Hour))
+		check(t, err)
+		want(t, "failures after the window", failures, 1)
+
+		ok, err := store.LockLogin("ip:192.0.2.1", later, later.Add(time.Minute))
+		check(t, err)
+		want(t, "lock", ok, true)
+		ok, err = store.LockLogin("ip:192.0.2.1", later, later.Add(time.Minute))
+		check(t, err)
+		want(t, "lock twice", ok, false)
+		_, last, locked, err = store.GetLoginFailures("ip:192.0.2.1")
+		check(t, err)
+		want(t, "last failure", last.Unix(), later.Unix())
+		want(t, "locked until", locked.Unix(), later.Add(time.Minute).Unix())
+
+		check(t, store.DeleteLoginFailures("ip:192.0.2.1"))
+		failures, _, _, err = store.GetLoginFailures("ip:192.0.2.1")
+		check(t, err)
+		want(t, "failures after deleting", failures, 0)
+	})
+
+	t.Run("invites", func(t *testing.T) {
+		check(t, store.CreateUser("grace@example.com", "", "grace", true, 1))
+		ok, err := store.UseInviteQuota("grace@example.com")
+		check(t, err)
+		want(t, "quota", ok, true)
+		ok, err = store.UseInviteQuota("grace@example.com")
+		check(t, err)
+		want(t, "quota used up", ok, false)
+
+		check(t, store.CreateInvite("INVITE", "grace@example.com"))
+		ok, err = store.ClaimInvite("INVITE", "heidi@example.com", time.Now().Add(time.Hour))
+		check(t, err)
+		want(t, "claim expired", ok, false)
+		ok, err = store.ClaimInvite("INVITE", "heidi@example.com", time.Now().Add(-time.Hour))
+		check(t, err)
+		want(t, "claim", ok, true)
+		ok, err = store.ClaimInvite("INVITE", "ivan@example.com", time.Time{})
+		check(t, err)
+		want(t, "claim twice", ok, false)
+		ok, err = store.ClaimInvite("UNKNOWN", "ivan@example.com", time.Time{})
+		check(t, err)
+		want(t, "claim unknown", ok, false)
+
+		invites, err := store.GetInvites("grace@example.com")
+		check(t, err)
+		want(t, "invites", len(invites), 1)
+		if len(invites) == 1 {
+			want(t, "used by", invites[0].UsedBy, "heidi@example.com")
+			want(t, "used at set", invites[0].UsedAt != "", true)
+		}
+
+		check(t, store.ReleaseInvite("INVITE"))
+		invites, err = store.GetInvites("grace@example.com")
+		check(t, err)
+		if len(invites) == 1 {
+			want(t, "released", invites[0].UsedBy, "")
+			want(t, "used at cleared", invites[0].UsedAt, "")
+		}
+	})
+}
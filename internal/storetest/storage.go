@@ -0,0 +1,108 @@
+package storetest
+
+import (
+	"codeserver/internal/storage"
+	"testing"
+	"time"
+)
+
+// Storage tests a storage.Store backed by an empty, migrated database
+func Storage(t *testing.T, store storage.Store) {
+	now := time.Unix(1700000000, 0)
+	check(t, store.Insert("id1", "alice", "notes/Todo.txt", "", "alice/id1", 10, now))
+	check(t, store.Insert("id2", "alice", "photo.jpg", "secret", "alice/id2", 200, now.Add(time.Minute)))
+	check(t, store.Insert("id3", "bob", "100%_done.txt", "", "bob/id3", 5, now.Add(2*time.Minute)))
+	if err := store.Insert("id4", "alice", "photo.jpg", "", "alice/id4", 1, now); err == nil {
+		t.Error("inserted a second object with the same owner and filename")
+	}
+
+	t.Run("get", func(t *testing.T) {
+		obj, err := store.Get("id2")
+		check(t, err)
+		if obj == nil {
+			t.Fatal("object not found")
+		}
+		want(t, "owner", obj.Username, "alice")
+		want(t, "filename", obj.Filename, "photo.jpg")
+		want(t, "password", obj.Password, "secret")
+		want(t, "path", obj.Path, "alice/id2")
+
+		obj, err = store.Get("unknown")
+		check(t, err)
+		want(t, "unknown ID", obj, (*storage.Object)(nil))
+
+		obj, err = store.GetByUsernamePath("alice", "notes/Todo.txt")
+		check(t, err)
+		if obj == nil || obj.ID != "id1" {
+			t.Errorf("by username and path: got %v", obj)
+		}
+		obj, err = store.GetByUsernamePath("bob", "notes/Todo.txt")
+		check(t, err)
+		want(t, "other owner's path", obj, (*storage.Object)(nil))
+	})
+
+	t.Run("list", func(t *testing.T) {
+		objs, err := store.List("alice")
+		check(t, err)
+		want(t, "objects", len(objs), 2)
+		for _, obj := range objs {
+			want(t, "created at", obj.CreatedAt != "", true)
+		}
+	})
+
+	t.Run("search", func(t *testing.T) {
+		objs, err := store.Search("", "TODO", 10, 0)
+		check(t, err)
+		want(t, "matches ignoring case", len(objs), 1)
+		objs, err = store.Search("", "", 10, 0)
+		check(t, err)
+		want(t, "all objects", len(objs), 3)
+		if len(objs) == 3 {
+			want(t, "newest first", objs[0].ID, "id3")
+			want(t, "size", objs[0].Size, int64(5))
+		}
+		objs, err = store.Search("alice", "", 10, 0)
+		check(t, err)
+		want(t, "objects of one owner", len(objs), 2)
+		objs, err = store.Search("", "%_", 10, 0)
+		check(t, err)
+		want(t, "wildcards are literal", len(objs), 1)
+		objs, err = store.Search("", "id2", 10, 0)
+		check(t, err)
+		want(t, "by ID", len(objs), 1)
+		objs, err = store.Search("", "", 1, 1)
+		check(t, err)
+		if len(objs) != 1 || objs[0].ID != "id2" {
+			t.Errorf("limit and offset: got %v", objs)
+		}
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		usage, err := store.Usage()
+		check(t, err)
+		want(t, "owners", len(usage), 2)
+		if len(usage) == 2 {
+			want(t, "largest first", usage[0], storage.OwnerUsage{Username: "alice", Objects: 2, Bytes: 210})
+		}
+	})
+
+	t.Run("rename and remove", func(t *testing.T) {
+		check(t, store.RenameOwner("alice", "alicia", map[string]string{"id1": "alicia/id1", "id2": "alicia/id2"}))
+		objs, err := store.List("alice")
+		check(t, err)
+		want(t, "objects of the old name", len(objs), 0)
+		obj, err := store.Get("id1")
+		check(t, err)
+		if obj == nil || obj.Username != "alicia" || obj.Path != "alicia/id1" {
+			t.Errorf("renamed object: got %v", obj)
+		}
+
+		check(t, store.Remove("id1"))
+		obj, err = store.Get("id1")
+		check(t, err)
+		want(t, "removed object", obj, (*storage.Object)(nil))
+		objs, err = store.List("alicia")
+		check(t, err)
+		want(t, "objects left", len(objs), 1)
+	})
+}
@@ -0,0 +1,144 @@
+// Package storetest is the conformance suite of the auth and storage stores.
+// A backend runs it from a test with a function returning a new, empty
+// database of its kind:
+//
+//	func TestPostgres(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) *database.DB { ... })
+//	}
+//
+// Run migrates the database and tests NewStore of both packages,
+// NewSharedStore with auth in the same database and the audit log. Auth and Storage test any
+// other implementation of the interfaces.
+package storetest
+
+import (
+	"codeserver/internal/audit"
+	"codeserver/internal/auth"
+	"codeserver/internal/database"
+	"codeserver/internal/migrate"
+	"codeserver/internal/storage"
+	"context"
+	"testing"
+	"time"
+)
+
+// Run runs the suite against the SQL stores, open is called for every
+// package and has to return an empty database
+func Run(t *testing.T, open func(t *testing.T) *database.DB) {
+	t.Run("auth", func(t *testing.T) {
+		db := open(t)
+		up(t, db, auth.Schemas[db.Dialect])
+		Auth(t, auth.NewStore(db))
+	})
+	t.Run("audit", func(t *testing.T) {
+		db := open(t)
+		up(t, db, audit.Schemas[db.Dialect])
+		Audit(t, audit.New(db, nil))
+	})
+	t.Run("storage", func(t *testing.T) {
+		db := open(t)
+		up(t, db, storage.Schemas[db.Dialect])
+		Storage(t, storage.NewStore(db))
+	})
+	t.Run("shared", func(t *testing.T) {
+		db := open(t)
+		up(t, db, auth.Schemas[db.Dialect])
+		up(t, db, storage.SharedSchemas[db.Dialect])
+		users := auth.NewStore(db)
+		for _, name := range []string{"alice", "bob"} {
+			check(t, users.CreateUser(name+"@example.com", "", name, true, 0))
+		}
+		store := storage.NewSharedStore(db)
+		want(t, "unknown owner", store.Insert("id0", "nobody", "a.txt", "", "nobody/id0", 1, time.Now()), storage.ErrOwnerNotFound)
+		Storage(t, sharedRename{Store: store, users: users})
+
+		// The owner has to exist and takes its objects along, also in SQLite
+		// where foreign keys aren't enforced by default
+		check(t, users.CreateUser("carol@example.com", "", "carol", true, 0))
+		check(t, store.Insert("owned", "carol", "a.txt", "", "owned/a.txt", 1, time.Now()))
+		if _, err := db.Exec("INSERT INTO objects (id, owner_id, filename, path) VALUES ('orphan', -1, 'b.txt', 'orphan/b.txt')"); err == nil {
+			t.Error("object of a missing owner inserted")
+		}
+		// Anonymous uploads have no user row and survive deleting users
+		anon := storage.AnonymousOwner
+		check(t, store.Insert("anon0", anon, "a.txt", "", "anon/anon0", 2, time.Now()))
+		if err := store.Insert("anon1", anon, "a.txt", "", "anon/anon1", 2, time.Now()); err == nil {
+			t.Error("duplicate anonymous filename inserted")
+		}
+		check(t, users.DeleteUser("carol@example.com"))
+		obj, err := store.GetByUsernamePath(anon, "a.txt")
+		check(t, err)
+		if obj == nil || obj.ID != "anon0" || obj.Username != anon {
+			t.Errorf("anonymous object = %+v", obj)
+		}
+		objs, err := store.List(anon)
+		check(t, err)
+		want(t, "anonymous objects", len(objs), 1)
+		usages, err := store.Usage()
+		check(t, err)
+		found := false
+		for _, u := range usages {
+			found = found || u.Username == anon && u.Objects == 1 && u.Bytes == 2
+		}
+		if !found {
+			t.Errorf("usage of anonymous objects missing from %+v", usages)
+		}
+		// Get joins the owner, count the rows themselves
+		var n int
+		check(t, db.QueryRow("SELECT COUNT(*) FROM objects WHERE id IN ('owned', 'orphan')").Scan(&n))
+		want(t, "objects of deleted or missing owners", n, 0)
+	})
+}
+
+// sharedRename renames the user after the objects like the auth service, in
+// a shared database that is what moves them to the new owner
+type sharedRename struct {
+	storage.Store
+	users auth.Store
+}
+
+func (s sharedRename) RenameOwner(oldUsername, newUsername string, paths map[string]string) error {
+	if err := s.Store.RenameOwner(oldUsername, newUsername, paths); err != nil {
+		return err
+	}
+	user, err := s.users.GetUserByUsername(oldUsername)
+	if err != nil {
+		return err
+	}
+	return s.users.SetUsername(user.Email, newUsername)
+}
+
+// up applies every migration, then reverts and applies them again so the
+// down migrations are covered as well
+func up(t *testing.T, db *database.DB, s migrate.Schema) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := migrate.Up(ctx, db, s, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrate.Down(ctx, db, s, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrate.Up(ctx, db, s, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate.Check(ctx, db, s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// check fails the test if err is not nil
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// want fails the test if got isn't what was expected
+func want[T comparable](t *testing.T, what string, got, expected T) {
+	t.Helper()
+	if got != expected {
+		t.Errorf("%s: got %v, want %v", what, got, expected)
+	}
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"codeserver/internal/certfile"
+	"codeserver/internal/config"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serverTLS sets up HTTPS on srv from the certificate files or ACME, for
+// plain HTTP srv.TLSConfig stays nil. stop ends what runs alongside: the
+// reloading of the files or the HTTP-01 challenge listener.
+func serverTLS(c *config.Config, srv *http.Server) (stop func(), err error) {
+	switch {
+	case c.TLS.CertFile != "":
+		certs, err := certfile.Load(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go certs.Watch(ctx, c.TLS.ReloadInterval, hup)
+		srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		return func() {
+			signal.Stop(hup)
+			cancel()
+		}, nil
+	case len(c.TLS.ACME.Domains) > 0:
+		return acmeTLS(c.TLS.ACME, srv)
+	}
+	return func() {}, nil
+}
+
+// acmeTLS gets the certificates of srv from the ACME directory. TLS-ALPN-01
+// challenges are answered by srv itself, HTTP-01 ones by a listener on the
+// HTTP port which redirects everything else to HTTPS.
+func acmeTLS(c config.ACME, srv *http.Server) (stop func(), err error) {
+	client := &acme.Client{DirectoryURL: c.DirectoryURL}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("tls.acme.ca_file: no certificates found in " + c.CAFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+			Timeout:   time.Minute,
+		}
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(c.CacheDir),
+		HostPolicy: autocert.HostWhitelist(c.Domains...),
+		Email:      c.Email,
+		Client:     client,
+	}
+	srv.TLSConfig = manager.TLSConfig()
+	if c.HTTPPort == 0 {
+		return func() {}, nil
+	}
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", c.HTTPPort))
+	if err != nil {
+		return nil, fmt.Errorf("ACME HTTP-01 listener: %w", err)
+	}
+	httpHandler := manager.HTTPHandler(nil)
+	challenges := &http.Server{
+		// Validation on a port other than 80, e.g. by Pebble, sends it in the
+		// Host header, which the host policy would reject
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if host, _, err := net.SplitHostPort(r.Host); err == nil {
+				r.Host = host
+			}
+			httpHandler.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+	go func() {
+		if err := challenges.Serve(lis); err != http.ErrServerClosed {
+			slog.Error("ACME HTTP-01 listener stopped", "error", err)
+		}
+	}()
+	slog.Info("answering ACME HTTP-01 challenges", "port", c.HTTPPort)
+	return func() { challenges.Close() }, nil
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"codeserver/internal/config"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestACME gets a certificate from the Pebble directory in
+// CODESERVER_TEST_PEBBLE, e.g. https://localhost:14000/dir, which is trusted
+// with CODESERVER_TEST_PEBBLE_CA (its test/certs/pebble.minica.pem). Pebble
+// validates HTTP-01 challenges on port 5002, where the test answers them for
+// the domain in CODESERVER_TEST_PEBBLE_DOMAIN (default codeserver.test), so
+// either run it with PEBBLE_VA_ALWAYS_VALID=1 or have pebble-challtestsrv
+// resolve the domain to this host:
+//
+//	docker run -p 14000:14000 -e PEBBLE_VA_ALWAYS_VALID=1 ghcr.io/letsencrypt/pebble
+func TestACME(t *testing.T) {
+	directory := os.Getenv("CODESERVER_TEST_PEBBLE")
+	if directory == "" {
+		t.Skip("CODESERVER_TEST_PEBBLE is not set")
+	}
+	domain := os.Getenv("CODESERVER_TEST_PEBBLE_DOMAIN")
+	if domain == "" {
+		domain = "codeserver.test"
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	stop, err := acmeTLS(config.ACME{
+		Domains:      []string{domain},
+		CacheDir:     t.TempDir(),
+		DirectoryURL: directory,
+		CAFile:       os.Getenv("CODESERVER_TEST_PEBBLE_CA"),
+		HTTPPort:     5002,
+	}, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	// The first handshake waits for the order, Pebble's root is generated at
+	// startup so the chain isn't verified
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: time.Minute},
+		Config:    &tls.Config{ServerName: domain, InsecureSkipVerify: true},
+	}
+	conn, err := dialer.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	leaf := conn.(*tls.Conn).ConnectionState().PeerCertificates[0]
+	if !slices.Contains(leaf.DNSNames, domain) {
+		t.Errorf("certificate for %v, want %s", leaf.DNSNames, domain)
+	}
+	if leaf.Issuer.CommonName == leaf.Subject.CommonName {
+		t.Errorf("self-signed certificate %q", leaf.Subject.CommonName)
+	}
+}